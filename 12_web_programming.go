@@ -29,102 +29,5594 @@
 // - Form submissions send data to the server using an HTTP POST request
 // - Access and process form data in the POST handler function
 
+// TLS and HTTP/2 in Go:
+// - Use 'http.Server.ListenAndServeTLS(certFile, keyFile)' to serve HTTPS with a certificate and private key
+// - Set 'http.Server.Protocols' to choose which protocols the server speaks (HTTP/2 needs TLS in browsers)
+// - Run a second plain HTTP server that answers with 'http.Redirect' to send clients to the HTTPS address
+// - Use the 'flag' package to read options such as '--tls-cert' and '--tls-key' from the command line
+
+// Certificates in Go:
+// - The 'crypto/x509' package creates and parses certificates with 'x509.CreateCertificate'
+// - A certificate authority (CA) signs leaf certificates, so trusting the CA trusts every leaf it signs
+// - Use 'encoding/pem' to write certificates and keys in the PEM format expected by 'tls.LoadX509KeyPair'
+// - Self-signed certificates are only for development and must never be used in production
+
+// Middleware and response compression in Go:
+// - Middleware is a function that takes an 'http.Handler' and returns a new one wrapping it
+// - Wrap 'http.ResponseWriter' in a struct to change how a response is written (e.g. compress it)
+// - Use 'compress/gzip' and 'compress/zlib' for the 'gzip' and 'deflate' content encodings
+// - Read the 'Accept-Encoding' request header to pick an encoding and always set 'Vary: Accept-Encoding'
+// - Implement 'Flush' so streaming responses are sent immediately instead of being buffered
+
+// Scheduling in Go:
+// - Use 'time.NewTicker' in a goroutine to run background work at a fixed interval
+// - A cron expression has 5 fields: minute, hour, day of month, month and day of week (e.g. '0 9 * * 1')
+// - Use 'time.Date' to build times, it normalizes overflow such as hour 24 into the next day
+// - Store bitsets in a 'uint64' to check whether a minute, hour or day matches with a single AND
+
+// Idempotent requests in Go:
+// - Clients send an 'Idempotency-Key' header so a retried POST is not applied twice
+// - Record the first response for each key and replay it for repeats until the key expires
+// - Hash the request body with 'crypto/sha256' to detect a key reused for a different request
+
+// Request context in Go:
+// - Use 'context.WithValue' to attach request-scoped values such as the selected workspace
+// - Use an unexported key type for context values so other packages cannot collide with them
+// - Use 'r.WithContext(ctx)' to pass the new context to the next handler
+
+// CORS in Go:
+// - Browsers only let a page call an API on another origin when the response has 'Access-Control-Allow-Origin'
+// - Before non-simple requests browsers send an 'OPTIONS' preflight with 'Access-Control-Request-Method'
+// - Answer preflights in middleware so they never reach handlers that reject unknown methods
+// - Never combine 'Access-Control-Allow-Credentials: true' with the '*' origin, echo an origin from an explicit list instead
+
+// API versioning in Go:
+// - Put the version in the path (e.g. '/v1/tasks') so old clients keep working when the response shape changes
+// - Map the internal 'Task' to a separate struct per version instead of changing the JSON of existing versions
+// - Mark old versions with the 'Deprecation' and 'Sunset' headers and link to the successor version
+
+// Request IDs and tracing in Go:
+// - Give every request an ID ('X-Request-ID') so its log lines and error responses can be matched up
+// - The W3C 'traceparent' header carries a trace ID and parent span ID between services
+// - Store the IDs in the request context and pass 'ctx' down to the store and the logger
+// - Use 'log/slog' for structured logs, a custom 'slog.Handler' can add values from the context to every line
+
+// File uploads and downloads in Go:
+// - Use 'r.MultipartReader()' to stream 'multipart/form-data' parts to disk without holding them in memory
+// - Use 'http.MaxBytesReader' and 'io.LimitReader' to cap how much a client can upload
+// - Use 'http.DetectContentType' on the first 512 bytes to check what a file really is instead of trusting its name
+// - Use 'http.ServeContent' to send files, it handles 'Range' requests for partial downloads
+
+// Pagination in Go:
+// - Return large lists in pages using a 'limit' and a cursor such as the last ID seen ('after')
+// - Cursors stay correct when items are added or removed, unlike page numbers or offsets
+
+// Ordering with fractional ranks:
+// - Give each item a string rank and sort by it, like words in a dictionary
+// - To move an item between two others, create a new rank that sorts between their ranks
+// - Only the moved item changes, so reordering never rewrites the rest of the list
+
+// Syncing offline clients:
+// - Number every write with a growing sequence number and let clients ask for everything after the last one they saw
+// - Keep a tombstone for each delete, otherwise clients cannot tell a deleted task from one that did not change
+// - Resolve conflicting writes with "last writer wins": the change with the newest modification time is kept
+
+// Dependencies between tasks:
+// - Dependencies form a directed graph, adding an edge must not close a cycle or no task could ever start
+// - A depth-first search from the new dependency back to the task finds such a cycle before it is stored
+// - A topological sort (Kahn's algorithm) lists tasks so every task comes after the tasks it waits for
+
+// Calendar feeds in Go:
+// - An iCalendar ('.ics') file is text with one 'NAME:value' property per line, ending in CRLF
+// - Lines longer than 75 bytes are folded onto the next line, which starts with a space
+// - Escape backslashes, ';', ',' and newlines in text values so they are not read as separators
+// - Use 'time.LoadLocation' and 't.ZoneBounds()' to describe a time zone and its daylight saving changes
+
+// Soft deletion:
+// - Instead of removing a deleted row, mark it with the time of deletion and hide it from normal reads
+// - A restore only clears the mark, so IDs, comments and attachments come back unchanged
+// - A background job purges rows that stayed deleted longer than a retention period
+
+// Text templates in Go:
+// - The 'text/template' package fills in placeholders such as '{{.version}}' from a map or struct
+// - Use 'Option("missingkey=zero")' so a missing variable is empty instead of '<no value>'
+// - Templates from users can loop or call 'printf', walk the parsed tree to allow only what is safe
+
+// Plain text formats:
+// - todo.txt keeps one task per line: 'x' when done, '(A)' priority, dates, '+project', '@context' and 'key:value'
+// - Read lines with 'bufio.Scanner' and split them into words with 'strings.Fields'
+// - Write with 'bufio.Writer' and 'Flush' at the end so many small writes become few large ones
+
+// JSON-RPC in Go:
+// - JSON-RPC 2.0 sends '{"jsonrpc": "2.0", "method": ..., "params": ..., "id": ...}' and gets a result or an error back
+// - A call without an 'id' is a notification, it runs but gets no response
+// - An array of calls is a batch, answered with an array, or nothing at all when every call was a notification
+// - Errors carry standard codes such as -32700 (parse error), -32601 (method not found) and -32602 (invalid params)
+// - Use 'json.RawMessage' to delay decoding the params until the method is known
+
+// Building the server:
+// - The server is split over several files of one 'main' package, pass all of them to the go command
+// - Use 'go build -o server 12_web_programming.go 15_task_storage.go 16_replication.go 17_authentication.go 18_markdown.go' to build it
+// - Use 'go test 12_web_programming.go 15_task_storage.go 16_replication.go 17_authentication.go 18_markdown.go 12_web_programming_test.go 15_task_storage_test.go 18_markdown_test.go' to run its tests
+
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
+	"log/slog"
+	"math/big"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
 )
 
 // Task represents a single task with a title and description
 type Task struct {
-	Title       string `json:"title"`
-	Description string `json:"description"`
+	ID           int          `json:"id"`
+	Title        string       `json:"title"`
+	Description  string       `json:"description"`
+	Status       string       `json:"status"`
+	Priority     string       `json:"priority,omitempty"`
+	Due          *time.Time   `json:"due,omitempty"`
+	Recurrence   string       `json:"recurrence,omitempty"`
+	NextID       int          `json:"next_id,omitempty"`
+	ParentID     int          `json:"parent_id,omitempty"`
+	Attachments  []Attachment `json:"attachments,omitempty"`
+	CommentCount int          `json:"comment_count"`
+	Rank         string       `json:"rank"`
+	BlockedBy    []int        `json:"blocked_by,omitempty"`
+	Blocked      bool         `json:"blocked"`
+	Seq          int64        `json:"seq"`
+	CreatedAt    time.Time    `json:"created_at"`
+	UpdatedAt    time.Time    `json:"updated_at"`
+	DeletedAt    *time.Time   `json:"deleted_at,omitempty"`
+
+	// DescriptionHTML is only filled in for responses that ask for rendered Markdown
+	DescriptionHTML string `json:"-"`
 }
 
-// In-memory storage for tasks
-var tasks []Task
+// Tombstone records a deleted task so offline clients learn about the delete
+type Tombstone struct {
+	ID        int       `json:"id"`
+	Seq       int64     `json:"seq"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
 
-func main() {
-	// Set up routing with 'http.ServeMux'
-	mux := http.NewServeMux()
+// Attachment describes a file uploaded to a task
+type Attachment struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Size        int64     `json:"size"`
+	CreatedAt   time.Time `json:"created_at"`
+}
 
-	// Define the root route to display a welcome message
-	mux.HandleFunc("/", handleRoot)
+// Comment is a message in the discussion thread of a task
+type Comment struct {
+	ID        int       `json:"id"`
+	TaskID    int       `json:"task_id"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Edited    bool      `json:"edited"`
+}
 
-	// Define the '/tasks' route to handle GET and POST requests for tasks
-	mux.HandleFunc("/tasks", handleTasks)
+// maxCommentLength is the longest comment body accepted, in characters
+const maxCommentLength = 10000
 
-	// Define the '/submit' route to handle form submissions for adding tasks
-	mux.HandleFunc("/submit", handleForm)
+// maxDescriptionLength is the longest task description accepted, in characters
+const maxDescriptionLength = 20000
+
+// Due dates outside these years are rejected, so catching up on missed occurrences stays short
+const (
+	minDueYear = 1970
+	maxDueYear = 9999
+)
+
+// maxTaskBody is the largest request body accepted when a task is created or changed
+const maxTaskBody = 1 << 20
+
+// Task statuses accepted by the API
+const (
+	StatusTodo       = "todo"
+	StatusInProgress = "in_progress"
+	StatusDone       = "done"
+)
+
+// errTaskNotFound is returned when no task has the requested ID
+var errTaskNotFound = errors.New("task not found")
+
+// Errors returned by the comment methods of the store
+var (
+	errCommentNotFound  = errors.New("comment not found")
+	errNotCommentAuthor = errors.New("only the author can change a comment")
+)
+
+// Errors returned when tasks depend on each other
+var (
+	errDependencyCycle = errors.New("dependency cycle")
+	errTaskBlocked     = errors.New("task is blocked")
+)
+
+// errQuotaExceeded is returned when a workspace already holds its maximum number of tasks
+var errQuotaExceeded = errors.New("task quota exceeded")
+
+// TaskStore keeps tasks in memory and guards them for concurrent handlers
+type TaskStore struct {
+	mu       sync.Mutex
+	nextID   int
+	tasks    []Task // sorted by ID so memory and database listings agree
+	maxTasks int
+
+	// Comments are kept per task in the order they were written
+	nextCommentID int
+	comments      map[int][]Comment
+
+	// Every write takes the next sequence number, deletes leave a tombstone behind
+	seq            int64
+	tombstones     []Tombstone
+	tombstoneFloor int64
+
+	// Deleted tasks wait in the trash, with their comments, until they are restored or purged
+	trash []Task
+
+	// Writes up to sequence number 'logged' are in the replication log, the IDs of tasks written since
+	// are in 'written' and purges are logged separately
+	workspace string
+	logged    int64
+	written   []int
+	purged    []int
+}
+
+// maxTombstones is how many deletes are remembered for the change feed
+const maxTombstones = 10000
+
+// Errors returned by the sync methods of the store
+var (
+	errCursorExpired = errors.New("change cursor expired")
+	errSyncConflict  = errors.New("task changed on the server")
+	errTaskDeleted   = errors.New("task deleted on the server")
+)
+
+// NewTaskStore creates an empty store for a workspace, a 'maxTasks' of 0 means unlimited
+func NewTaskStore(workspace string, maxTasks int) *TaskStore {
+	return &TaskStore{workspace: workspace, nextID: 1, maxTasks: maxTasks, nextCommentID: 1, comments: map[int][]Comment{}}
+}
+
+// unlock records the writes made while the lock was held in the replication log and releases the lock
+//
+// Methods that write defer it with their error result, which is set when the writes could not be stored
+// and the method did not fail already.
+func (s *TaskStore) unlock(err *error) {
+	logErr := s.logWrites()
+	s.mu.Unlock()
+	if *err == nil {
+		*err = logErr
+	}
+}
+
+// bump takes the next sequence number for a write to a task and remembers the task for the replication log
+func (s *TaskStore) bump(id int) int64 {
+	s.seq++
+	s.written = append(s.written, id)
+	return s.seq
+}
+
+// logWrites appends the state every task written since the last call was left in to the replication log
+//
+// Entries hold the whole task rather than the change, so a follower can apply them again without harm.
+func (s *TaskStore) logWrites() error {
+	if s.seq == s.logged && len(s.purged) == 0 {
+		return nil
+	}
+
+	var entries []WriteEntry
+	for _, id := range s.purged {
+		entries = append(entries, WriteEntry{Workspace: s.workspace, Op: opPurge, TaskID: id})
+	}
+	s.purged = nil
+	slices.Sort(s.written)
+	for _, id := range slices.Compact(s.written) {
+		// A task written and then deleted under the same lock is logged by its tombstone below
+		i := s.index(id)
+		if i < 0 || s.tasks[i].Seq <= s.logged {
+			continue
+		}
+		task := s.tasks[i]
+		entries = append(entries, WriteEntry{Workspace: s.workspace, Op: opPut, Seq: task.Seq, Task: &task, Comments: slices.Clone(s.comments[id])})
+	}
+	s.written = s.written[:0]
+	for i := len(s.tombstones) - 1; i >= 0 && s.tombstones[i].Seq > s.logged; i-- {
+		tombstone := s.tombstones[i]
+		j := slices.IndexFunc(s.trash, func(t Task) bool { return t.ID == tombstone.ID })
+		if j < 0 {
+			continue
+		}
+		trashed := s.trash[j]
+		entries = append(entries, WriteEntry{Workspace: s.workspace, Op: opTrash, Seq: tombstone.Seq, Task: &trashed, Comments: slices.Clone(s.comments[tombstone.ID])})
+	}
+	slices.SortStableFunc(entries, func(a, b WriteEntry) int { return cmp.Compare(a.Seq, b.Seq) })
+
+	s.logged = s.seq
+	return writeLog.Append(entries...)
+}
+
+// SetMaxTasks changes the task quota of the store
+func (s *TaskStore) SetMaxTasks(maxTasks int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxTasks = maxTasks
+}
+
+// Count returns the number of stored tasks
+func (s *TaskStore) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.tasks)
+}
+
+// List returns a copy of all tasks
+func (s *TaskStore) List(ctx context.Context) []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Task{}, s.tasks...)
+}
+
+// Get returns the task with the given ID
+func (s *TaskStore) Get(ctx context.Context, id int) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.index(id)
+	if i < 0 {
+		return Task{}, errTaskNotFound
+	}
+	return s.tasks[i], nil
+}
+
+// Add assigns an ID and timestamps to a task and stores it unless the quota is reached
+func (s *TaskStore) Add(ctx context.Context, task Task) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	if s.maxTasks > 0 && len(s.tasks) >= s.maxTasks {
+		slog.WarnContext(ctx, "task quota exceeded", "max_tasks", s.maxTasks)
+		return Task{}, errQuotaExceeded
+	}
+	task = s.add(ctx, task)
+	slog.DebugContext(ctx, "task created", "task_id", task.ID)
+	return task, nil
+}
+
+// add stores a new task, the caller must hold the lock
+func (s *TaskStore) add(ctx context.Context, task Task) Task {
+	task.ID = s.nextID
+	s.nextID++
+	if task.Status == "" {
+		task.Status = StatusTodo
+	}
+	// Imported and synced tasks keep the times they were written with
+	now := time.Now().UTC()
+	if task.CreatedAt.IsZero() {
+		task.CreatedAt = now
+	}
+	if task.UpdatedAt.IsZero() {
+		task.UpdatedAt = now
+	}
+	task.Seq = s.bump(task.ID)
+
+	// New tasks go to the bottom of their board column
+	task.Rank = rankBetween(s.lastRank(task.Status, 0), "")
+
+	// A recurring task without a due date starts at the next occurrence of its rule
+	if task.Recurrence != "" && task.Due == nil {
+		rule, err := parseRecurrence(task.Recurrence)
+		if err == nil {
+			due := rule.Next(task.CreatedAt)
+			task.Due = &due
+		}
+	}
+
+	s.tasks = append(s.tasks, task)
+	return task
+}
+
+// Update applies a change to the task with the given ID and validates the result
+func (s *TaskStore) Update(ctx context.Context, id int, change func(*Task)) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	i := s.index(id)
+	if i < 0 {
+		return Task{}, errTaskNotFound
+	}
+	return s.update(ctx, i, change, time.Now().UTC())
+}
 
-	// Start the server on port 4001
-	fmt.Println("Starting server on :4001...")
-	err := http.ListenAndServe(":4001", mux)
+// update changes the task at index i and marks it as updated at 'now', the caller must hold the lock
+func (s *TaskStore) update(ctx context.Context, i int, change func(*Task), now time.Time) (Task, error) {
+	task := s.tasks[i]
+	id := task.ID
+	wasDone := task.Status == StatusDone
+	change(&task)
+	err := validateTask(task)
 	if err != nil {
-		log.Fatal("Error starting server:", err)
+		return Task{}, err
+	}
+
+	task.ID = id
+	if task.Status != s.tasks[i].Status {
+		err = s.checkUnblocked(task)
+		if err != nil {
+			return Task{}, err
+		}
+	}
+	task.UpdatedAt = now
+	task.Seq = s.bump(task.ID)
+
+	// A task whose status changed moves to the bottom of its new board column
+	if task.Status != s.tasks[i].Status {
+		task.Rank = rankBetween(s.lastRank(task.Status, id), "")
+	}
+	s.tasks[i] = task
+	slog.DebugContext(ctx, "task updated", "task_id", id)
+
+	// Completing a recurring task creates its next occurrence
+	if !wasDone && task.Status == StatusDone {
+		s.materialiseNext(ctx, i, time.Now().UTC())
+	}
+	if wasDone != (task.Status == StatusDone) {
+		s.refreshBlocked(ctx)
 	}
+	return s.tasks[i], nil
 }
 
-// handleRoot displays a welcome message on the root endpoint
-func handleRoot(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintln(w, "Welcome to the Task Manager API!")
+// MaterialiseDue creates the next occurrence of every recurring task whose due time has arrived
+func (s *TaskStore) MaterialiseDue(ctx context.Context, now time.Time) (_ int, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	created := 0
+	for i := 0; i < len(s.tasks); i++ {
+		task := s.tasks[i]
+		if task.Recurrence == "" || task.NextID != 0 || task.Due == nil || task.Due.After(now) {
+			continue
+		}
+		if s.materialiseNext(ctx, i, now) {
+			created++
+		}
+	}
+	return created, nil
 }
 
-// handleTasks handles GET and POST requests for task management
-func handleTasks(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		// Return all tasks as JSON
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(tasks)
-	case http.MethodPost:
-		// Add a new task from JSON data in the request body
-		body, err := io.ReadAll(r.Body)
+// materialiseNext adds the occurrence following the task at index i, the caller must hold the lock
+func (s *TaskStore) materialiseNext(ctx context.Context, i int, now time.Time) bool {
+	task := s.tasks[i]
+	if task.Recurrence == "" || task.NextID != 0 {
+		return false
+	}
+	rule, err := parseRecurrence(task.Recurrence)
+	if err != nil {
+		return false
+	}
+
+	from := now
+	if task.Due != nil {
+		from = *task.Due
+	}
+	next := nextOccurrence(rule, from, now)
+	if next.IsZero() {
+		return false
+	}
+
+	occurrence := s.add(ctx, Task{
+		Title:       task.Title,
+		Description: task.Description,
+		Due:         &next,
+		Recurrence:  task.Recurrence,
+	})
+	s.tasks[i].NextID = occurrence.ID
+	s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+	slog.DebugContext(ctx, "recurring task occurrence created", "task_id", task.ID, "next_id", occurrence.ID)
+	return true
+}
+
+// nextOccurrence returns the first occurrence of rule after 'from' that is also after 'now', skipping the ones already in the past
+func nextOccurrence(rule Recurrence, from, now time.Time) time.Time {
+	if from.Before(now) {
+		if interval, ok := rule.(IntervalRule); ok {
+			// Jump over the missed intervals at once, keeping the day the task repeats on
+			missed := int(now.Sub(from).Hours()/24) / interval.Days
+			from = from.AddDate(0, 0, missed*interval.Days)
+		} else {
+			// A cron schedule matches the same times whatever time it is started from
+			from = now
+		}
+	}
+
+	next := rule.Next(from)
+	for !next.IsZero() && !next.After(now) {
+		next = rule.Next(next)
+	}
+	return next
+}
+
+// Delete moves the task with the given ID to the trash
+func (s *TaskStore) Delete(ctx context.Context, id int) (err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	i := s.index(id)
+	if i < 0 {
+		return errTaskNotFound
+	}
+	s.remove(ctx, i)
+	return nil
+}
+
+// remove moves the task at index i to the trash and leaves a tombstone, the caller must hold the lock
+func (s *TaskStore) remove(ctx context.Context, i int) {
+	task := s.tasks[i]
+	id := task.ID
+	s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+	now := time.Now().UTC()
+	task.DeletedAt = &now
+	s.trash = append(s.trash, task)
+
+	// Dependencies on a task in the trash are kept for a restore but no longer block anything
+	s.refreshBlocked(ctx)
+
+	s.seq++
+	s.addTombstone(Tombstone{ID: id, Seq: s.seq, DeletedAt: time.Now().UTC()})
+	slog.DebugContext(ctx, "task moved to trash", "task_id", id)
+}
+
+// addTombstone remembers a delete for the change feed, the caller must hold the lock
+func (s *TaskStore) addTombstone(tombstone Tombstone) {
+	s.tombstones = append(s.tombstones, tombstone)
+	if len(s.tombstones) > maxTombstones {
+		// Clients whose cursor is older than a forgotten delete must fetch everything again
+		s.tombstoneFloor = s.tombstones[0].Seq
+		s.tombstones = slices.Delete(s.tombstones, 0, 1)
+	}
+}
+
+// AddTree stores tasks created together, such as from a template, where parents[i] is the index of the parent of
+// task i or -1, either all tasks are added or none
+func (s *TaskStore) AddTree(ctx context.Context, tasks []Task, parents []int) (_ []Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	if s.maxTasks > 0 && len(s.tasks)+len(tasks) > s.maxTasks {
+		slog.WarnContext(ctx, "task quota exceeded", "max_tasks", s.maxTasks)
+		return nil, errQuotaExceeded
+	}
+	for _, task := range tasks {
+		err := validateTask(task)
 		if err != nil {
-			http.Error(w, "Error reading request body.", http.StatusInternalServerError)
-			return
+			return nil, err
 		}
-		defer r.Body.Close()
+	}
+
+	created := make([]Task, len(tasks))
+	for i, task := range tasks {
+		if parents[i] >= 0 {
+			task.ParentID = created[parents[i]].ID
+		}
+		created[i] = s.add(ctx, task)
+	}
+	slog.DebugContext(ctx, "task tree created", "task_id", created[0].ID, "count", len(created))
+	return created, nil
+}
+
+// Trash returns a copy of the deleted tasks that can still be restored
+func (s *TaskStore) Trash(ctx context.Context) []Task {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Task{}, s.trash...)
+}
+
+// GetTrashed returns the deleted task with the given ID
+func (s *TaskStore) GetTrashed(ctx context.Context, id int) (Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j := slices.IndexFunc(s.trash, func(t Task) bool { return t.ID == id })
+	if j < 0 {
+		return Task{}, errTaskNotFound
+	}
+	return s.trash[j], nil
+}
+
+// Restore takes a task out of the trash, keeping its ID, comments and, unless it was taken, its place on the board
+func (s *TaskStore) Restore(ctx context.Context, id int) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	j := slices.IndexFunc(s.trash, func(t Task) bool { return t.ID == id })
+	if j < 0 {
+		return Task{}, errTaskNotFound
+	}
+	if s.maxTasks > 0 && len(s.tasks) >= s.maxTasks {
+		return Task{}, errQuotaExceeded
+	}
+
+	task := s.trash[j]
+	s.trash = slices.Delete(s.trash, j, j+1)
+	task.DeletedAt = nil
+
+	// A task added to the column in the meantime can have the same rank, then the restored task goes to the bottom
+	if slices.ContainsFunc(s.tasks, func(t Task) bool { return t.Status == task.Status && t.Rank == task.Rank }) {
+		task.Rank = rankBetween(s.lastRank(task.Status, 0), "")
+	}
+	task.UpdatedAt = time.Now().UTC()
+	task.Seq = s.bump(task.ID)
+	i := s.insert(task)
+	s.refreshBlocked(ctx)
+	slog.DebugContext(ctx, "task restored", "task_id", id)
+	return s.tasks[i], nil
+}
+
+// Purge permanently deletes the tasks that were moved to the trash before 'cutoff' and returns their IDs
+func (s *TaskStore) Purge(ctx context.Context, cutoff time.Time) (_ []int, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	var purged []int
+	s.trash = slices.DeleteFunc(s.trash, func(task Task) bool {
+		if task.DeletedAt.After(cutoff) {
+			return false
+		}
+		purged = append(purged, task.ID)
+		delete(s.comments, task.ID)
+		return true
+	})
+	s.purged = append(s.purged, purged...)
+
+	// Tasks waiting for a purged task no longer depend on it
+	for i := range s.tasks {
+		blockedBy := slices.DeleteFunc(slices.Clone(s.tasks[i].BlockedBy), func(dep int) bool { return slices.Contains(purged, dep) })
+		if len(blockedBy) != len(s.tasks[i].BlockedBy) {
+			s.tasks[i].BlockedBy = blockedBy
+			s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+		}
+	}
+	if len(purged) > 0 {
+		slog.DebugContext(ctx, "trashed tasks purged", "task_ids", purged)
+	}
+	return purged, nil
+}
+
+// ChangeSet lists what changed in a store after a cursor
+type ChangeSet struct {
+	Tasks   []Task
+	Deleted []Tombstone
+	Cursor  int64
+	More    bool
+}
+
+// Changes returns up to 'limit' tasks and tombstones written after sequence number 'since', oldest first
+func (s *TaskStore) Changes(ctx context.Context, since int64, limit int) (ChangeSet, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A cursor from before the oldest tombstone, or from a store that was reset, would miss deletes
+	if since < s.tombstoneFloor || since > s.seq {
+		return ChangeSet{}, errCursorExpired
+	}
+
+	var changed []Task
+	for _, task := range s.tasks {
+		if task.Seq > since {
+			changed = append(changed, task)
+		}
+	}
+	slices.SortFunc(changed, func(a, b Task) int { return cmp.Compare(a.Seq, b.Seq) })
+	start, _ := slices.BinarySearchFunc(s.tombstones, since+1, func(t Tombstone, seq int64) int { return cmp.Compare(t.Seq, seq) })
+	deleted := s.tombstones[start:]
+
+	// Merge both lists by sequence number so a page never skips a write
+	set := ChangeSet{Tasks: []Task{}, Deleted: []Tombstone{}, Cursor: s.seq}
+	i, j := 0, 0
+	for i < len(changed) || j < len(deleted) {
+		if len(set.Tasks)+len(set.Deleted) == limit {
+			set.More = true
+			break
+		}
+		if j == len(deleted) || (i < len(changed) && changed[i].Seq < deleted[j].Seq) {
+			set.Tasks = append(set.Tasks, changed[i])
+			set.Cursor = changed[i].Seq
+			i++
+		} else {
+			set.Deleted = append(set.Deleted, deleted[j])
+			set.Cursor = deleted[j].Seq
+			j++
+		}
+	}
+	if !set.More {
+		set.Cursor = s.seq
+	}
+	return set, nil
+}
+
+// Apply writes a change made by an offline client at 'modifiedAt' unless the server copy is newer (last writer wins)
+//
+// An ID of 0 creates a new task. On a conflict the server copy of the task is returned with errSyncConflict.
+func (s *TaskStore) Apply(ctx context.Context, id int, task Task, deleted bool, modifiedAt time.Time) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	// Clocks of offline devices drift, a change from the future would win every later conflict
+	now := time.Now().UTC()
+	modifiedAt = modifiedAt.UTC()
+	if modifiedAt.After(now) {
+		modifiedAt = now
+	}
 
-		var newTask Task
-		err = json.Unmarshal(body, &newTask)
+	if id == 0 {
+		err := validateTask(task)
 		if err != nil {
-			http.Error(w, "Invalid JSON format.", http.StatusBadRequest)
-			return
+			return Task{}, err
 		}
+		if s.maxTasks > 0 && len(s.tasks) >= s.maxTasks {
+			return Task{}, errQuotaExceeded
+		}
+		task.UpdatedAt = modifiedAt
+		return s.add(ctx, task), nil
+	}
 
-		tasks = append(tasks, newTask)
-		fmt.Fprintln(w, "Task added successfully!")
-	default:
-		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+	i := s.index(id)
+	if i < 0 {
+		if slices.ContainsFunc(s.tombstones, func(t Tombstone) bool { return t.ID == id }) {
+			// Deleting a task twice is not a conflict
+			if deleted {
+				return Task{ID: id}, nil
+			}
+			return Task{}, errTaskDeleted
+		}
+		return Task{}, errTaskNotFound
+	}
+	if !modifiedAt.After(s.tasks[i].UpdatedAt) {
+		slog.DebugContext(ctx, "sync conflict", "task_id", id, "client_modified_at", modifiedAt, "server_updated_at", s.tasks[i].UpdatedAt)
+		return s.tasks[i], errSyncConflict
+	}
+
+	if deleted {
+		s.remove(ctx, i)
+		return Task{ID: id}, nil
 	}
+	return s.update(ctx, i, func(t *Task) {
+		t.Title = task.Title
+		t.Description = task.Description
+		t.Status = task.Status
+		t.Priority = task.Priority
+		t.Due = task.Due
+		t.Recurrence = task.Recurrence
+	}, modifiedAt)
 }
 
-// handleForm processes form submissions to add a new task
-func handleForm(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed.", http.StatusMethodNotAllowed)
-		return
+// insert puts a task at its place by ID and returns the position, the caller must hold the lock
+func (s *TaskStore) insert(task Task) int {
+	i, _ := slices.BinarySearchFunc(s.tasks, task.ID, func(t Task, id int) int { return cmp.Compare(t.ID, id) })
+	s.tasks = slices.Insert(s.tasks, i, task)
+	return i
+}
+
+// index returns the position of a task in the slice or -1, the caller must hold the lock
+func (s *TaskStore) index(id int) int {
+	for i, task := range s.tasks {
+		if task.ID == id {
+			return i
+		}
 	}
+	return -1
+}
 
-	// Parse form data to retrieve task details
-	err := r.ParseForm()
+// errInvalidMove is returned when a move refers to tasks outside the target column
+var errInvalidMove = errors.New("invalid move")
+
+// column returns the tasks with a status ordered by rank, the caller must hold the lock
+func (s *TaskStore) column(status string, skipID int) []Task {
+	var column []Task
+	for _, task := range s.tasks {
+		if task.Status == status && task.ID != skipID {
+			column = append(column, task)
+		}
+	}
+	sortByRank(column)
+	return column
+}
+
+// lastRank returns the highest rank in a column, or "" when it is empty, the caller must hold the lock
+func (s *TaskStore) lastRank(status string, skipID int) string {
+	column := s.column(status, skipID)
+	if len(column) == 0 {
+		return ""
+	}
+	return column[len(column)-1].Rank
+}
+
+// Move places a task in a column directly after 'afterID' or before 'beforeID', or at the bottom when both are 0
+func (s *TaskStore) Move(ctx context.Context, id int, status string, afterID, beforeID int) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	i := s.index(id)
+	if i < 0 {
+		return Task{}, errTaskNotFound
+	}
+	task := s.tasks[i]
+	if status == "" {
+		status = task.Status
+	}
+
+	// Find the neighbours in the target column as it is now, under the lock, so concurrent moves cannot interleave
+	column := s.column(status, id)
+	position := len(column)
+	switch {
+	case afterID != 0 && beforeID != 0:
+		return Task{}, fmt.Errorf("%w: use either after_id or before_id", errInvalidMove)
+	case afterID != 0:
+		j := slices.IndexFunc(column, func(t Task) bool { return t.ID == afterID })
+		if j < 0 {
+			return Task{}, fmt.Errorf("%w: task %d is not in column '%s'", errInvalidMove, afterID, status)
+		}
+		position = j + 1
+	case beforeID != 0:
+		j := slices.IndexFunc(column, func(t Task) bool { return t.ID == beforeID })
+		if j < 0 {
+			return Task{}, fmt.Errorf("%w: task %d is not in column '%s'", errInvalidMove, beforeID, status)
+		}
+		position = j
+	}
+
+	lower, upper := "", ""
+	if position > 0 {
+		lower = column[position-1].Rank
+	}
+	if position < len(column) {
+		upper = column[position].Rank
+	}
+
+	wasDone := task.Status == StatusDone
+	changed := task.Status != status
+	task.Status = status
+	err = validateTask(task)
 	if err != nil {
-		http.Error(w, "Error parsing form data.", http.StatusBadRequest)
-		return
+		return Task{}, err
+	}
+	if changed {
+		err = s.checkUnblocked(task)
+		if err != nil {
+			return Task{}, err
+		}
 	}
+	task.Rank = rankBetween(lower, upper)
+	task.UpdatedAt = time.Now().UTC()
+	task.Seq = s.bump(task.ID)
+	s.tasks[i] = task
+	slog.DebugContext(ctx, "task moved", "task_id", id, "status", status, "rank", task.Rank)
 
-	title := r.FormValue("title")
-	description := r.FormValue("description")
+	if !wasDone && task.Status == StatusDone {
+		s.materialiseNext(ctx, i, task.UpdatedAt)
+	}
+	if wasDone != (task.Status == StatusDone) {
+		s.refreshBlocked(ctx)
+	}
+	return s.tasks[i], nil
+}
+
+// sortByRank orders tasks by rank, using the ID to break ties
+func sortByRank(list []Task) {
+	slices.SortStableFunc(list, func(a, b Task) int {
+		if c := strings.Compare(a.Rank, b.Rank); c != 0 {
+			return c
+		}
+		return a.ID - b.ID
+	})
+}
+
+// rankDigits are the digits of a rank in ascending byte order
+const rankDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// rankBetween returns a rank that sorts strictly between a and b, where "" means no bound on that side
+func rankBetween(a, b string) string {
+	if b != "" && a >= b {
+		// Ranks are out of order, which only happens with corrupt data, so fall back to after a
+		b = ""
+	}
+
+	// Keep the common prefix and find a rank between the remainders
+	if b != "" {
+		n := 0
+		for n < len(b) && rankDigitAt(a, n) == b[n] {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + rankBetween(a[min(n, len(a)):], b[n:])
+		}
+	}
+
+	digitA := 0
+	if a != "" {
+		digitA = strings.IndexByte(rankDigits, a[0])
+	}
+	digitB := len(rankDigits)
+	if b != "" {
+		digitB = strings.IndexByte(rankDigits, b[0])
+	}
 
-	// Add the task to the in-memory storage
-	tasks = append(tasks, Task{Title: title, Description: description})
+	// Use the middle digit when there is room between the first digits
+	if digitB-digitA > 1 {
+		return string(rankDigits[(digitA+digitB+1)/2])
+	}
+
+	// The first digits are adjacent, so extend the shorter rank
+	if len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if a != "" {
+		rest = a[1:]
+	}
+	return string(rankDigits[digitA]) + rankBetween(rest, "")
+}
+
+// rankDigitAt returns the digit of a rank at position n, treating missing digits as the lowest digit
+func rankDigitAt(rank string, n int) byte {
+	if n < len(rank) {
+		return rank[n]
+	}
+	return rankDigits[0]
+}
+
+// AddComment adds a comment to the thread of a task
+func (s *TaskStore) AddComment(ctx context.Context, taskID int, author, body string) (_ Comment, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	i := s.index(taskID)
+	if i < 0 {
+		return Comment{}, errTaskNotFound
+	}
+
+	now := time.Now().UTC()
+	comment := Comment{ID: s.nextCommentID, TaskID: taskID, Author: author, Body: body, CreatedAt: now, UpdatedAt: now}
+	s.nextCommentID++
+	s.comments[taskID] = append(s.comments[taskID], comment)
+	s.tasks[i].CommentCount = len(s.comments[taskID])
+	s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+
+	slog.DebugContext(ctx, "comment added", "task_id", taskID, "comment_id", comment.ID)
+	return comment, nil
+}
+
+// ListComments returns up to 'limit' comments of a task written after the comment with ID 'after'
+func (s *TaskStore) ListComments(ctx context.Context, taskID, after, limit int) ([]Comment, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.index(taskID) < 0 {
+		return nil, false, errTaskNotFound
+	}
+
+	// Comment IDs only grow so the thread is sorted by ID
+	thread := s.comments[taskID]
+	start, _ := slices.BinarySearchFunc(thread, after+1, func(c Comment, id int) int { return c.ID - id })
+	end := min(start+limit, len(thread))
+	return append([]Comment{}, thread[start:end]...), end < len(thread), nil
+}
+
+// UpdateComment changes the body of a comment written by 'user'
+func (s *TaskStore) UpdateComment(ctx context.Context, taskID, commentID int, user, body string) (_ Comment, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	j, err := s.commentIndex(taskID, commentID)
+	if err != nil {
+		return Comment{}, err
+	}
+	comment := &s.comments[taskID][j]
+	if comment.Author != user {
+		return Comment{}, errNotCommentAuthor
+	}
+
+	comment.Body = body
+	comment.UpdatedAt = time.Now().UTC()
+	comment.Edited = true
+
+	// The task is not changed, but its new sequence number sends the edited thread to followers
+	s.tasks[s.index(taskID)].Seq = s.bump(taskID)
+	slog.DebugContext(ctx, "comment updated", "task_id", taskID, "comment_id", commentID)
+	return *comment, nil
+}
+
+// DeleteComment removes a comment written by 'user'
+func (s *TaskStore) DeleteComment(ctx context.Context, taskID, commentID int, user string) (err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	j, err := s.commentIndex(taskID, commentID)
+	if err != nil {
+		return err
+	}
+	if s.comments[taskID][j].Author != user {
+		return errNotCommentAuthor
+	}
+
+	s.comments[taskID] = slices.Delete(s.comments[taskID], j, j+1)
+	i := s.index(taskID)
+	s.tasks[i].CommentCount = len(s.comments[taskID])
+	s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+	slog.DebugContext(ctx, "comment deleted", "task_id", taskID, "comment_id", commentID)
+	return nil
+}
+
+// commentIndex finds a comment in the thread of a task, the caller must hold the lock
+func (s *TaskStore) commentIndex(taskID, commentID int) (int, error) {
+	if s.index(taskID) < 0 {
+		return 0, errTaskNotFound
+	}
+	j := slices.IndexFunc(s.comments[taskID], func(c Comment) bool { return c.ID == commentID })
+	if j < 0 {
+		return 0, errCommentNotFound
+	}
+	return j, nil
+}
+
+// AddDependency records that the task 'id' cannot start until the task 'dep' is done
+func (s *TaskStore) AddDependency(ctx context.Context, id, dep int) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	i := s.index(id)
+	if i < 0 || s.index(dep) < 0 {
+		return Task{}, errTaskNotFound
+	}
+	if slices.Contains(s.tasks[i].BlockedBy, dep) {
+		return s.tasks[i], nil
+	}
+
+	// The new edge closes a cycle when 'dep' already waits for 'id', directly or through other tasks
+	if path := s.dependencyPath(dep, id); path != nil {
+		names := make([]string, len(path))
+		for j, taskID := range path {
+			names[j] = strconv.Itoa(taskID)
+		}
+		return Task{}, fmt.Errorf("%w: %d -> %s", errDependencyCycle, id, strings.Join(names, " -> "))
+	}
+
+	s.tasks[i].BlockedBy = append(slices.Clip(s.tasks[i].BlockedBy), dep)
+	s.tasks[i].UpdatedAt = time.Now().UTC()
+	s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+	s.refreshBlocked(ctx)
+	slog.DebugContext(ctx, "dependency added", "task_id", id, "blocked_by", dep)
+	return s.tasks[i], nil
+}
+
+// RemoveDependency removes the task 'dep' from the tasks that 'id' waits for
+func (s *TaskStore) RemoveDependency(ctx context.Context, id, dep int) (_ Task, err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	i := s.index(id)
+	if i < 0 {
+		return Task{}, errTaskNotFound
+	}
+	if !slices.Contains(s.tasks[i].BlockedBy, dep) {
+		return s.tasks[i], nil
+	}
+
+	s.tasks[i].BlockedBy = slices.DeleteFunc(slices.Clone(s.tasks[i].BlockedBy), func(d int) bool { return d == dep })
+	s.tasks[i].UpdatedAt = time.Now().UTC()
+	s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+	s.refreshBlocked(ctx)
+	slog.DebugContext(ctx, "dependency removed", "task_id", id, "blocked_by", dep)
+	return s.tasks[i], nil
+}
+
+// dependencyPath returns the chain of dependencies leading from 'from' to 'to', or nil if there is none, the caller must hold the lock
+func (s *TaskStore) dependencyPath(from, to int) []int {
+	visited := map[int]bool{}
+	var walk func(id int) []int
+	walk = func(id int) []int {
+		if id == to {
+			return []int{id}
+		}
+		if visited[id] {
+			return nil
+		}
+		visited[id] = true
+		i := s.index(id)
+		if i < 0 {
+			return nil
+		}
+		for _, dep := range s.tasks[i].BlockedBy {
+			if path := walk(dep); path != nil {
+				return append([]int{id}, path...)
+			}
+		}
+		return nil
+	}
+	return walk(from)
+}
+
+// checkUnblocked returns errTaskBlocked when a blocked task is started or finished, the caller must hold the lock
+func (s *TaskStore) checkUnblocked(task Task) error {
+	if task.Status == StatusTodo {
+		return nil
+	}
+	var waiting []string
+	for _, dep := range task.BlockedBy {
+		if j := s.index(dep); j >= 0 && s.tasks[j].Status != StatusDone {
+			waiting = append(waiting, strconv.Itoa(dep))
+		}
+	}
+	if len(waiting) > 0 {
+		return fmt.Errorf("%w: waiting for task %s", errTaskBlocked, strings.Join(waiting, ", "))
+	}
+	return nil
+}
+
+// refreshBlocked marks tasks as blocked while any of their dependencies is not done, the caller must hold the lock
+func (s *TaskStore) refreshBlocked(ctx context.Context) {
+	for i := range s.tasks {
+		blocked := slices.ContainsFunc(s.tasks[i].BlockedBy, func(dep int) bool {
+			j := s.index(dep)
+			return j >= 0 && s.tasks[j].Status != StatusDone
+		})
+		if blocked == s.tasks[i].Blocked {
+			continue
+		}
+		s.tasks[i].Blocked = blocked
+		s.tasks[i].Seq = s.bump(s.tasks[i].ID)
+		if blocked {
+			slog.DebugContext(ctx, "task blocked", "task_id", s.tasks[i].ID)
+		} else {
+			slog.DebugContext(ctx, "task unblocked", "task_id", s.tasks[i].ID)
+		}
+	}
+}
+
+// Plan returns the unfinished tasks in an order that respects their dependencies, earliest due date first
+func (s *TaskStore) Plan(ctx context.Context) ([]Task, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Count the unfinished dependencies of every unfinished task (Kahn's algorithm)
+	open := map[int]Task{}
+	for _, task := range s.tasks {
+		if task.Status != StatusDone {
+			open[task.ID] = task
+		}
+	}
+	waiting := map[int]int{}
+	dependents := map[int][]int{}
+	for id, task := range open {
+		for _, dep := range task.BlockedBy {
+			if _, ok := open[dep]; ok {
+				waiting[id]++
+				dependents[dep] = append(dependents[dep], id)
+			}
+		}
+	}
+
+	var ready []Task
+	for id, task := range open {
+		if waiting[id] == 0 {
+			ready = append(ready, task)
+		}
+	}
+
+	plan := []Task{}
+	for len(ready) > 0 {
+		// Pick the most urgent ready task so the plan is stable between calls
+		slices.SortFunc(ready, comparePlanOrder)
+		task := ready[0]
+		ready = ready[1:]
+		plan = append(plan, task)
+		for _, id := range dependents[task.ID] {
+			waiting[id]--
+			if waiting[id] == 0 {
+				ready = append(ready, open[id])
+			}
+		}
+	}
+
+	// AddDependency rejects cycles, so this only happens with corrupt data
+	if len(plan) != len(open) {
+		return nil, errDependencyCycle
+	}
+	return plan, nil
+}
+
+// comparePlanOrder orders tasks by due date, tasks without one last, then by board position
+func comparePlanOrder(a, b Task) int {
+	switch {
+	case a.Due != nil && b.Due != nil && !a.Due.Equal(*b.Due):
+		return a.Due.Compare(*b.Due)
+	case a.Due != nil && b.Due == nil:
+		return -1
+	case a.Due == nil && b.Due != nil:
+		return 1
+	}
+	if c := strings.Compare(a.Rank, b.Rank); c != 0 {
+		return c
+	}
+	return a.ID - b.ID
+}
+
+// validateTask checks that a task has a title, a description of limited length, a due date in range, a known status and a valid recurrence rule
+func validateTask(task Task) error {
+	if strings.TrimSpace(task.Title) == "" {
+		return errors.New("title is required")
+	}
+	if utf8.RuneCountInString(task.Description) > maxDescriptionLength {
+		return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+	}
+	if task.Due != nil && (task.Due.Year() < minDueYear || task.Due.Year() > maxDueYear) {
+		return fmt.Errorf("due date must be between the years %d and %d", minDueYear, maxDueYear)
+	}
+	if task.Recurrence != "" {
+		rule, err := parseRecurrence(task.Recurrence)
+		if err != nil {
+			return err
+		}
+		if rule.Next(time.Now()).IsZero() {
+			return fmt.Errorf("recurrence '%s' never occurs", task.Recurrence)
+		}
+	}
+	if task.Priority != "" && (len(task.Priority) != 1 || task.Priority[0] < 'A' || task.Priority[0] > 'Z') {
+		return fmt.Errorf("priority must be a letter from A to Z")
+	}
+	switch task.Status {
+	case "", StatusTodo, StatusInProgress, StatusDone:
+		return nil
+	}
+	return fmt.Errorf("unknown status '%s'", task.Status)
+}
+
+// Recurrence calculates the occurrences of a repeating task
+type Recurrence interface {
+	// Next returns the first occurrence strictly after t, or the zero time if there is none
+	Next(t time.Time) time.Time
+}
+
+// parseRecurrence parses an "every N days" rule or a 5-field cron expression
+func parseRecurrence(rule string) (Recurrence, error) {
+	rule = strings.TrimSpace(rule)
+	if strings.HasPrefix(strings.ToLower(rule), "every ") {
+		return parseInterval(rule)
+	}
+	return parseCron(rule)
+}
+
+// IntervalRule repeats a task every fixed number of days
+type IntervalRule struct {
+	Days int
+}
+
+// parseInterval parses rules such as "every day", "every 3 days" and "every 2 weeks"
+func parseInterval(rule string) (IntervalRule, error) {
+	fields := strings.Fields(strings.ToLower(rule))
+	if len(fields) == 2 {
+		fields = []string{fields[0], "1", fields[1]}
+	}
+	if len(fields) != 3 || fields[0] != "every" {
+		return IntervalRule{}, fmt.Errorf("invalid recurrence '%s': expected 'every N days'", rule)
+	}
+
+	n, err := strconv.Atoi(fields[1])
+	if err != nil || n < 1 {
+		return IntervalRule{}, fmt.Errorf("invalid recurrence '%s': N must be a positive number", rule)
+	}
+
+	switch fields[2] {
+	case "day", "days":
+		return IntervalRule{Days: n}, nil
+	case "week", "weeks":
+		return IntervalRule{Days: 7 * n}, nil
+	}
+	return IntervalRule{}, fmt.Errorf("invalid recurrence '%s': unknown unit '%s'", rule, fields[2])
+}
+
+// Next returns the time N days after t, keeping the wall clock time across daylight saving changes
+func (r IntervalRule) Next(t time.Time) time.Time {
+	return t.AddDate(0, 0, r.Days)
+}
+
+// CronSchedule is a parsed 5-field cron expression stored as bitsets
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Day of month and day of week match either one when both are restricted
+	domStar, dowStar bool
+}
+
+// cronField describes the allowed range and names of a cron field
+type cronField struct {
+	name     string
+	min, max int
+	names    []string
+}
+
+// Fields of a cron expression in order
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{name: "day of week", min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// Shorthand expressions supported in place of the 5 fields
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a standard cron expression such as '30 9 * * mon-fri' or '0 0 1 */3 *'
+func parseCron(expr string) (CronSchedule, error) {
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return CronSchedule{}, fmt.Errorf("invalid cron expression '%s': expected 5 fields", expr)
+	}
+
+	var bits [5]uint64
+	for i, field := range fields {
+		b, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return CronSchedule{}, fmt.Errorf("invalid cron expression '%s': %w", expr, err)
+		}
+		bits[i] = b
+	}
+
+	// Sunday can be written as 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] = bits[4]&^(1<<7) | 1
+	}
+
+	return CronSchedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: strings.HasPrefix(fields[2], "*"),
+		dowStar: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps into a bitset
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step '%s' in %s", stepPart, spec.name)
+			}
+			step = n
+		}
+
+		// Work out the start and end of the range ('*', 'n', 'a-b')
+		var start, end int
+		switch {
+		case rangePart == "*":
+			start, end = spec.min, spec.max
+		case strings.Contains(rangePart, "-"):
+			lo, hi, _ := strings.Cut(rangePart, "-")
+			var err error
+			start, err = cronValue(lo, spec)
+			if err != nil {
+				return 0, err
+			}
+			end, err = cronValue(hi, spec)
+			if err != nil {
+				return 0, err
+			}
+		default:
+			v, err := cronValue(rangePart, spec)
+			if err != nil {
+				return 0, err
+			}
+			start, end = v, v
+			// 'n/step' means from n to the end of the range
+			if hasStep {
+				end = spec.max
+			}
+		}
+
+		if start > end {
+			return 0, fmt.Errorf("invalid range '%s' in %s", rangePart, spec.name)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << v
+		}
+	}
+	return bits, nil
+}
+
+// cronValue parses a number or a name (e.g. 'jan' or 'mon') and checks it is in range
+func cronValue(s string, spec cronField) (int, error) {
+	for i, name := range spec.names {
+		if strings.EqualFold(s, name) {
+			return i + spec.min, nil
+		}
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value '%s' in %s", s, spec.name)
+	}
+	if v < spec.min || v > spec.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d in %s", v, spec.min, spec.max, spec.name)
+	}
+	return v, nil
+}
+
+// Next returns the first minute after t that matches the schedule, in the location of t
+func (c CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Give up if nothing matches within five years (e.g. '0 0 30 2 *')
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the cron rule that a restricted day of month or day of week is enough
+func (c CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := c.dom&(1<<uint(t.Day())) != 0
+	dowMatch := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// runRecurrence materialises due recurring tasks in every workspace at every tick
+func runRecurrence(registry *WorkspaceRegistry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		// A follower gets the occurrences its leader creates
+		if replica.Following() {
+			continue
+		}
+		for _, ws := range registry.List() {
+			created, err := ws.Tasks.MaterialiseDue(context.Background(), now.UTC())
+			if err != nil {
+				slog.Error("failed to store recurring task occurrences", "workspace", ws.Name, "error", err)
+			}
+			if created > 0 {
+				slog.Info("recurring task occurrences created", "workspace", ws.Name, "count", created)
+			}
+		}
+	}
+}
+
+// DefaultWorkspace is used when a request does not select a workspace
+const DefaultWorkspace = "default"
+
+// Workspace is an isolated set of tasks with its own members and quota
+type Workspace struct {
+	Name      string         `json:"name"`
+	Members   []string       `json:"members"`
+	MaxTasks  int            `json:"max_tasks"`
+	Tasks     *TaskStore     `json:"-"`
+	Templates *TemplateStore `json:"-"`
+}
+
+// HasMember reports whether a user may access the workspace, a workspace without members is open to everyone
+func (ws *Workspace) HasMember(user string) bool {
+	return len(ws.Members) == 0 || slices.Contains(ws.Members, user)
+}
+
+// WorkspaceRegistry holds all workspaces of the server by name
+type WorkspaceRegistry struct {
+	mu         sync.RWMutex
+	workspaces map[string]*Workspace
+}
+
+// Workspaces of the server, starting with the open default workspace
+var workspaces = NewWorkspaceRegistry()
+
+// NewWorkspaceRegistry creates a registry that contains the default workspace
+func NewWorkspaceRegistry() *WorkspaceRegistry {
+	registry := &WorkspaceRegistry{workspaces: map[string]*Workspace{}}
+	registry.workspaces[DefaultWorkspace] = &Workspace{Name: DefaultWorkspace, Members: []string{}, Tasks: NewTaskStore(DefaultWorkspace, 0), Templates: NewTemplateStore(DefaultWorkspace)}
+	return registry
+}
+
+// Errors returned by the workspace registry
+var (
+	errWorkspaceNotFound = errors.New("workspace not found")
+	errWorkspaceExists   = errors.New("workspace already exists")
+)
+
+// workspaceNameRE restricts workspace names to characters that are safe in URLs
+var workspaceNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,62}$`)
+
+// Get returns the workspace with the given name
+func (reg *WorkspaceRegistry) Get(name string) (*Workspace, error) {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	ws, ok := reg.workspaces[name]
+	if !ok {
+		return nil, errWorkspaceNotFound
+	}
+	return ws, nil
+}
+
+// List returns all workspaces sorted by name
+func (reg *WorkspaceRegistry) List() []*Workspace {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+
+	list := make([]*Workspace, 0, len(reg.workspaces))
+	for _, ws := range reg.workspaces {
+		list = append(list, ws)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Create adds a new workspace with an empty task set
+func (reg *WorkspaceRegistry) Create(name string, members []string, maxTasks int) (*Workspace, error) {
+	if !workspaceNameRE.MatchString(name) {
+		return nil, errors.New("name must be lowercase letters, digits, '-' or '_'")
+	}
+	if maxTasks < 0 {
+		return nil, errors.New("max_tasks must not be negative")
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if _, ok := reg.workspaces[name]; ok {
+		return nil, errWorkspaceExists
+	}
+	if members == nil {
+		members = []string{}
+	}
+	ws := &Workspace{Name: name, Members: members, MaxTasks: maxTasks, Tasks: NewTaskStore(name, maxTasks), Templates: NewTemplateStore(name)}
+	reg.workspaces[name] = ws
+	return ws, writeLog.Append(WriteEntry{Workspace: name, Op: opWorkspace, Members: members, MaxTasks: maxTasks})
+}
+
+// Update replaces the members and quota of a workspace
+func (reg *WorkspaceRegistry) Update(name string, members []string, maxTasks int) (*Workspace, error) {
+	if maxTasks < 0 {
+		return nil, errors.New("max_tasks must not be negative")
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	ws, ok := reg.workspaces[name]
+	if !ok {
+		return nil, errWorkspaceNotFound
+	}
+	if members == nil {
+		members = []string{}
+	}
+
+	// Replace the workspace value so readers holding the old pointer are not raced
+	updated := &Workspace{Name: name, Members: members, MaxTasks: maxTasks, Tasks: ws.Tasks, Templates: ws.Templates}
+	updated.Tasks.SetMaxTasks(maxTasks)
+	reg.workspaces[name] = updated
+	return updated, writeLog.Append(WriteEntry{Workspace: name, Op: opWorkspace, Members: members, MaxTasks: maxTasks})
+}
+
+// Delete removes a workspace and its tasks, the default workspace cannot be deleted
+func (reg *WorkspaceRegistry) Delete(name string) error {
+	if name == DefaultWorkspace {
+		return errors.New("the default workspace cannot be deleted")
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	if _, ok := reg.workspaces[name]; !ok {
+		return errWorkspaceNotFound
+	}
+	delete(reg.workspaces, name)
+	return writeLog.Append(WriteEntry{Workspace: name, Op: opDropWorkspace})
+}
+
+// contextKey is the type of the keys of values stored in a request context
+type contextKey int
+
+// Keys of the values stored in a request context
+const (
+	workspaceKey contextKey = iota
+	basePathKey
+	versionKey
+	traceKey
+	userKey
+	sessionKey
+)
+
+// workspaceFrom returns the workspace selected for a request, falling back to the default workspace
+func workspaceFrom(ctx context.Context) *Workspace {
+	if ws, ok := ctx.Value(workspaceKey).(*Workspace); ok {
+		return ws
+	}
+	ws, _ := workspaces.Get(DefaultWorkspace)
+	return ws
+}
+
+// basePath returns the path prefix that was removed from the request path (e.g. '/w/team')
+func basePath(ctx context.Context) string {
+	prefix, _ := ctx.Value(basePathKey).(string)
+	return prefix
+}
+
+// withBasePath adds a removed path prefix to the context
+func withBasePath(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, basePathKey, basePath(ctx)+prefix)
+}
+
+// withPath returns a shallow copy of the request with a different URL path
+func withPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = path
+	r2.URL.RawPath = ""
+	return r2
+}
+
+// withWorkspace selects the workspace from a '/w/{name}' path prefix or the 'X-Workspace' header
+func withWorkspace(registry *WorkspaceRegistry, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.Header.Get("X-Workspace")
+		ctx := r.Context()
+
+		// Strip a '/w/{name}' prefix so the routes below do not need to know about it
+		if rest, ok := strings.CutPrefix(r.URL.Path, "/w/"); ok {
+			prefixName, path, _ := strings.Cut(rest, "/")
+			if name != "" && name != prefixName {
+				httpError(w, r, "X-Workspace header does not match the workspace in the path.", http.StatusBadRequest)
+				return
+			}
+			name = prefixName
+			r = withPath(r, "/"+path)
+			ctx = withBasePath(ctx, "/w/"+name)
+		}
+		if name == "" {
+			name = DefaultWorkspace
+		}
+
+		ws, err := registry.Get(name)
+		if err != nil {
+			httpError(w, r, "Workspace not found.", http.StatusNotFound)
+			return
+		}
+		if !ws.HasMember(requestUser(r)) {
+			httpError(w, r, "You are not a member of this workspace.", http.StatusForbidden)
+			return
+		}
+
+		ctx = context.WithValue(ctx, workspaceKey, ws)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// workspaceRequest is the JSON body used to create or update a workspace
+type workspaceRequest struct {
+	Name     string   `json:"name"`
+	Members  []string `json:"members"`
+	MaxTasks int      `json:"max_tasks"`
+}
+
+// workspaceInfo is a workspace with its current task count
+type workspaceInfo struct {
+	*Workspace
+	TaskCount int `json:"task_count"`
+}
+
+// handleWorkspaces lists the workspaces visible to the caller and creates new ones
+func handleWorkspaces(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		user := requestUser(r)
+		list := []workspaceInfo{}
+		for _, ws := range workspaces.List() {
+			if ws.HasMember(user) {
+				list = append(list, workspaceInfo{ws, ws.Tasks.Count()})
+			}
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var req workspaceRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+
+		// The creator becomes a member so they do not lock themselves out
+		if user := requestUser(r); user != "" && len(req.Members) > 0 && !slices.Contains(req.Members, user) {
+			req.Members = append(req.Members, user)
+		}
+
+		ws, err := workspaces.Create(req.Name, req.Members, req.MaxTasks)
+		if storeError(w, r, err) {
+			return
+		}
+		if errors.Is(err, errWorkspaceExists) {
+			httpError(w, r, "Workspace already exists.", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Invalid workspace: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Location", "/workspaces/"+ws.Name)
+		writeJSON(w, http.StatusCreated, workspaceInfo{ws, 0})
+	default:
+		httpError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleWorkspace reads, updates and deletes a single workspace
+func handleWorkspace(w http.ResponseWriter, r *http.Request) {
+	ws, err := workspaces.Get(r.PathValue("name"))
+	if err != nil || !ws.HasMember(requestUser(r)) {
+		httpError(w, r, "Workspace not found.", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, workspaceInfo{ws, ws.Tasks.Count()})
+	case http.MethodPut:
+		var req workspaceRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+
+		ws, err = workspaces.Update(ws.Name, req.Members, req.MaxTasks)
+		if storeError(w, r, err) {
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Invalid workspace: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, workspaceInfo{ws, ws.Tasks.Count()})
+	case http.MethodDelete:
+		err := workspaces.Delete(ws.Name)
+		if storeError(w, r, err) {
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Cannot delete workspace: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		attachments.RemoveWorkspace(r.Context(), ws.Name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+func main() {
+	// Run the 'gen-cert' command instead of the server when requested
+	if len(os.Args) > 1 && os.Args[1] == "gen-cert" {
+		err := runGenCert(os.Args[2:])
+		if err != nil {
+			log.Fatal("Error generating certificates:", err)
+		}
+		return
+	}
+
+	// Run the 'hash-password' command to create a password hash for the users file
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		err := runHashPassword(os.Args[2:])
+		if err != nil {
+			log.Fatal("Error hashing password:", err)
+		}
+		return
+	}
+
+	// Run the 'promote' command to make a follower the leader
+	if len(os.Args) > 1 && os.Args[1] == "promote" {
+		err := runPromote(os.Args[2:])
+		if err != nil {
+			log.Fatal("Error promoting follower:", err)
+		}
+		return
+	}
+
+	// Run the 'gen-token' command to create an API token for the users file
+	if len(os.Args) > 1 && os.Args[1] == "gen-token" {
+		err := runGenToken(os.Args[2:])
+		if err != nil {
+			log.Fatal("Error generating token:", err)
+		}
+		return
+	}
+
+	err := runServer(os.Args[1:])
+	if err != nil {
+		log.Fatal("Error starting server:", err)
+	}
+}
+
+// runServer parses the server options and serves the Task Manager API over HTTP or HTTPS
+func runServer(args []string) error {
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	addr := fs.String("addr", ":4001", "address to serve the API on")
+	tlsCert := fs.String("tls-cert", "", "path to a PEM certificate to serve HTTPS")
+	tlsKey := fs.String("tls-key", "", "path to the PEM private key for --tls-cert")
+	httpAddr := fs.String("http-addr", ":4000", "address that redirects plain HTTP to HTTPS (empty to disable)")
+	compressMinSize := fs.Int("compress-min-size", 1024, "smallest response body in bytes worth compressing")
+	idempotencyTTL := fs.Duration("idempotency-ttl", 24*time.Hour, "how long responses are kept for replay by 'Idempotency-Key'")
+	recurrenceInterval := fs.Duration("recurrence-interval", time.Minute, "how often to create occurrences of due recurring tasks")
+	corsOrigins := fs.String("cors-origins", "", "comma-separated origins allowed to call the API from a browser ('*' for any, empty to disable)")
+	corsMethods := fs.String("cors-methods", "GET,POST,PUT,PATCH,DELETE", "comma-separated methods allowed in cross-origin requests")
+	corsHeaders := fs.String("cors-headers", "Content-Type,Authorization,Idempotency-Key,X-Workspace,X-User,X-Request-ID,Traceparent", "comma-separated request headers allowed in cross-origin requests")
+	corsCredentials := fs.Bool("cors-credentials", false, "allow cross-origin requests to send cookies and credentials")
+	corsMaxAge := fs.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache a preflight response")
+	attachmentsDir := fs.String("attachments-dir", filepath.Join("data", "attachments"), "directory to store task attachments in")
+	attachmentMaxSize := fs.Int64("attachment-max-size", 10<<20, "largest accepted upload in bytes")
+	attachmentTypes := fs.String("attachment-types", "image/png,image/jpeg,image/gif,image/webp,text/plain,application/pdf,application/zip", "comma-separated MIME types accepted as attachments")
+	dbPath := fs.String("db", "", "file to store tasks in, with its write-ahead log next to it (empty to keep tasks in memory)")
+	follow := fs.String("follow", "", "URL of a leader to replicate as a read-only follower (empty to be the leader)")
+	followToken := fs.String("follow-token", "", "API token of an admin on the leader when it checks tokens")
+	usersFile := fs.String("users-file", "", "JSON file of users with API token and password hashes and roles (empty to trust the 'X-User' header)")
+	sessionTTL := fs.Duration("session-ttl", 12*time.Hour, "how long a browser stays signed in after logging in")
+	defaultRole := fs.String("default-role", "", "role of users without an assigned one (default 'admin' without --users-file, else 'viewer')")
+	trashRetention := fs.Duration("trash-retention", 30*24*time.Hour, "how long deleted tasks stay in the trash before they are purged")
+	logFile := fs.String("log-file", "server.log", "file to append JSON logs to ('-' for standard error)")
+	logLevel := fs.String("log-level", "info", "lowest level to log: debug, info, warn or error")
+	fs.Parse(args)
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return errors.New("--tls-cert and --tls-key must be used together")
+	}
+
+	// Send structured logs with request and trace IDs to the log file
+	var level slog.Level
+	err := level.UnmarshalText([]byte(*logLevel))
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %w", err)
+	}
+	logOutput := io.Writer(os.Stderr)
+	if *logFile != "-" {
+		file, err := os.OpenFile(*logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log file '%s': %w", *logFile, err)
+		}
+		defer file.Close()
+		logOutput = file
+	}
+	slog.SetDefault(newLogger(logOutput, level))
+
+	// Check API tokens and roles when a users file is given, otherwise everyone is trusted as before
+	if *defaultRole == "" {
+		*defaultRole = RoleAdmin
+		if *usersFile != "" {
+			*defaultRole = RoleViewer
+		}
+	}
+	if rolePermissions[*defaultRole] == nil {
+		return fmt.Errorf("invalid --default-role '%s'", *defaultRole)
+	}
+	roles = NewRoleStore(*defaultRole)
+	if *usersFile != "" {
+		users, err = loadUsers(*usersFile)
+		if err != nil {
+			return err
+		}
+		seed := map[string]string{}
+		for _, account := range users.byName {
+			if account.Role != "" {
+				seed[account.Name] = account.Role
+			}
+		}
+		roles.Load(seed)
+	}
+	if *sessionTTL <= 0 {
+		return errors.New("--session-ttl must be positive")
+	}
+	sessions = NewSessionStore(*sessionTTL)
+	if *usersFile != "" && *tlsCert == "" {
+		// Session cookies are marked 'Secure', browsers only send them back over HTTPS or to localhost
+		slog.Warn("sign in from browsers needs HTTPS, start with --tls-cert and --tls-key")
+	}
+
+	// Load the stored workspaces and store every write from now on
+	if *dbPath != "" {
+		taskDB, err = OpenTaskDB(*dbPath)
+		if err != nil {
+			return err
+		}
+		snapshot, err := taskDB.Load()
+		if err != nil {
+			return fmt.Errorf("failed to load tasks from '%s': %w", *dbPath, err)
+		}
+		workspaces.Load(snapshot)
+		roles.Load(snapshot.Roles)
+		writeLog.persist = taskDB.Apply
+		slog.Info("tasks loaded", "file", *dbPath, "workspaces", len(workspaces.List()))
+	}
+
+	// Follow a leader's write log and refuse writes until promoted
+	if *follow != "" {
+		leader, err := url.Parse(*follow)
+		if err != nil || (leader.Scheme != "http" && leader.Scheme != "https") || leader.Host == "" {
+			return fmt.Errorf("invalid --follow URL '%s'", *follow)
+		}
+		replica.Follow(*follow, *followToken)
+	}
+
+	// Create the next occurrence of recurring tasks in the background
+	go runRecurrence(workspaces, *recurrenceInterval)
+
+	// Store attachments on disk and remove files left behind by deleted tasks
+	attachments = &AttachmentStore{Dir: *attachmentsDir, MaxSize: *attachmentMaxSize, AllowedTypes: splitList(*attachmentTypes)}
+	err = os.MkdirAll(attachments.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create attachments directory: %w", err)
+	}
+	go runAttachmentCleanup(attachments, workspaces, time.Hour)
+
+	// Permanently delete tasks that have been in the trash longer than the retention period
+	if *trashRetention <= 0 {
+		return errors.New("--trash-retention must be positive")
+	}
+	go runPurge(workspaces, attachments, *trashRetention, min(*trashRetention, time.Hour))
+
+	// Browsers refuse credentials with 'Access-Control-Allow-Origin: *', echoing every origin instead would let any site use them
+	if *corsCredentials && slices.Contains(splitList(*corsOrigins), "*") {
+		return errors.New("--cors-credentials cannot be used with --cors-origins '*', list the allowed origins instead")
+	}
+	cors := CORSConfig{
+		Origins:          splitList(*corsOrigins),
+		Methods:          splitList(*corsMethods),
+		Headers:          splitList(*corsHeaders),
+		ExposeHeaders:    []string{"Location", "Idempotent-Replayed", "Deprecation", "Sunset", "Link", "API-Version", "X-Request-ID", "Traceparent"},
+		AllowCredentials: *corsCredentials,
+		MaxAge:           *corsMaxAge,
+	}
+
+	// Wrap the routes in middleware, the last one added runs first
+	var handler http.Handler = recordRoute(newMux(NewIdempotencyStore(*idempotencyTTL)))
+	handler = withReadOnly(handler)
+	handler = withWorkspace(workspaces, handler)
+	handler = withAuth(users, handler)
+	handler = withVersion(handler)
+	handler = withCompression(handler, *compressMinSize)
+	handler = withCORS(cors, handler)
+	handler = withTracing(handler)
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: handler,
+	}
+
+	// Serve plain HTTP when no certificate is configured
+	if *tlsCert == "" {
+		fmt.Printf("Starting server on %s...\n", *addr)
+		return server.ListenAndServe()
+	}
+
+	// Speak both HTTP/1.1 and HTTP/2 over TLS
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+
+	// Redirect plain HTTP requests to the HTTPS address
+	if *httpAddr != "" {
+		redirect := &http.Server{
+			Addr:    *httpAddr,
+			Handler: redirectToHTTPS(*addr),
+		}
+		go func() {
+			fmt.Printf("Redirecting HTTP on %s to HTTPS...\n", *httpAddr)
+			err := redirect.ListenAndServe()
+			if err != nil {
+				log.Println("Error starting redirect server:", err)
+			}
+		}()
+	}
+
+	fmt.Printf("Starting TLS server on %s...\n", *addr)
+	return server.ListenAndServeTLS(*tlsCert, *tlsKey)
+}
+
+// newMux sets up the routes of the Task Manager API
+func newMux(idempotency *IdempotencyStore) *http.ServeMux {
+	// Set up routing with 'http.ServeMux'
+	mux := http.NewServeMux()
+
+	// Every route except the welcome message and signing in and out checks the permission of the caller's role
+
+	// Define the root route to display a welcome message
+	mux.HandleFunc("/", handleRoot)
+
+	// Define the '/tasks' route to handle GET and POST requests for tasks
+	mux.Handle("/tasks", allowByMethod(PermReadTasks, PermWriteTasks, idempotency.Wrap(http.HandlerFunc(handleTasks))))
+
+	// Define the '/tasks/{id}' route to read, edit and delete a single task
+	mux.Handle("/tasks/{id}", allowByMethod(PermReadTasks, PermWriteTasks, http.HandlerFunc(handleTask)))
+
+	// Define the attachment routes to upload, list, download and delete files of a task
+	mux.Handle("GET /tasks/{id}/attachments", allow(PermReadTasks, handleListAttachments))
+	mux.Handle("POST /tasks/{id}/attachments", allow(PermWriteTasks, handleUploadAttachments))
+	mux.Handle("GET /tasks/{id}/attachments/{attachment}", allow(PermReadTasks, handleDownloadAttachment))
+	mux.Handle("DELETE /tasks/{id}/attachments/{attachment}", allow(PermWriteTasks, handleDeleteAttachment))
+
+	// Define the board routes to show tasks as columns and move them around
+	mux.Handle("GET /board", allow(PermReadTasks, handleBoard))
+	mux.Handle("POST /tasks/{id}/move", allow(PermWriteTasks, handleMoveTask))
+
+	// Define the dependency routes to say which tasks must be done first and to plan the work
+	mux.Handle("PUT /tasks/{id}/blocked-by/{dep}", allow(PermWriteTasks, handleAddDependency))
+	mux.Handle("DELETE /tasks/{id}/blocked-by/{dep}", allow(PermWriteTasks, handleRemoveDependency))
+	mux.Handle("GET /tasks/plan", allow(PermReadTasks, handlePlan))
+
+	// Define the comment routes for the discussion thread of a task
+	mux.Handle("GET /tasks/{id}/comments", allow(PermReadTasks, handleListComments))
+	mux.Handle("POST /tasks/{id}/comments", allow(PermWriteTasks, handleAddComment))
+	mux.Handle("PATCH /tasks/{id}/comments/{comment}", allow(PermWriteTasks, handleUpdateComment))
+	mux.Handle("DELETE /tasks/{id}/comments/{comment}", allow(PermWriteTasks, handleDeleteComment))
+
+	// Define the calendar routes so calendar apps can subscribe to due dates of a workspace or a user
+	mux.Handle("GET /calendar.ics", allow(PermReadTasks, handleCalendar))
+	mux.Handle("GET /users/{user}/calendar.ics", allow(PermReadTasks, handleUserCalendar))
+
+	// Define the sync routes for offline clients to pull changes and push their own writes
+	mux.Handle("GET /tasks/changes", allow(PermReadTasks, handleChanges))
+	mux.Handle("POST /tasks/sync", allowByMethod(PermReadTasks, PermWriteTasks, idempotency.Wrap(http.HandlerFunc(handleSync))))
+
+	// Define the trash routes to list deleted tasks and bring them back
+	mux.Handle("GET /trash", allow(PermReadTasks, handleTrash))
+	mux.Handle("POST /tasks/{id}/restore", allow(PermWriteTasks, handleRestoreTask))
+
+	// Define the template routes to save task trees and create tasks from them
+	mux.Handle("GET /templates", allow(PermReadTasks, handleListTemplates))
+	mux.Handle("GET /templates/{name}", allow(PermReadTasks, handleGetTemplate))
+	mux.Handle("PUT /templates/{name}", allow(PermWriteTasks, handlePutTemplate))
+	mux.Handle("DELETE /templates/{name}", allow(PermWriteTasks, handleDeleteTemplate))
+	mux.Handle("POST /templates/{name}/instantiate", allowByMethod(PermReadTasks, PermWriteTasks, idempotency.Wrap(http.HandlerFunc(handleInstantiateTemplate))))
+
+	// Define the todo.txt routes to import and export tasks as plain text
+	mux.Handle("POST /tasks/import", allowByMethod(PermReadTasks, PermWriteTasks, idempotency.Wrap(http.HandlerFunc(handleImportTasks))))
+	mux.Handle("GET /tasks/export", allow(PermReadTasks, handleExportTasks))
+
+	// Define the '/ui' route to show the tasks in a browser
+	mux.Handle("GET /ui", allow(PermReadTasks, handleUI))
+
+	// Define the '/submit' route to handle form submissions for adding tasks
+	mux.Handle("/submit", allow(PermWriteTasks, handleForm))
+
+	// Define the '/workspaces' routes to manage workspaces and their members
+	mux.Handle("/workspaces", allowByMethod(PermReadTasks, PermManageWorkspaces, http.HandlerFunc(handleWorkspaces)))
+	mux.Handle("/workspaces/{name}", allowByMethod(PermReadTasks, PermManageWorkspaces, http.HandlerFunc(handleWorkspace)))
+
+	// Define the JSON-RPC route for tools that call the task operations as methods, each method checks its own permission
+	mux.Handle("POST /rpc", allow(PermReadTasks, handleRPC))
+
+	// Define the replication routes for followers to copy the writes of this server and to promote a follower
+	mux.Handle("GET /replication/log", allow(PermManageWorkspaces, handleReplicationLog))
+	mux.Handle("GET /replication/snapshot", allow(PermManageWorkspaces, handleReplicationSnapshot))
+	mux.Handle("GET /replication/status", allow(PermReadTasks, handleReplicationStatus))
+	mux.Handle("POST /replication/promote", allow(PermManageWorkspaces, handlePromote))
+
+	// Define the routes for browsers to sign in and out with a session cookie
+	mux.HandleFunc("GET /login", handleLoginPage)
+	mux.HandleFunc("POST /login", handleLogin)
+	mux.HandleFunc("POST /logout", handleLogout)
+
+	// Define the role routes for admins to see and change who may do what
+	mux.Handle("GET /roles", allow(PermManageRoles, handleListRoles))
+	mux.Handle("PUT /roles/{user}", allow(PermManageRoles, handleAssignRole))
+	mux.Handle("DELETE /roles/{user}", allow(PermManageRoles, handleRemoveRole))
+
+	return mux
+}
+
+// withCompression compresses responses with gzip or deflate when the client accepts it
+func withCompression(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The response depends on 'Accept-Encoding' whether or not it ends up compressed
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the preferred supported encoding from an 'Accept-Encoding' header
+func negotiateEncoding(header string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		// Parse the optional quality value (e.g. 'gzip;q=0.5')
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		var candidates []string
+		switch name {
+		case "gzip", "deflate":
+			candidates = []string{name}
+		case "*":
+			candidates = []string{"gzip", "deflate"}
+		}
+
+		// Prefer gzip over deflate when both have the same quality
+		for _, c := range candidates {
+			if q > bestQ || (q == bestQ && q > 0 && c == "gzip") {
+				best, bestQ = c, q
+			}
+		}
+	}
+	return best
+}
+
+// Writers are reused between responses to avoid allocating compression state per request
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(io.Discard) }}
+)
+
+// compressWriter buffers the start of a response and compresses it once it is large enough
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	encoder interface {
+		io.WriteCloser
+		Flush() error
+		Reset(io.Writer)
+	}
+}
+
+// WriteHeader records the status code until the compression decision is made
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided || cw.status != 0 {
+		return
+	}
+	cw.status = status
+
+	// Informational and body-less responses are sent straight away
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+// Write buffers data until 'minSize' bytes are available, then streams it through the encoder
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if !cw.decided {
+		cw.buf = append(cw.buf, p...)
+		if len(cw.buf) < cw.minSize {
+			return len(p), nil
+		}
+		err := cw.decide(true)
+		return len(p), err
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// Flush sends everything written so far, which keeps streaming responses such as SSE live
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+		}
+		cw.decide(true)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Close writes any buffered data and finishes the compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if cw.status == 0 {
+			return nil
+		}
+		// The whole body fit below the threshold so it is sent uncompressed
+		return cw.decide(false)
+	}
+	if cw.encoder == nil {
+		return nil
+	}
+
+	err := cw.encoder.Close()
+	if cw.encoding == "gzip" {
+		gzipWriters.Put(cw.encoder)
+	} else {
+		zlibWriters.Put(cw.encoder)
+	}
+	cw.encoder = nil
+	return err
+}
+
+// Unwrap gives 'http.ResponseController' access to the underlying writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// decide writes the headers, choosing whether the body is compressed, and flushes the buffer
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+
+	// Sniff the content type from the plain data before it gets compressed
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	// Skip bodies that are already encoded, partial or not worth compressing
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" || cw.status == http.StatusPartialContent || !compressibleType(header.Get("Content-Type")) {
+		compress = false
+	}
+
+	if compress {
+		if cw.encoding == "gzip" {
+			cw.encoder = gzipWriters.Get().(*gzip.Writer)
+		} else {
+			cw.encoder = zlibWriters.Get().(*zlib.Writer)
+		}
+		cw.encoder.Reset(cw.ResponseWriter)
+
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	buf := cw.buf
+	cw.buf = nil
+	if cw.encoder != nil {
+		_, err := cw.encoder.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// compressibleType reports whether a content type benefits from compression
+func compressibleType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+
+	switch {
+	case mediaType == "":
+		return true
+	case mediaType == "image/svg+xml":
+		return true
+	case strings.HasPrefix(mediaType, "image/"), strings.HasPrefix(mediaType, "audio/"), strings.HasPrefix(mediaType, "video/"):
+		return false
+	case mediaType == "application/zip", mediaType == "application/gzip", mediaType == "application/octet-stream":
+		return false
+	}
+	return true
+}
+
+// maxIdempotentBody is the largest request body that can be used with an 'Idempotency-Key'
+const maxIdempotentBody = 1 << 20
+
+// idempotentResponse is the recorded response for one 'Idempotency-Key'
+type idempotentResponse struct {
+	requestHash [sha256.Size]byte
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// IdempotencyStore remembers responses by 'Idempotency-Key' so retried requests are replayed
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	responses map[string]*idempotentResponse
+	lastSweep time.Time
+}
+
+// NewIdempotencyStore creates a store that keeps responses for the given time
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{ttl: ttl, responses: map[string]*idempotentResponse{}}
+}
+
+// Wrap makes POST requests carrying an 'Idempotency-Key' header safe to retry
+func (s *IdempotencyStore) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			httpError(w, r, "Idempotency-Key must be at most 255 characters.", http.StatusBadRequest)
+			return
+		}
+
+		// Read the body so it can be hashed and then handed to the next handler
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBody+1))
+		r.Body.Close()
+		if err != nil {
+			httpError(w, r, "Error reading request body.", http.StatusInternalServerError)
+			return
+		}
+		if len(body) > maxIdempotentBody {
+			httpError(w, r, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the workspace, caller and path so they cannot collide between them
+		scope := strings.Join([]string{workspaceFrom(r.Context()).Name, requestUser(r), r.URL.Path, key}, "\n")
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\n"), body...))
+
+		entry, replay, status := s.begin(scope, hash)
+		switch status {
+		case http.StatusUnprocessableEntity:
+			httpError(w, r, "Idempotency-Key was already used with a different request.", status)
+			return
+		case http.StatusConflict:
+			httpError(w, r, "A request with this Idempotency-Key is still being processed.", status)
+			return
+		}
+		if replay {
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		// Run the request and record the response while sending it, a panic releases the key like a server error
+		defer func() {
+			if err := recover(); err != nil {
+				s.release(scope)
+				panic(err)
+			}
+		}()
+		rec := &recordingWriter{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		s.finish(scope, rec)
+	})
+}
+
+// begin returns the recorded response for a key or reserves the key for a new request
+func (s *IdempotencyStore) begin(scope string, hash [sha256.Size]byte) (*idempotentResponse, bool, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	entry, ok := s.responses[scope]
+	if ok && now.Before(entry.expires) {
+		switch {
+		case entry.requestHash != hash:
+			return nil, false, http.StatusUnprocessableEntity
+		case !entry.done:
+			return nil, false, http.StatusConflict
+		}
+		return entry, true, http.StatusOK
+	}
+
+	// Reserve the key so concurrent retries wait for this request to finish
+	s.responses[scope] = &idempotentResponse{requestHash: hash, expires: now.Add(s.ttl)}
+	return nil, false, http.StatusOK
+}
+
+// finish stores the response for a key, server errors release the key so the request can be retried
+func (s *IdempotencyStore) finish(scope string, rec *recordingWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if rec.status >= 500 {
+		delete(s.responses, scope)
+		return
+	}
+
+	entry := s.responses[scope]
+	entry.done = true
+	entry.status = rec.status
+	entry.header = replayableHeader(rec.Header())
+	entry.body = rec.body.Bytes()
+	entry.expires = time.Now().Add(s.ttl)
+}
+
+// release forgets a key whose request did not finish, so it can be retried
+func (s *IdempotencyStore) release(scope string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.responses, scope)
+}
+
+// replayableHeader copies the headers the handler set for its response
+//
+// Headers of the middleware around it are left out: the replay is compressed again on its own, and
+// request IDs, trace context and CORS headers belong to the request being answered.
+func replayableHeader(header http.Header) http.Header {
+	replay := header.Clone()
+	for name := range replay {
+		switch name {
+		case "Content-Encoding", "Content-Length", "Vary", "X-Request-Id", "Traceparent":
+			delete(replay, name)
+		default:
+			if strings.HasPrefix(name, "Access-Control-") {
+				delete(replay, name)
+			}
+		}
+	}
+	return replay
+}
+
+// sweep removes expired responses at most once a minute, the caller must hold the lock
+func (s *IdempotencyStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for scope, entry := range s.responses {
+		if entry.done && now.After(entry.expires) {
+			delete(s.responses, scope)
+		}
+	}
+}
+
+// recordingWriter copies the status and body of a response while writing it
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status code and sends it
+func (rw *recordingWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the data and sends it
+func (rw *recordingWriter) Write(p []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(p)
+	return rw.ResponseWriter.Write(p)
+}
+
+// Unwrap gives 'http.ResponseController' access to the underlying writer
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// CORSConfig controls which browser origins may call the API and how
+type CORSConfig struct {
+	Origins          []string
+	Methods          []string
+	Headers          []string
+	ExposeHeaders    []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// allowsOrigin reports whether an origin matches the list, which may contain '*' or 'https://*.example.com'
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.Origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok {
+			if len(origin) > len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// withCORS adds CORS headers for allowed origins and answers preflight requests
+func withCORS(config CORSConfig, next http.Handler) http.Handler {
+	if len(config.Origins) == 0 {
+		return next
+	}
+	wildcard := slices.Contains(config.Origins, "*")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// The response differs per origin unless every origin gets '*'
+		if !wildcard {
+			w.Header().Add("Vary", "Origin")
+		}
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !config.allowsOrigin(origin) {
+			if preflight {
+				httpError(w, r, "Origin not allowed.", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := w.Header()
+		if wildcard {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		// Any origin may call with '*', so it never gets the caller's credentials
+		if config.AllowCredentials && !wildcard {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			if len(config.ExposeHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(config.ExposeHeaders, ", "))
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Answer the preflight here instead of passing it to the routes
+		header.Add("Vary", "Access-Control-Request-Method")
+		header.Add("Vary", "Access-Control-Request-Headers")
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if !slices.Contains(config.Methods, method) && method != http.MethodGet && method != http.MethodHead && method != http.MethodPost {
+			httpError(w, r, "Method not allowed by CORS policy.", http.StatusForbidden)
+			return
+		}
+		for _, name := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+			if !slices.ContainsFunc(config.Headers, func(h string) bool { return strings.EqualFold(h, name) }) {
+				httpError(w, r, fmt.Sprintf("Header '%s' not allowed by CORS policy.", name), http.StatusForbidden)
+				return
+			}
+		}
+
+		header.Set("Access-Control-Allow-Methods", strings.Join(config.Methods, ", "))
+		if len(config.Headers) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(config.Headers, ", "))
+		}
+		if config.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// splitList splits a comma-separated list and drops empty items
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// RequestTrace identifies a request in logs, responses and calls to other services
+type RequestTrace struct {
+	RequestID string
+	TraceID   string
+	SpanID    string
+	ParentID  string
+	Flags     string
+
+	// Route is the matched pattern (e.g. 'GET /tasks/{id}'), filled in once routing is done
+	Route string
+}
+
+// Traceparent formats the trace as a W3C 'traceparent' header for this server's span
+func (t *RequestTrace) Traceparent() string {
+	return "00-" + t.TraceID + "-" + t.SpanID + "-" + t.Flags
+}
+
+// traceFrom returns the trace of a request, or nil outside of a request
+func traceFrom(ctx context.Context) *RequestTrace {
+	trace, _ := ctx.Value(traceKey).(*RequestTrace)
+	return trace
+}
+
+// requestIDRE limits accepted request IDs to short printable tokens so they are safe to log
+var requestIDRE = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// traceparentRE matches a version 00 'traceparent' header
+var traceparentRE = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// randomHex returns n random bytes encoded as hexadecimal
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withTracing accepts or creates request and trace IDs, echoes them and writes an access log line
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		trace := &RequestTrace{RequestID: r.Header.Get("X-Request-ID"), SpanID: randomHex(8), Flags: "01"}
+		if !requestIDRE.MatchString(trace.RequestID) {
+			trace.RequestID = randomHex(16)
+		}
+
+		// Continue the caller's trace when it sends a valid 'traceparent'
+		m := traceparentRE.FindStringSubmatch(r.Header.Get("Traceparent"))
+		if m != nil && m[1] != strings.Repeat("0", 32) && m[2] != strings.Repeat("0", 16) {
+			trace.TraceID, trace.ParentID, trace.Flags = m[1], m[2], m[3]
+		} else {
+			trace.TraceID = randomHex(16)
+		}
+
+		w.Header().Set("X-Request-ID", trace.RequestID)
+		w.Header().Set("Traceparent", trace.Traceparent())
+
+		ctx := context.WithValue(r.Context(), traceKey, trace)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		route := trace.Route
+		if route == "" {
+			route = "unmatched"
+		}
+		slog.InfoContext(ctx, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// recordRoute stores the pattern the mux matched in the request trace for the access log
+func recordRoute(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if trace := traceFrom(r.Context()); trace != nil {
+			trace.Route = r.Pattern
+		}
+	})
+}
+
+// statusRecorder remembers the status code and size of a response for logging
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader records the status code and sends it
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(p)
+	sr.bytes += n
+	return n, err
+}
+
+// Unwrap gives 'http.ResponseController' access to the underlying writer
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// traceHandler adds the request and trace IDs from the context to every log record
+type traceHandler struct {
+	slog.Handler
+}
+
+// newLogger creates a JSON logger that includes request and trace IDs
+func newLogger(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(traceHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})})
+}
+
+// Handle adds the IDs of the request in the context before passing the record on
+func (h traceHandler) Handle(ctx context.Context, record slog.Record) error {
+	if trace := traceFrom(ctx); trace != nil {
+		record.AddAttrs(
+			slog.String("request_id", trace.RequestID),
+			slog.String("trace_id", trace.TraceID),
+			slog.String("span_id", trace.SpanID),
+		)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs keeps the trace handler when attributes are added to the logger
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+// WithGroup keeps the trace handler when a group is added to the logger
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+// redirectToHTTPS returns a handler that permanently redirects requests to the HTTPS address
+func redirectToHTTPS(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
+
+// runGenCert creates a development CA and a leaf certificate signed by it
+func runGenCert(args []string) error {
+	fs := flag.NewFlagSet("gen-cert", flag.ExitOnError)
+	outDir := fs.String("out", "certs", "directory to write the certificates to")
+	hosts := fs.String("hosts", "localhost,127.0.0.1,::1", "comma-separated host names and IPs for the leaf certificate")
+	days := fs.Int("days", 365, "number of days the leaf certificate is valid")
+	fs.Parse(args)
+
+	err := os.MkdirAll(*outDir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create directory '%s': %w", *outDir, err)
+	}
+
+	caCertPath := filepath.Join(*outDir, "ca.pem")
+	caKeyPath := filepath.Join(*outDir, "ca-key.pem")
+
+	// Reuse an existing CA so certificates already trusted keep working
+	caCert, caKey, err := loadCA(caCertPath, caKeyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		caCert, caKey, err = createCA(caCertPath, caKeyPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(*outDir, "cert.pem")
+	keyPath := filepath.Join(*outDir, "key.pem")
+	err = createLeafCert(certPath, keyPath, strings.Split(*hosts, ","), *days, caCert, caKey)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("CA certificate written to '%s' (add it to your trust store).\n", caCertPath)
+	fmt.Printf("Start the server with: --tls-cert %s --tls-key %s\n", certPath, keyPath)
+	return nil
+}
+
+// createCA generates a self-signed development CA and writes it to disk
+func createCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Task Manager Development CA"}, CommonName: "Task Manager Development CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+
+	err = writeCertAndKey(certPath, keyPath, der, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+	return cert, key, nil
+}
+
+// loadCA reads a previously generated CA certificate and key from disk
+func loadCA(certPath, keyPath string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil, err
+		}
+		return nil, nil, fmt.Errorf("failed to load CA from '%s': %w", certPath, err)
+	}
+
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %w", err)
+	}
+
+	key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+	if !ok || !cert.IsCA {
+		return nil, nil, fmt.Errorf("'%s' is not an ECDSA certificate authority", certPath)
+	}
+	return cert, key, nil
+}
+
+// createLeafCert generates a server certificate for the given hosts signed by the CA
+func createLeafCert(certPath, keyPath string, hosts []string, days int, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"Task Manager Development"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, days),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	// Split the hosts into DNS names and IP addresses
+	for _, host := range hosts {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %w", err)
+	}
+	return writeCertAndKey(certPath, keyPath, der, key)
+}
+
+// writeCertAndKey writes a DER certificate and its private key as PEM files
+func writeCertAndKey(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err := os.WriteFile(certPath, certPEM, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write certificate '%s': %w", certPath, err)
+	}
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to serialize private key: %w", err)
+	}
+
+	// Keep private keys readable by the owner only
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	err = os.WriteFile(keyPath, keyPEM, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write private key '%s': %w", keyPath, err)
+	}
+	return nil
+}
+
+// randomSerial returns a random 128-bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	return serial, nil
+}
+
+// APIVersion maps tasks to and from the JSON shape of one version of the API
+type APIVersion struct {
+	Name       string
+	Deprecated time.Time
+	Sunset     time.Time
+
+	encodeTask  func(Task) any
+	encodeTasks func([]Task) any
+	decodeTask  func([]byte) (Task, error)
+	decodePatch func([]byte) (taskPatch, error)
+}
+
+// taskV1 is the task shape of version 1, it must not change
+type taskV1 struct {
+	ID          int        `json:"id"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	Due         *time.Time `json:"due,omitempty"`
+	Recurrence  string     `json:"recurrence,omitempty"`
+	NextID      int        `json:"next_id,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// taskV2 is the task shape of version 2, with scheduling fields grouped together
+type taskV2 struct {
+	ID              int             `json:"id"`
+	Title           string          `json:"title"`
+	Description     string          `json:"description"`
+	DescriptionHTML string          `json:"description_html,omitempty"`
+	Status          string          `json:"status"`
+	Priority        string          `json:"priority,omitempty"`
+	Schedule        *taskScheduleV2 `json:"schedule,omitempty"`
+	ParentID        int             `json:"parent_id,omitempty"`
+	Attachments     []Attachment    `json:"attachments,omitempty"`
+	CommentCount    int             `json:"comment_count"`
+	Rank            string          `json:"rank"`
+	BlockedBy       []int           `json:"blocked_by,omitempty"`
+	Blocked         bool            `json:"blocked"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	DeletedAt       *time.Time      `json:"deleted_at,omitempty"`
+}
+
+// taskScheduleV2 holds the due date and recurrence of a version 2 task
+type taskScheduleV2 struct {
+	DueAt      *time.Time `json:"due_at,omitempty"`
+	Recurrence string     `json:"recurrence,omitempty"`
+	NextID     int        `json:"next_id,omitempty"`
+}
+
+// taskListV2 wraps a version 2 task list so metadata can be added without breaking clients
+type taskListV2 struct {
+	Tasks []taskV2 `json:"tasks"`
+	Count int      `json:"count"`
+}
+
+// taskPatchV2 is a partial update in the version 2 shape
+type taskPatchV2 struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Status      *string `json:"status"`
+	Priority    *string `json:"priority"`
+	Schedule    *struct {
+		DueAt      nullableTime `json:"due_at"`
+		Recurrence *string      `json:"recurrence"`
+	} `json:"schedule"`
+}
+
+// apiV1 is the original task API, also served on the unversioned legacy paths
+var apiV1 = &APIVersion{
+	Name:        "v1",
+	Deprecated:  time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC),
+	Sunset:      time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC),
+	encodeTask:  func(t Task) any { return toTaskV1(t) },
+	encodeTasks: func(list []Task) any { return mapTasks(list, toTaskV1) },
+	decodeTask:  decodeTaskV1,
+	decodePatch: decodePatchV1,
+}
+
+// apiV2 is the current task API
+var apiV2 = &APIVersion{
+	Name:       "v2",
+	encodeTask: func(t Task) any { return toTaskV2(t) },
+	encodeTasks: func(list []Task) any {
+		return taskListV2{Tasks: mapTasks(list, toTaskV2), Count: len(list)}
+	},
+	decodeTask:  decodeTaskV2,
+	decodePatch: decodePatchV2,
+}
+
+// mapTasks converts every task of a list with the given function
+func mapTasks[T any](list []Task, convert func(Task) T) []T {
+	out := make([]T, len(list))
+	for i, t := range list {
+		out[i] = convert(t)
+	}
+	return out
+}
+
+// toTaskV1 converts a task to the version 1 shape
+func toTaskV1(t Task) taskV1 {
+	return taskV1{t.ID, t.Title, t.Description, t.Status, t.Due, t.Recurrence, t.NextID, t.CreatedAt, t.UpdatedAt}
+}
+
+// decodeTaskV1 reads a new task in the version 1 shape
+func decodeTaskV1(data []byte) (Task, error) {
+	var t taskV1
+	err := json.Unmarshal(data, &t)
+	return Task{Title: t.Title, Description: t.Description, Status: t.Status, Due: t.Due, Recurrence: t.Recurrence}, err
+}
+
+// decodePatchV1 reads a partial update in the version 1 shape
+func decodePatchV1(data []byte) (taskPatch, error) {
+	var patch taskPatch
+	err := json.Unmarshal(data, &patch)
+	return patch, err
+}
+
+// toTaskV2 converts a task to the version 2 shape
+func toTaskV2(t Task) taskV2 {
+	out := taskV2{ID: t.ID, Title: t.Title, Description: t.Description, DescriptionHTML: t.DescriptionHTML, Status: t.Status, Priority: t.Priority, ParentID: t.ParentID, Attachments: t.Attachments, CommentCount: t.CommentCount, Rank: t.Rank, BlockedBy: t.BlockedBy, Blocked: t.Blocked, CreatedAt: t.CreatedAt, UpdatedAt: t.UpdatedAt, DeletedAt: t.DeletedAt}
+	if t.Due != nil || t.Recurrence != "" || t.NextID != 0 {
+		out.Schedule = &taskScheduleV2{DueAt: t.Due, Recurrence: t.Recurrence, NextID: t.NextID}
+	}
+	return out
+}
+
+// decodeTaskV2 reads a new task in the version 2 shape
+func decodeTaskV2(data []byte) (Task, error) {
+	var t taskV2
+	err := json.Unmarshal(data, &t)
+	task := Task{Title: t.Title, Description: t.Description, Status: t.Status, Priority: t.Priority}
+	if t.Schedule != nil {
+		task.Due = t.Schedule.DueAt
+		task.Recurrence = t.Schedule.Recurrence
+	}
+	return task, err
+}
+
+// decodePatchV2 reads a partial update in the version 2 shape
+func decodePatchV2(data []byte) (taskPatch, error) {
+	var p taskPatchV2
+	err := json.Unmarshal(data, &p)
+	patch := taskPatch{Title: p.Title, Description: p.Description, Status: p.Status, Priority: p.Priority}
+	if p.Schedule != nil {
+		patch.Due = p.Schedule.DueAt
+		patch.Recurrence = p.Schedule.Recurrence
+	}
+	return patch, err
+}
+
+// apiVersions lists the versions served under '/{version}/'
+var apiVersions = map[string]*APIVersion{"v1": apiV1, "v2": apiV2}
+
+// versionFrom returns the API version of a request, unversioned requests use version 1
+func versionFrom(ctx context.Context) *APIVersion {
+	if version, ok := ctx.Value(versionKey).(*APIVersion); ok {
+		return version
+	}
+	return apiV1
+}
+
+// withVersion selects the API version from a '/v1' or '/v2' path prefix and marks deprecated versions
+func withVersion(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		version := apiV1
+		legacy := true
+
+		// Strip the version prefix so the routes below are shared by every version
+		first, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if v, ok := apiVersions[first]; ok {
+			version = v
+			legacy = false
+			r = withPath(r, "/"+rest)
+			ctx = withBasePath(ctx, "/"+first)
+		}
+
+		// Tell clients of old versions when they stop working and where to go next
+		if !version.Deprecated.IsZero() {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%d", version.Deprecated.Unix()))
+			w.Header().Set("Link", fmt.Sprintf("</v2%s>; rel=\"successor-version\"", r.URL.Path))
+		}
+		if !version.Sunset.IsZero() {
+			w.Header().Set("Sunset", version.Sunset.Format(http.TimeFormat))
+		}
+		if legacy {
+			w.Header().Set("API-Version", version.Name+" (legacy path)")
+		} else {
+			w.Header().Set("API-Version", version.Name)
+		}
+
+		ctx = context.WithValue(ctx, versionKey, version)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// writeTask writes a task in the shape of the request's API version
+func writeTask(w http.ResponseWriter, r *http.Request, status int, task Task) {
+	if wantsHTML(r) {
+		task.DescriptionHTML = renderMarkdown(task.Description)
+	}
+	writeJSON(w, status, versionFrom(r.Context()).encodeTask(task))
+}
+
+// writeTasks writes a task list in the shape of the request's API version
+func writeTasks(w http.ResponseWriter, r *http.Request, status int, list []Task) {
+	if wantsHTML(r) {
+		for i := range list {
+			list[i].DescriptionHTML = renderMarkdown(list[i].Description)
+		}
+	}
+	writeJSON(w, status, versionFrom(r.Context()).encodeTasks(list))
+}
+
+// wantsHTML reports whether '?render=html' asks for descriptions rendered from Markdown, version 1 has no field for them
+func wantsHTML(r *http.Request) bool {
+	return versionFrom(r.Context()) != apiV1 && r.URL.Query().Get("render") == "html"
+}
+
+// handleRoot displays a welcome message on the root endpoint
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Welcome to the Task Manager API!")
+}
+
+// handleTasks handles GET and POST requests for task management
+func handleTasks(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Return all tasks as JSON, optionally filtered by status and due date
+		query := r.URL.Query()
+		filter := TaskFilter{Status: query.Get("status")}
+		var err error
+		for name, bound := range map[string]*time.Time{"due_after": &filter.DueAfter, "due_before": &filter.DueBefore} {
+			if value := query.Get(name); value != "" && err == nil {
+				*bound, err = time.Parse(time.RFC3339, value)
+			}
+		}
+		if err != nil {
+			httpError(w, r, "Invalid due_after or due_before, use RFC 3339 times.", http.StatusBadRequest)
+			return
+		}
+		list, err := listTasks(r.Context(), workspaceFrom(r.Context()), filter)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "listing tasks failed", "error", err)
+			httpError(w, r, "Error reading tasks.", http.StatusInternalServerError)
+			return
+		}
+		writeTasks(w, r, http.StatusOK, list)
+	case http.MethodPost:
+		// Add a new task from JSON data in the request body
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTaskBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, r, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Error reading request body.", http.StatusInternalServerError)
+			return
+		}
+		defer r.Body.Close()
+
+		newTask, err := versionFrom(r.Context()).decodeTask(body)
+		if err != nil {
+			httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+
+		err = validateTask(newTask)
+		if err != nil {
+			httpError(w, r, "Invalid task: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+
+		ws := workspaceFrom(r.Context())
+		created, err := ws.Tasks.Add(r.Context(), newTask)
+		if storeError(w, r, err) {
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			httpError(w, r, fmt.Sprintf("Workspace task quota of %d reached.", ws.MaxTasks), http.StatusConflict)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("%s/tasks/%d", basePath(r.Context()), created.ID))
+		writeTask(w, r, http.StatusCreated, created)
+	default:
+		httpError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// TaskFilter selects tasks by status and due date, empty fields match every task
+type TaskFilter struct {
+	Status    string
+	DueAfter  time.Time
+	DueBefore time.Time
+}
+
+// Matches reports whether a task passes the filter, due dates are matched in [DueAfter, DueBefore)
+func (f TaskFilter) Matches(task Task) bool {
+	if f.Status != "" && task.Status != f.Status {
+		return false
+	}
+	if f.DueAfter.IsZero() && f.DueBefore.IsZero() {
+		return true
+	}
+	if task.Due == nil {
+		return false
+	}
+	return !task.Due.Before(f.DueAfter) && (f.DueBefore.IsZero() || task.Due.Before(f.DueBefore))
+}
+
+// listTasks returns the tasks of a workspace that pass the filter
+//
+// With a database the status or due date index finds the candidates, otherwise every task in memory is checked.
+// Memory is also used while writes that failed to reach the database wait to be stored again, so both
+// listings agree.
+func listTasks(ctx context.Context, ws *Workspace, filter TaskFilter) ([]Task, error) {
+	if taskDB == nil || filter == (TaskFilter{}) || !writeLog.Stored() {
+		list := ws.Tasks.List(ctx)
+		return slices.DeleteFunc(list, func(t Task) bool { return !filter.Matches(t) }), nil
+	}
+
+	var list []Task
+	var err error
+	if !filter.DueAfter.IsZero() || !filter.DueBefore.IsZero() {
+		list, err = taskDB.TasksDue(ws.Name, filter.DueAfter, filter.DueBefore)
+	} else {
+		list, err = taskDB.TasksByStatus(ws.Name, filter.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(list, func(a, b Task) int { return a.ID - b.ID })
+	return slices.DeleteFunc(list, func(t Task) bool { return !filter.Matches(t) }), nil
+}
+
+// taskPatch holds the fields of a partial task update, nil fields are left unchanged
+type taskPatch struct {
+	Title       *string      `json:"title"`
+	Description *string      `json:"description"`
+	Status      *string      `json:"status"`
+	Due         nullableTime `json:"due"`
+	Recurrence  *string      `json:"recurrence"`
+
+	// Priority only exists from version 2, so it is not read from version 1 bodies
+	Priority *string `json:"-"`
+}
+
+// nullableTime is a time in a partial update that tells an absent field from a null one
+type nullableTime struct {
+	Set  bool
+	Time *time.Time
+}
+
+// UnmarshalJSON records that the field was given, a null value clears the time
+func (n *nullableTime) UnmarshalJSON(data []byte) error {
+	n.Set = true
+	n.Time = nil
+	if string(data) == "null" {
+		return nil
+	}
+	return json.Unmarshal(data, &n.Time)
+}
+
+// apply copies the fields set in the patch to a task
+func (patch taskPatch) apply(t *Task) {
+	if patch.Title != nil {
+		t.Title = *patch.Title
+	}
+	if patch.Description != nil {
+		t.Description = *patch.Description
+	}
+	if patch.Status != nil {
+		t.Status = *patch.Status
+	}
+	if patch.Due.Set {
+		t.Due = patch.Due.Time
+	}
+	if patch.Recurrence != nil {
+		t.Recurrence = *patch.Recurrence
+	}
+	if patch.Priority != nil {
+		t.Priority = *patch.Priority
+	}
+}
+
+// handleTask handles GET, PATCH and DELETE requests for a single task
+func handleTask(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return
+	}
+
+	store := workspaceFrom(r.Context()).Tasks
+
+	switch r.Method {
+	case http.MethodGet:
+		task, err := store.Get(r.Context(), id)
+		if err != nil {
+			httpError(w, r, "Task not found.", http.StatusNotFound)
+			return
+		}
+		writeTask(w, r, http.StatusOK, task)
+	case http.MethodPatch:
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxTaskBody))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			httpError(w, r, "Request body too large.", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Error reading request body.", http.StatusInternalServerError)
+			return
+		}
+		patch, err := versionFrom(r.Context()).decodePatch(body)
+		if err != nil {
+			httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+			return
+		}
+
+		task, err := store.Update(r.Context(), id, patch.apply)
+		if storeError(w, r, err) {
+			return
+		}
+		if errors.Is(err, errTaskNotFound) {
+			httpError(w, r, "Task not found.", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errTaskBlocked) {
+			httpError(w, r, "Task is blocked, "+strings.TrimPrefix(err.Error(), errTaskBlocked.Error()+": ")+".", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Invalid task: "+err.Error()+".", http.StatusBadRequest)
+			return
+		}
+		writeTask(w, r, http.StatusOK, task)
+	case http.MethodDelete:
+		err := store.Delete(r.Context(), id)
+		if storeError(w, r, err) {
+			return
+		}
+		if err != nil {
+			httpError(w, r, "Task not found.", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		httpError(w, r, "Method not allowed.", http.StatusMethodNotAllowed)
+	}
+}
+
+// AttachmentStore keeps uploaded files on disk under '<dir>/<workspace>/<task>/<attachment>'
+type AttachmentStore struct {
+	Dir          string
+	MaxSize      int64
+	AllowedTypes []string
+}
+
+// Attachments of all tasks, configured when the server starts
+var attachments = &AttachmentStore{Dir: filepath.Join("data", "attachments"), MaxSize: 10 << 20}
+
+// Errors returned while saving an attachment
+var (
+	errAttachmentTooLarge = errors.New("attachment too large")
+	errAttachmentType     = errors.New("attachment type not allowed")
+)
+
+// taskDir returns the directory that holds the attachments of a task
+func (a *AttachmentStore) taskDir(workspace string, taskID int) string {
+	return filepath.Join(a.Dir, workspace, strconv.Itoa(taskID))
+}
+
+// Save streams one uploaded file to disk after checking its sniffed type and size
+func (a *AttachmentStore) Save(workspace string, taskID int, name string, r io.Reader) (Attachment, error) {
+	// Sniff the type from the first bytes rather than trusting the client
+	br := bufio.NewReaderSize(r, 512)
+	head, err := br.Peek(512)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) {
+		return Attachment{}, fmt.Errorf("failed to read upload: %w", err)
+	}
+	contentType := http.DetectContentType(head)
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if !slices.Contains(a.AllowedTypes, mediaType) {
+		return Attachment{ContentType: mediaType}, errAttachmentType
+	}
+
+	dir := a.taskDir(workspace, taskID)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to create directory '%s': %w", dir, err)
+	}
+
+	// Write to a temporary file first so a failed upload never leaves a partial attachment
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to create file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	size, err := io.Copy(tmp, io.LimitReader(br, a.MaxSize+1))
+	closeErr := tmp.Close()
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to write file: %w", err)
+	}
+	if closeErr != nil {
+		return Attachment{}, fmt.Errorf("failed to write file: %w", closeErr)
+	}
+	if size > a.MaxSize {
+		return Attachment{}, errAttachmentTooLarge
+	}
+
+	attachment := Attachment{
+		ID:          randomHex(8),
+		Name:        filepath.Base(name),
+		ContentType: contentType,
+		Size:        size,
+		CreatedAt:   time.Now().UTC(),
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(dir, attachment.ID))
+	if err != nil {
+		return Attachment{}, fmt.Errorf("failed to store file: %w", err)
+	}
+	return attachment, nil
+}
+
+// Open opens the file of an attachment
+func (a *AttachmentStore) Open(workspace string, taskID int, attachmentID string) (*os.File, error) {
+	return os.Open(filepath.Join(a.taskDir(workspace, taskID), attachmentID))
+}
+
+// Remove deletes the file of one attachment
+func (a *AttachmentStore) Remove(ctx context.Context, workspace string, taskID int, attachmentID string) {
+	err := os.Remove(filepath.Join(a.taskDir(workspace, taskID), attachmentID))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.ErrorContext(ctx, "failed to remove attachment", "task_id", taskID, "attachment", attachmentID, "error", err)
+	}
+}
+
+// RemoveTask deletes all files of a task
+func (a *AttachmentStore) RemoveTask(ctx context.Context, workspace string, taskID int) {
+	err := os.RemoveAll(a.taskDir(workspace, taskID))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to remove task attachments", "task_id", taskID, "error", err)
+	}
+}
+
+// RemoveWorkspace deletes all files of a workspace
+func (a *AttachmentStore) RemoveWorkspace(ctx context.Context, workspace string) {
+	err := os.RemoveAll(filepath.Join(a.Dir, workspace))
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to remove workspace attachments", "workspace", workspace, "error", err)
+	}
+}
+
+// CleanOrphans removes files that no longer belong to an existing task and attachment
+func (a *AttachmentStore) CleanOrphans(ctx context.Context, registry *WorkspaceRegistry) int {
+	removed := 0
+	workspaceDirs, _ := os.ReadDir(a.Dir)
+	for _, wsDir := range workspaceDirs {
+		ws, err := registry.Get(wsDir.Name())
+		if err != nil {
+			a.RemoveWorkspace(ctx, wsDir.Name())
+			removed++
+			continue
+		}
+
+		taskDirs, _ := os.ReadDir(filepath.Join(a.Dir, wsDir.Name()))
+		for _, taskDir := range taskDirs {
+			id, _ := strconv.Atoi(taskDir.Name())
+			task, err := ws.Tasks.Get(ctx, id)
+			if err != nil {
+				// Attachments of a task in the trash are kept until the task is purged
+				task, err = ws.Tasks.GetTrashed(ctx, id)
+			}
+			if err != nil {
+				os.RemoveAll(filepath.Join(a.Dir, wsDir.Name(), taskDir.Name()))
+				removed++
+				continue
+			}
+
+			// Remove files whose attachment was never recorded, skipping uploads still in progress
+			files, _ := os.ReadDir(a.taskDir(ws.Name, id))
+			for _, file := range files {
+				known := slices.ContainsFunc(task.Attachments, func(att Attachment) bool { return att.ID == file.Name() })
+				info, err := file.Info()
+				if known || err != nil || time.Since(info.ModTime()) < time.Hour {
+					continue
+				}
+				a.Remove(ctx, ws.Name, id, file.Name())
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// runAttachmentCleanup removes orphaned attachments at startup and then at every tick
+func runAttachmentCleanup(store *AttachmentStore, registry *WorkspaceRegistry, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed := store.CleanOrphans(context.Background(), registry)
+		if removed > 0 {
+			slog.Info("orphaned attachments removed", "count", removed)
+		}
+		<-ticker.C
+	}
+}
+
+// runPurge permanently deletes expired tasks in the trash of every workspace, with their attachments, at every tick
+func runPurge(registry *WorkspaceRegistry, store *AttachmentStore, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		// A follower gets the purges of its leader
+		if replica.Following() {
+			continue
+		}
+		for _, ws := range registry.List() {
+			ctx := context.Background()
+			// The tasks are gone from memory even when storing the purge failed, so their files go too
+			purged, err := ws.Tasks.Purge(ctx, now.Add(-retention))
+			if err != nil {
+				slog.Error("failed to store purge", "workspace", ws.Name, "error", err)
+			}
+			for _, id := range purged {
+				store.RemoveTask(ctx, ws.Name, id)
+			}
+			if len(purged) > 0 {
+				slog.Info("trashed tasks purged", "workspace", ws.Name, "count", len(purged))
+			}
+		}
+	}
+}
+
+// handleTrash lists the deleted tasks of the workspace that can still be restored
+func handleTrash(w http.ResponseWriter, r *http.Request) {
+	writeTasks(w, r, http.StatusOK, workspaceFrom(r.Context()).Tasks.Trash(r.Context()))
+}
+
+// handleRestoreTask takes a task out of the trash
+func handleRestoreTask(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return
+	}
+
+	ws := workspaceFrom(r.Context())
+	task, err := ws.Tasks.Restore(r.Context(), id)
+	if storeError(w, r, err) {
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		httpError(w, r, fmt.Sprintf("Workspace task quota of %d reached.", ws.MaxTasks), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Task not found in the trash.", http.StatusNotFound)
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// taskFromPath looks up the task named by the '{id}' path value, replying with an error if there is none
+func taskFromPath(w http.ResponseWriter, r *http.Request) (Task, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return Task{}, false
+	}
+	task, err := workspaceFrom(r.Context()).Tasks.Get(r.Context(), id)
+	if err != nil {
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return Task{}, false
+	}
+	return task, true
+}
+
+// Error codes of JSON-RPC 2.0, the ones from -32000 to -32099 are left to the server
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcNotFound       = -32001
+	rpcConflict       = -32002
+	rpcForbidden      = -32003
+	rpcReadOnly       = -32004
+)
+
+// maxRPCBatch limits how many calls one batch may contain
+const maxRPCBatch = 100
+
+// rpcRequest is a JSON-RPC 2.0 call, a notification when it has no ID
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcResponse is the answer to a call, with either a result or an error
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// rpcError describes why a call failed
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+// Error returns the message of the error
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// rpcMethod runs a call with its parameters and returns the result
+type rpcMethod struct {
+	perm Permission
+	call func(r *http.Request, params json.RawMessage) (any, error)
+}
+
+// rpcMethods lists the methods served at '/rpc', they share the task store and validation of the REST routes
+var rpcMethods = map[string]rpcMethod{
+	"tasks.list":   {PermReadTasks, rpcListTasks},
+	"tasks.get":    {PermReadTasks, rpcGetTask},
+	"tasks.create": {PermWriteTasks, rpcCreateTask},
+	"tasks.update": {PermWriteTasks, rpcUpdateTask},
+	"tasks.delete": {PermWriteTasks, rpcDeleteTask},
+}
+
+// handleRPC serves JSON-RPC 2.0 calls, single or batched, in the task shape of the request's API version
+func handleRPC(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, &rpcError{Code: rpcParseError, Message: "Request body is too large or unreadable."}))
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, &rpcError{Code: rpcParseError, Message: "Parse error."}))
+		return
+	}
+
+	// A batch is an array of calls, answered with an array holding the responses of the calls that are not notifications
+	if body[0] != '[' {
+		response, ok := runRPC(r, body)
+		if !ok {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, http.StatusOK, response)
+		return
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(body, &batch)
+	if len(batch) == 0 {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, &rpcError{Code: rpcInvalidRequest, Message: "Batch is empty."}))
+		return
+	}
+	if len(batch) > maxRPCBatch {
+		writeJSON(w, http.StatusOK, rpcFailure(nil, &rpcError{Code: rpcInvalidRequest, Message: fmt.Sprintf("Batch has more than %d calls.", maxRPCBatch)}))
+		return
+	}
+	responses := []rpcResponse{}
+	for _, call := range batch {
+		if response, ok := runRPC(r, call); ok {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, responses)
+}
+
+// runRPC runs one call and returns its response, or false for a notification that gets none
+func runRPC(r *http.Request, data json.RawMessage) (rpcResponse, bool) {
+	var req rpcRequest
+	err := json.Unmarshal(data, &req)
+	if err != nil || req.JSONRPC != "2.0" || req.Method == "" || !validRPCID(req.ID) {
+		return rpcFailure(nil, &rpcError{Code: rpcInvalidRequest, Message: "Invalid request."}), true
+	}
+	// A call without an 'id' member is a notification, an explicit null ID still gets an answer
+	notification := req.ID == nil
+
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		return rpcFailure(req.ID, &rpcError{Code: rpcMethodNotFound, Message: "Method not found.", Data: req.Method}), !notification
+	}
+	if len(req.Params) > 0 && req.Params[0] != '{' && string(req.Params) != "null" {
+		return rpcFailure(req.ID, &rpcError{Code: rpcInvalidParams, Message: "Params must be an object."}), !notification
+	}
+
+	user := requestUser(r)
+	if !roles.Can(user, method.perm) {
+		slog.InfoContext(r.Context(), "permission denied", "user", user, "permission", string(method.perm), "rpc_method", req.Method)
+		message := fmt.Sprintf("Permission '%s' is required, your role '%s' does not have it.", method.perm, roles.RoleOf(user))
+		return rpcFailure(req.ID, &rpcError{Code: rpcForbidden, Message: message}), !notification
+	}
+
+	if method.perm == PermWriteTasks && replica.Following() {
+		return rpcFailure(req.ID, &rpcError{Code: rpcReadOnly, Message: "This server is a read-only follower, send writes to the leader.", Data: replica.Leader()}), !notification
+	}
+
+	result, err := method.call(r, req.Params)
+	if err != nil {
+		var rpcErr *rpcError
+		if !errors.As(err, &rpcErr) {
+			slog.ErrorContext(r.Context(), "rpc call failed", "rpc_method", req.Method, "error", err)
+			rpcErr = &rpcError{Code: rpcInternalError, Message: "Internal error."}
+		}
+		return rpcFailure(req.ID, rpcErr), !notification
+	}
+	return rpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID}, !notification
+}
+
+// validRPCID reports whether an ID is absent, null, a string or a number as JSON-RPC requires
+func validRPCID(id json.RawMessage) bool {
+	if id == nil || string(id) == "null" {
+		return true
+	}
+	return id[0] == '"' || id[0] == '-' || (id[0] >= '0' && id[0] <= '9')
+}
+
+// rpcFailure builds an error response, with a null ID when the call's ID could not be read
+func rpcFailure(id json.RawMessage, err *rpcError) rpcResponse {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return rpcResponse{JSONRPC: "2.0", Error: err, ID: id}
+}
+
+// rpcParams decodes the parameters of a call, reporting malformed ones as invalid params
+func rpcParams(params json.RawMessage, v any) error {
+	if len(params) == 0 {
+		params = json.RawMessage("{}")
+	}
+	err := json.Unmarshal(params, v)
+	if err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: "Invalid params: " + err.Error() + "."}
+	}
+	return nil
+}
+
+// rpcTaskID reads the required 'id' parameter of a call
+func rpcTaskID(params json.RawMessage) (int, error) {
+	var p struct {
+		ID *int `json:"id"`
+	}
+	err := rpcParams(params, &p)
+	if err != nil {
+		return 0, err
+	}
+	if p.ID == nil {
+		return 0, &rpcError{Code: rpcInvalidParams, Message: "Invalid params: 'id' is required."}
+	}
+	return *p.ID, nil
+}
+
+// rpcListTasks returns the tasks of the workspace, optionally only those with the given 'status'
+func rpcListTasks(r *http.Request, params json.RawMessage) (any, error) {
+	var p struct {
+		Status string `json:"status"`
+	}
+	err := rpcParams(params, &p)
+	if err != nil {
+		return nil, err
+	}
+	list, err := listTasks(r.Context(), workspaceFrom(r.Context()), TaskFilter{Status: p.Status})
+	if err != nil {
+		return nil, err
+	}
+	return versionFrom(r.Context()).encodeTasks(list), nil
+}
+
+// rpcGetTask returns the task with the given 'id'
+func rpcGetTask(r *http.Request, params json.RawMessage) (any, error) {
+	id, err := rpcTaskID(params)
+	if err != nil {
+		return nil, err
+	}
+	task, err := workspaceFrom(r.Context()).Tasks.Get(r.Context(), id)
+	if err != nil {
+		return nil, &rpcError{Code: rpcNotFound, Message: "Task not found.", Data: id}
+	}
+	return versionFrom(r.Context()).encodeTask(task), nil
+}
+
+// rpcCreateTask adds a task given as the params in the shape of the request's API version
+func rpcCreateTask(r *http.Request, params json.RawMessage) (any, error) {
+	if len(params) == 0 || string(params) == "null" {
+		params = json.RawMessage("{}")
+	}
+	task, err := versionFrom(r.Context()).decodeTask(params)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Invalid params: " + err.Error() + "."}
+	}
+	err = validateTask(task)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Invalid task: " + err.Error() + "."}
+	}
+
+	ws := workspaceFrom(r.Context())
+	created, err := ws.Tasks.Add(r.Context(), task)
+	if errors.Is(err, errQuotaExceeded) {
+		return nil, &rpcError{Code: rpcConflict, Message: fmt.Sprintf("Workspace task quota of %d reached.", ws.MaxTasks)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return versionFrom(r.Context()).encodeTask(created), nil
+}
+
+// rpcUpdateTask changes the fields given next to the 'id' of a task, like PATCH does
+func rpcUpdateTask(r *http.Request, params json.RawMessage) (any, error) {
+	id, err := rpcTaskID(params)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := versionFrom(r.Context()).decodePatch(params)
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Invalid params: " + err.Error() + "."}
+	}
+
+	task, err := workspaceFrom(r.Context()).Tasks.Update(r.Context(), id, patch.apply)
+	if errors.Is(err, errNotStored) {
+		return nil, err
+	}
+	if errors.Is(err, errTaskNotFound) {
+		return nil, &rpcError{Code: rpcNotFound, Message: "Task not found.", Data: id}
+	}
+	if errors.Is(err, errTaskBlocked) {
+		return nil, &rpcError{Code: rpcConflict, Message: "Task is blocked, " + strings.TrimPrefix(err.Error(), errTaskBlocked.Error()+": ") + "."}
+	}
+	if err != nil {
+		return nil, &rpcError{Code: rpcInvalidParams, Message: "Invalid task: " + err.Error() + "."}
+	}
+	return versionFrom(r.Context()).encodeTask(task), nil
+}
+
+// rpcDeleteTask moves the task with the given 'id' to the trash
+func rpcDeleteTask(r *http.Request, params json.RawMessage) (any, error) {
+	id, err := rpcTaskID(params)
+	if err != nil {
+		return nil, err
+	}
+	err = workspaceFrom(r.Context()).Tasks.Delete(r.Context(), id)
+	if errors.Is(err, errNotStored) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &rpcError{Code: rpcNotFound, Message: "Task not found.", Data: id}
+	}
+	return map[string]int{"deleted": id}, nil
+}
+
+// handleListAttachments returns the attachments of a task
+func handleListAttachments(w http.ResponseWriter, r *http.Request) {
+	task, ok := taskFromPath(w, r)
+	if !ok {
+		return
+	}
+	list := task.Attachments
+	if list == nil {
+		list = []Attachment{}
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleUploadAttachments streams the 'file' parts of a multipart upload to disk and attaches them to a task
+func handleUploadAttachments(w http.ResponseWriter, r *http.Request) {
+	task, ok := taskFromPath(w, r)
+	if !ok {
+		return
+	}
+	ws := workspaceFrom(r.Context())
+
+	// Cap the whole request so a client cannot stream unlimited data
+	r.Body = http.MaxBytesReader(w, r.Body, attachments.MaxSize+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		httpError(w, r, "Expected a multipart/form-data upload.", http.StatusBadRequest)
+		return
+	}
+
+	var saved []Attachment
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			removeAttachments(r.Context(), ws.Name, task.ID, saved)
+			httpError(w, r, "Error reading upload.", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" || part.FileName() == "" {
+			part.Close()
+			continue
+		}
+
+		attachment, err := attachments.Save(ws.Name, task.ID, part.FileName(), part)
+		part.Close()
+		if err != nil {
+			removeAttachments(r.Context(), ws.Name, task.ID, saved)
+			var maxErr *http.MaxBytesError
+			switch {
+			case errors.Is(err, errAttachmentTooLarge), errors.As(err, &maxErr):
+				httpError(w, r, fmt.Sprintf("Attachment '%s' exceeds the limit of %d bytes.", part.FileName(), attachments.MaxSize), http.StatusRequestEntityTooLarge)
+			case errors.Is(err, errAttachmentType):
+				httpError(w, r, fmt.Sprintf("Attachment '%s' has type '%s' which is not allowed.", part.FileName(), attachment.ContentType), http.StatusUnsupportedMediaType)
+			default:
+				slog.ErrorContext(r.Context(), "failed to save attachment", "task_id", task.ID, "error", err)
+				httpError(w, r, "Error saving attachment.", http.StatusInternalServerError)
+			}
+			return
+		}
+		saved = append(saved, attachment)
+	}
+
+	if len(saved) == 0 {
+		httpError(w, r, "No file was uploaded in the 'file' field.", http.StatusBadRequest)
+		return
+	}
+
+	// Record the files on the task, removing them again if the task was deleted meanwhile
+	_, err = ws.Tasks.Update(r.Context(), task.ID, func(t *Task) {
+		t.Attachments = append(slices.Clip(t.Attachments), saved...)
+	})
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		removeAttachments(r.Context(), ws.Name, task.ID, saved)
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+// removeAttachments deletes the files of attachments saved during a failed upload
+func removeAttachments(ctx context.Context, workspace string, taskID int, list []Attachment) {
+	for _, attachment := range list {
+		attachments.Remove(ctx, workspace, taskID, attachment.ID)
+	}
+}
+
+// handleDownloadAttachment sends an attachment, supporting 'Range' requests
+func handleDownloadAttachment(w http.ResponseWriter, r *http.Request) {
+	task, ok := taskFromPath(w, r)
+	if !ok {
+		return
+	}
+	i := slices.IndexFunc(task.Attachments, func(att Attachment) bool { return att.ID == r.PathValue("attachment") })
+	if i < 0 {
+		httpError(w, r, "Attachment not found.", http.StatusNotFound)
+		return
+	}
+	attachment := task.Attachments[i]
+
+	file, err := attachments.Open(workspaceFrom(r.Context()).Name, task.ID, attachment.ID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "failed to open attachment", "task_id", task.ID, "attachment", attachment.ID, "error", err)
+		httpError(w, r, "Attachment not found.", http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	// Make browsers download the file instead of rendering it in our origin
+	w.Header().Set("Content-Type", attachment.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, attachment.Name, attachment.CreatedAt, file)
+}
+
+// handleDeleteAttachment removes an attachment from a task and deletes its file
+func handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	task, ok := taskFromPath(w, r)
+	if !ok {
+		return
+	}
+	ws := workspaceFrom(r.Context())
+	attachmentID := r.PathValue("attachment")
+
+	found := false
+	_, err := ws.Tasks.Update(r.Context(), task.ID, func(t *Task) {
+		t.Attachments = slices.DeleteFunc(slices.Clone(t.Attachments), func(att Attachment) bool {
+			if att.ID == attachmentID {
+				found = true
+				return true
+			}
+			return false
+		})
+	})
+	// Files no longer attached to a task are removed by the attachment cleanup
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil || !found {
+		httpError(w, r, "Attachment not found.", http.StatusNotFound)
+		return
+	}
+
+	attachments.Remove(r.Context(), ws.Name, task.ID, attachmentID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// BoardColumn is a column of the board showing the tasks with one status
+type BoardColumn struct {
+	Status string `json:"status"`
+	Title  string `json:"title"`
+}
+
+// boardColumns are the columns of the board from left to right
+var boardColumns = []BoardColumn{
+	{Status: StatusTodo, Title: "To do"},
+	{Status: StatusInProgress, Title: "In progress"},
+	{Status: StatusDone, Title: "Done"},
+}
+
+// boardColumnView is a board column with its tasks in order
+type boardColumnView struct {
+	BoardColumn
+	Tasks []any `json:"tasks"`
+}
+
+// handleBoard returns the tasks grouped into board columns and ordered by rank
+func handleBoard(w http.ResponseWriter, r *http.Request) {
+	list := workspaceFrom(r.Context()).Tasks.List(r.Context())
+	sortByRank(list)
+	version := versionFrom(r.Context())
+
+	board := struct {
+		Columns []boardColumnView `json:"columns"`
+	}{}
+	for _, column := range boardColumns {
+		view := boardColumnView{BoardColumn: column, Tasks: []any{}}
+		for _, task := range list {
+			if task.Status == column.Status {
+				view.Tasks = append(view.Tasks, version.encodeTask(task))
+			}
+		}
+		board.Columns = append(board.Columns, view)
+	}
+	writeJSON(w, http.StatusOK, board)
+}
+
+// moveRequest is the JSON body of a move, naming the target column and a neighbour
+type moveRequest struct {
+	Status   string `json:"status"`
+	AfterID  int    `json:"after_id"`
+	BeforeID int    `json:"before_id"`
+}
+
+// handleMoveTask moves a task to a column and position on the board
+func handleMoveTask(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return
+	}
+
+	var req moveRequest
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+		return
+	}
+
+	task, err := workspaceFrom(r.Context()).Tasks.Move(r.Context(), id, req.Status, req.AfterID, req.BeforeID)
+	switch {
+	case storeError(w, r, err):
+		return
+	case errors.Is(err, errTaskNotFound):
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return
+	case errors.Is(err, errInvalidMove):
+		httpError(w, r, "Invalid move: "+strings.TrimPrefix(err.Error(), errInvalidMove.Error()+": ")+".", http.StatusConflict)
+		return
+	case errors.Is(err, errTaskBlocked):
+		httpError(w, r, "Task is blocked, "+strings.TrimPrefix(err.Error(), errTaskBlocked.Error()+": ")+".", http.StatusConflict)
+		return
+	case err != nil:
+		httpError(w, r, "Invalid task: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// dependencyFromPath reads the task and dependency IDs of a dependency route, replying with an error if they are invalid
+func dependencyFromPath(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	dep, err := strconv.Atoi(r.PathValue("dep"))
+	if err != nil {
+		httpError(w, r, "Invalid dependency ID.", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if id == dep {
+		httpError(w, r, "A task cannot depend on itself.", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	return id, dep, true
+}
+
+// handleAddDependency marks a task as blocked by another task until that one is done
+func handleAddDependency(w http.ResponseWriter, r *http.Request) {
+	id, dep, ok := dependencyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	task, err := workspaceFrom(r.Context()).Tasks.AddDependency(r.Context(), id, dep)
+	switch {
+	case storeError(w, r, err):
+		return
+	case errors.Is(err, errTaskNotFound):
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return
+	case errors.Is(err, errDependencyCycle):
+		httpError(w, r, "Dependency would create a cycle: "+strings.TrimPrefix(err.Error(), errDependencyCycle.Error()+": ")+".", http.StatusConflict)
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// handleRemoveDependency removes a dependency between two tasks
+func handleRemoveDependency(w http.ResponseWriter, r *http.Request) {
+	id, dep, ok := dependencyFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	task, err := workspaceFrom(r.Context()).Tasks.RemoveDependency(r.Context(), id, dep)
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return
+	}
+	writeTask(w, r, http.StatusOK, task)
+}
+
+// handlePlan returns the unfinished tasks in the order they can be worked on
+func handlePlan(w http.ResponseWriter, r *http.Request) {
+	plan, err := workspaceFrom(r.Context()).Tasks.Plan(r.Context())
+	if err != nil {
+		httpError(w, r, "Error planning tasks.", http.StatusInternalServerError)
+		return
+	}
+	writeTasks(w, r, http.StatusOK, plan)
+}
+
+// commentPage is one page of a comment thread
+type commentPage struct {
+	Comments []Comment `json:"comments"`
+	Next     string    `json:"next,omitempty"`
+}
+
+// commentRequest is the JSON body used to write or edit a comment
+type commentRequest struct {
+	Body string `json:"body"`
+}
+
+// readCommentBody decodes and validates the body of a comment, replying with an error if it is invalid
+func readCommentBody(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var req commentRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+		return "", false
+	}
+
+	body := strings.TrimSpace(req.Body)
+	if body == "" {
+		httpError(w, r, "Invalid comment: body is required.", http.StatusBadRequest)
+		return "", false
+	}
+	if len([]rune(body)) > maxCommentLength {
+		httpError(w, r, fmt.Sprintf("Invalid comment: body must be at most %d characters.", maxCommentLength), http.StatusBadRequest)
+		return "", false
+	}
+	return body, true
+}
+
+// commentAuthor returns the name comments of the caller are stored under
+func commentAuthor(r *http.Request) string {
+	if user := requestUser(r); user != "" {
+		return user
+	}
+	return "anonymous"
+}
+
+// handleListComments returns a page of the comments of a task, oldest first
+func handleListComments(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return
+	}
+
+	// Read the page size and the cursor from the query string
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 100 {
+			httpError(w, r, "limit must be between 1 and 100.", http.StatusBadRequest)
+			return
+		}
+	}
+	after := 0
+	if v := r.URL.Query().Get("after"); v != "" {
+		after, err = strconv.Atoi(v)
+		if err != nil || after < 0 {
+			httpError(w, r, "Invalid 'after' cursor.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	comments, more, err := workspaceFrom(r.Context()).Tasks.ListComments(r.Context(), id, after, limit)
+	if err != nil {
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return
+	}
+
+	page := commentPage{Comments: comments}
+	if more {
+		page.Next = strconv.Itoa(comments[len(comments)-1].ID)
+		next := fmt.Sprintf("%s/tasks/%d/comments?limit=%d&after=%s", basePath(r.Context()), id, limit, page.Next)
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"next\"", next))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// handleAddComment adds a comment by the caller to a task
+func handleAddComment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		httpError(w, r, "Invalid task ID.", http.StatusBadRequest)
+		return
+	}
+	body, ok := readCommentBody(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := workspaceFrom(r.Context()).Tasks.AddComment(r.Context(), id, commentAuthor(r), body)
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/tasks/%d/comments/%d", basePath(r.Context()), id, comment.ID))
+	writeJSON(w, http.StatusCreated, comment)
+}
+
+// handleUpdateComment edits a comment written by the caller
+func handleUpdateComment(w http.ResponseWriter, r *http.Request) {
+	id, errID := strconv.Atoi(r.PathValue("id"))
+	commentID, errComment := strconv.Atoi(r.PathValue("comment"))
+	if errID != nil || errComment != nil {
+		httpError(w, r, "Invalid task or comment ID.", http.StatusBadRequest)
+		return
+	}
+	body, ok := readCommentBody(w, r)
+	if !ok {
+		return
+	}
+
+	comment, err := workspaceFrom(r.Context()).Tasks.UpdateComment(r.Context(), id, commentID, commentAuthor(r), body)
+	if !writeCommentError(w, r, err) {
+		return
+	}
+	writeJSON(w, http.StatusOK, comment)
+}
+
+// handleDeleteComment deletes a comment written by the caller
+func handleDeleteComment(w http.ResponseWriter, r *http.Request) {
+	id, errID := strconv.Atoi(r.PathValue("id"))
+	commentID, errComment := strconv.Atoi(r.PathValue("comment"))
+	if errID != nil || errComment != nil {
+		httpError(w, r, "Invalid task or comment ID.", http.StatusBadRequest)
+		return
+	}
+
+	err := workspaceFrom(r.Context()).Tasks.DeleteComment(r.Context(), id, commentID, commentAuthor(r))
+	if !writeCommentError(w, r, err) {
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeCommentError replies with the error of a comment change and reports whether there was none
+func writeCommentError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case storeError(w, r, err):
+	case errors.Is(err, errTaskNotFound):
+		httpError(w, r, "Task not found.", http.StatusNotFound)
+	case errors.Is(err, errCommentNotFound):
+		httpError(w, r, "Comment not found.", http.StatusNotFound)
+	case errors.Is(err, errNotCommentAuthor):
+		httpError(w, r, "Only the author can change a comment.", http.StatusForbidden)
+	default:
+		httpError(w, r, "Error changing comment.", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// changeFeed is one page of the change feed, 'cursor' is passed as 'since' to get the next page
+type changeFeed struct {
+	Changes []any       `json:"changes"`
+	Deleted []Tombstone `json:"deleted"`
+	Cursor  int64       `json:"cursor"`
+	HasMore bool        `json:"has_more"`
+}
+
+// handleChanges returns the tasks written and deleted after the 'since' cursor
+func handleChanges(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	var err error
+	if v := r.URL.Query().Get("since"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			httpError(w, r, "Invalid 'since' cursor.", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 1000 {
+			httpError(w, r, "limit must be between 1 and 1000.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	set, err := workspaceFrom(r.Context()).Tasks.Changes(r.Context(), since, limit)
+	if errors.Is(err, errCursorExpired) {
+		// 410 tells the client to drop its copy and start again from 'GET /tasks'
+		httpError(w, r, "Change cursor expired, fetch all tasks again.", http.StatusGone)
+		return
+	}
+
+	version := versionFrom(r.Context())
+	feed := changeFeed{Changes: []any{}, Deleted: set.Deleted, Cursor: set.Cursor, HasMore: set.More}
+	for _, task := range set.Tasks {
+		feed.Changes = append(feed.Changes, version.encodeTask(task))
+	}
+	writeJSON(w, http.StatusOK, feed)
+}
+
+// maxSyncChanges is the largest batch accepted by the push endpoint
+const maxSyncChanges = 500
+
+// syncChange is one change made by an offline client, 'id' is 0 for a task created offline
+type syncChange struct {
+	ClientID   string          `json:"client_id"`
+	ID         int             `json:"id"`
+	Deleted    bool            `json:"deleted"`
+	Task       json.RawMessage `json:"task"`
+	ModifiedAt time.Time       `json:"modified_at"`
+}
+
+// syncResult reports what happened to one pushed change, with the server copy of the task
+type syncResult struct {
+	ClientID string `json:"client_id,omitempty"`
+	ID       int    `json:"id,omitempty"`
+	Status   string `json:"status"`
+	Reason   string `json:"reason,omitempty"`
+	Task     any    `json:"task,omitempty"`
+}
+
+// Outcomes of a pushed change
+const (
+	syncApplied  = "applied"
+	syncConflict = "conflict"
+	syncRejected = "rejected"
+)
+
+// handleSync applies a batch of changes from an offline client, the newest write of a task wins
+func handleSync(w http.ResponseWriter, r *http.Request) {
+	var push struct {
+		Changes []syncChange `json:"changes"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&push)
+	if err != nil {
+		httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+		return
+	}
+	if len(push.Changes) > maxSyncChanges {
+		httpError(w, r, fmt.Sprintf("At most %d changes can be pushed at once.", maxSyncChanges), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]syncResult, len(push.Changes))
+	for i, change := range push.Changes {
+		results[i] = applySyncChange(r.Context(), change)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Results []syncResult `json:"results"`
+	}{results})
+}
+
+// applySyncChange writes one pushed change to the workspace of the request and reports the outcome
+func applySyncChange(ctx context.Context, change syncChange) syncResult {
+	ws := workspaceFrom(ctx)
+	version := versionFrom(ctx)
+	result := syncResult{ClientID: change.ClientID, ID: change.ID, Status: syncRejected}
+
+	if change.ModifiedAt.IsZero() {
+		result.Reason = "modified_at is required"
+		return result
+	}
+	var task Task
+	if !change.Deleted {
+		var err error
+		task, err = version.decodeTask(change.Task)
+		if err != nil {
+			result.Reason = "invalid task JSON"
+			return result
+		}
+	}
+
+	applied, err := ws.Tasks.Apply(ctx, change.ID, task, change.Deleted, change.ModifiedAt)
+	switch {
+	case err == nil:
+		result.Status, result.ID = syncApplied, applied.ID
+		if !change.Deleted {
+			result.Task = version.encodeTask(applied)
+		}
+	case errors.Is(err, errSyncConflict):
+		result.Status, result.Reason = syncConflict, "the server copy is newer"
+		result.Task = version.encodeTask(applied)
+	case errors.Is(err, errTaskDeleted):
+		result.Status, result.Reason = syncConflict, "the task was deleted on the server"
+	case errors.Is(err, errTaskNotFound):
+		result.Reason = "task not found"
+	case errors.Is(err, errQuotaExceeded):
+		result.Reason = fmt.Sprintf("workspace task quota of %d reached", ws.MaxTasks)
+	case errors.Is(err, errNotStored):
+		result.Reason = "the change could not be stored"
+	default:
+		result.Reason = "invalid task: " + err.Error()
+	}
+	return result
+}
+
+// calendarEntry is a task with due date shown in a calendar feed, with the workspace it belongs to
+type calendarEntry struct {
+	Workspace string
+	Task      Task
+}
+
+// handleCalendar serves the due dates of the workspace as an iCalendar feed
+func handleCalendar(w http.ResponseWriter, r *http.Request) {
+	ws := workspaceFrom(r.Context())
+	var entries []calendarEntry
+	for _, task := range ws.Tasks.List(r.Context()) {
+		entries = append(entries, calendarEntry{ws.Name, task})
+	}
+	writeCalendar(w, r, "Tasks - "+ws.Name, entries)
+}
+
+// handleUserCalendar serves the due dates of every workspace a user belongs to as one iCalendar feed
+//
+// Without authentication calendar apps cannot send 'X-User', so the user in the path is trusted instead.
+func handleUserCalendar(w http.ResponseWriter, r *http.Request) {
+	user := strings.TrimSpace(r.PathValue("user"))
+	if user == "" {
+		httpError(w, r, "User is required.", http.StatusBadRequest)
+		return
+	}
+	if users != nil && user != requestUser(r) && !roles.Can(requestUser(r), PermManageRoles) {
+		httpError(w, r, "You can only subscribe to your own calendar.", http.StatusForbidden)
+		return
+	}
+
+	var entries []calendarEntry
+	for _, ws := range workspaces.List() {
+		if !ws.HasMember(user) {
+			continue
+		}
+		for _, task := range ws.Tasks.List(r.Context()) {
+			entries = append(entries, calendarEntry{ws.Name, task})
+		}
+	}
+	writeCalendar(w, r, "Tasks - "+user, entries)
+}
+
+// writeCalendar writes tasks with a due date as VEVENT or, with '?component=vtodo', VTODO entries
+//
+// Times are written in UTC unless '?tz=' names an IANA time zone, which is then described by a VTIMEZONE.
+func writeCalendar(w http.ResponseWriter, r *http.Request, name string, entries []calendarEntry) {
+	component := strings.ToUpper(r.URL.Query().Get("component"))
+	if component == "" {
+		component = "VEVENT"
+	}
+	if component != "VEVENT" && component != "VTODO" {
+		httpError(w, r, "component must be 'vevent' or 'vtodo'.", http.StatusBadRequest)
+		return
+	}
+	loc := time.UTC
+	if tz := r.URL.Query().Get("tz"); tz != "" {
+		var err error
+		loc, err = time.LoadLocation(tz)
+		if err != nil {
+			httpError(w, r, "Unknown time zone '"+tz+"'.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries = slices.DeleteFunc(entries, func(e calendarEntry) bool { return e.Task.Due == nil })
+	slices.SortFunc(entries, func(a, b calendarEntry) int { return a.Task.Due.Compare(*b.Task.Due) })
+
+	cal := &icsWriter{}
+	cal.prop("BEGIN", "VCALENDAR")
+	cal.prop("VERSION", "2.0")
+	cal.prop("PRODID", "-//Task Manager//Tasks//EN")
+	cal.prop("CALSCALE", "GREGORIAN")
+	cal.prop("METHOD", "PUBLISH")
+	cal.prop("X-WR-CALNAME", icsEscape(name))
+	if loc != time.UTC {
+		cal.prop("X-WR-TIMEZONE", loc.String())
+		if len(entries) > 0 {
+			cal.timezone(loc, *entries[0].Task.Due, *entries[len(entries)-1].Task.Due)
+		}
+	}
+
+	for _, entry := range entries {
+		task := entry.Task
+		due := task.Due.In(loc)
+		cal.prop("BEGIN", component)
+		cal.prop("UID", fmt.Sprintf("task-%d.%s@task-manager", task.ID, url.PathEscape(entry.Workspace)))
+		cal.prop("DTSTAMP", icsUTC(task.UpdatedAt))
+		cal.prop("CREATED", icsUTC(task.CreatedAt))
+		cal.prop("LAST-MODIFIED", icsUTC(task.UpdatedAt))
+		cal.prop("SUMMARY", icsEscape(task.Title))
+		if task.Description != "" {
+			cal.prop("DESCRIPTION", icsEscape(task.Description))
+		}
+		cal.prop("CATEGORIES", icsEscape(entry.Workspace)+","+icsEscape(task.Status))
+
+		// A due time of midnight means a whole day, which calendars show as an all-day entry
+		allDay := due.Hour() == 0 && due.Minute() == 0 && due.Second() == 0
+		if component == "VTODO" {
+			cal.propTime("DUE", due, allDay)
+			cal.prop("STATUS", map[string]string{StatusTodo: "NEEDS-ACTION", StatusInProgress: "IN-PROCESS", StatusDone: "COMPLETED"}[task.Status])
+		} else {
+			cal.propTime("DTSTART", due, allDay)
+			if allDay {
+				cal.propTime("DTEND", due.AddDate(0, 0, 1), true)
+			} else {
+				cal.prop("DURATION", "PT30M")
+			}
+			cal.prop("TRANSP", "TRANSPARENT")
+		}
+		cal.prop("END", component)
+	}
+	cal.prop("END", "VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(cal.buf.Bytes())
+}
+
+// icsWriter builds an iCalendar document with CRLF line endings and folded lines (RFC 5545 section 3.1)
+type icsWriter struct {
+	buf bytes.Buffer
+}
+
+// prop writes one content line, folding it so no line is longer than 75 bytes
+func (c *icsWriter) prop(name, value string) {
+	line := name + ":" + value
+	width := 75
+	for len(line) > width {
+		// Never fold inside a multi-byte UTF-8 character
+		cut := width
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		c.buf.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The leading space of a continuation line counts towards its length
+		width = 74
+	}
+	c.buf.WriteString(line + "\r\n")
+}
+
+// propTime writes a date-time property in the time zone of t, or a date when allDay is set
+func (c *icsWriter) propTime(name string, t time.Time, allDay bool) {
+	switch {
+	case allDay:
+		c.prop(name+";VALUE=DATE", t.Format("20060102"))
+	case t.Location() == time.UTC:
+		c.prop(name, icsUTC(t))
+	default:
+		c.prop(name+";TZID="+t.Location().String(), t.Format("20060102T150405"))
+	}
+}
+
+// timezone writes a VTIMEZONE with every offset change of loc between from and to
+func (c *icsWriter) timezone(loc *time.Location, from, to time.Time) {
+	c.prop("BEGIN", "VTIMEZONE")
+	c.prop("TZID", loc.String())
+
+	// Start a year early so the rules in effect before the first entry are included
+	t := from.In(loc).AddDate(-1, 0, 0)
+	for {
+		name, offset := t.Zone()
+		start, end := t.ZoneBounds()
+		prevOffset := offset
+		if start.IsZero() {
+			// The zone has no earlier transition, so this offset has always applied
+			start = time.Date(1970, time.January, 1, 0, 0, 0, 0, time.UTC)
+		} else {
+			_, prevOffset = start.Add(-time.Second).Zone()
+		}
+
+		kind := "STANDARD"
+		if t.IsDST() {
+			kind = "DAYLIGHT"
+		}
+		c.prop("BEGIN", kind)
+		c.prop("DTSTART", start.In(time.FixedZone("", prevOffset)).Format("20060102T150405"))
+		c.prop("TZOFFSETFROM", icsOffset(prevOffset))
+		c.prop("TZOFFSETTO", icsOffset(offset))
+		c.prop("TZNAME", icsEscape(name))
+		c.prop("END", kind)
+
+		if end.IsZero() || end.After(to) {
+			break
+		}
+		t = end.In(loc)
+	}
+	c.prop("END", "VTIMEZONE")
+}
+
+// icsUTC formats a time as an iCalendar UTC date-time
+func icsUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsOffset formats a UTC offset in seconds as '+hhmm' or '-hhmm'
+func icsOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+// icsEscaper escapes the characters that have a meaning in iCalendar TEXT values
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// icsEscape escapes a TEXT value and drops control characters that are not allowed in content lines
+func icsEscape(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if (r < 0x20 && r != '\n' && r != '\r' && r != '\t') || r == 0x7f {
+			return -1
+		}
+		return r
+	}, s)
+	return icsEscaper.Replace(s)
+}
+
+// uiTask is a task prepared for the HTML page, with its description rendered from Markdown
+type uiTask struct {
+	Task
+	DescriptionHTML template.HTML
+}
+
+// uiPage is the HTML page listing the tasks of a workspace
+var uiPage = template.Must(template.New("ui").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Tasks - {{.Workspace}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+article { border-bottom: 1px solid #ddd; padding: 0.5em 0; }
+.status { font-size: 0.8em; color: #555; }
+pre { background: #f4f4f4; padding: 0.5em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>Tasks - {{.Workspace}}</h1>
+{{if .CSRF}}<form method="post" action="/logout">
+<p>Signed in as {{.User}} <input type="hidden" name="csrf_token" value="{{.CSRF}}"><button type="submit">Sign out</button></p>
+</form>
+{{end}}{{range .Tasks}}<article>
+<h2>{{.Title}} <span class="status">{{.Status}}{{if .Due}}, due {{.Due.Format "2006-01-02 15:04"}}{{end}}</span></h2>
+{{.DescriptionHTML}}
+</article>
+{{else}}<p>No tasks yet.</p>
+{{end}}
+<h2>Add a task</h2>
+<form method="post" action="{{.SubmitURL}}">
+{{if .CSRF}}<input type="hidden" name="csrf_token" value="{{.CSRF}}">
+{{end}}<p><label>Title <input name="title" required></label></p>
+<p><label>Description (Markdown)<br><textarea name="description" rows="6" cols="60"></textarea></label></p>
+<p><button type="submit">Add</button></p>
+</form>
+</body>
+</html>
+`))
+
+// handleUI shows the tasks of the workspace as an HTML page with a form to add more
+func handleUI(w http.ResponseWriter, r *http.Request) {
+	ws := workspaceFrom(r.Context())
+	list := ws.Tasks.List(r.Context())
+	sortByRank(list)
+
+	data := struct {
+		Workspace string
+		Tasks     []uiTask
+		SubmitURL string
+		User      string
+		CSRF      string
+	}{Workspace: ws.Name, SubmitURL: basePath(r.Context()) + "/submit"}
+	if session, ok := sessionFrom(r.Context()); ok {
+		data.User, data.CSRF = session.User, session.CSRF
+	}
+	for _, task := range list {
+		// renderMarkdown escapes everything it does not produce itself, so its output is trusted here
+		data.Tasks = append(data.Tasks, uiTask{task, template.HTML(renderMarkdown(task.Description))})
+	}
+
+	// The policy blocks scripts even if the renderer ever let one through
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := uiPage.Execute(w, data)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "rendering page failed", "error", err)
+	}
+}
+
+// TemplateTask is one task of a template, its title and description may contain 'text/template' placeholders
+type TemplateTask struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Children    []TemplateTask `json:"children,omitempty"`
+}
+
+// TaskTemplate is a named tree of tasks that is created in one go, such as a release checklist
+type TaskTemplate struct {
+	Name string `json:"name"`
+	TemplateTask
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Limits on the size of a template
+const (
+	maxTemplateTasks = 200
+	maxTemplateDepth = 5
+)
+
+// errTemplateNotFound is returned when no template has the requested name
+var errTemplateNotFound = errors.New("template not found")
+
+// TemplateStore keeps the task templates of a workspace, writes go to the replication log like task writes
+type TemplateStore struct {
+	mu        sync.Mutex
+	workspace string
+	templates map[string]TaskTemplate
+}
+
+// NewTemplateStore creates an empty template store for a workspace
+func NewTemplateStore(workspace string) *TemplateStore {
+	return &TemplateStore{workspace: workspace, templates: map[string]TaskTemplate{}}
+}
+
+// Put checks a template and stores it under its name, replacing an older version, it reports whether the template is new
+func (s *TemplateStore) Put(ctx context.Context, tmpl TaskTemplate) (TaskTemplate, bool, error) {
+	if !workspaceNameRE.MatchString(tmpl.Name) {
+		return TaskTemplate{}, false, errors.New("name must be lowercase letters, digits, '-' or '_'")
+	}
+	count := 0
+	err := checkTemplateTask(tmpl.TemplateTask, 1, &count)
+	if err != nil {
+		return TaskTemplate{}, false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.templates[tmpl.Name]
+	tmpl.UpdatedAt = time.Now().UTC()
+	s.templates[tmpl.Name] = tmpl
+	slog.DebugContext(ctx, "template saved", "template", tmpl.Name, "tasks", count)
+	return tmpl, !exists, writeLog.Append(WriteEntry{Workspace: s.workspace, Op: opTemplate, Template: &tmpl})
+}
+
+// Get returns the template with the given name
+func (s *TemplateStore) Get(ctx context.Context, name string) (TaskTemplate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmpl, ok := s.templates[name]
+	if !ok {
+		return TaskTemplate{}, errTemplateNotFound
+	}
+	return tmpl, nil
+}
+
+// List returns all templates sorted by name
+func (s *TemplateStore) List(ctx context.Context) []TaskTemplate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]TaskTemplate, 0, len(s.templates))
+	for _, tmpl := range s.templates {
+		list = append(list, tmpl)
+	}
+	slices.SortFunc(list, func(a, b TaskTemplate) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// Delete removes the template with the given name
+func (s *TemplateStore) Delete(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.templates[name]; !ok {
+		return errTemplateNotFound
+	}
+	delete(s.templates, name)
+	return writeLog.Append(WriteEntry{Workspace: s.workspace, Op: opDropTemplate, Template: &TaskTemplate{Name: name}})
+}
+
+// SetTemplates replaces every template with ones read from the leader or the database
+func (s *TemplateStore) SetTemplates(list []TaskTemplate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.templates = make(map[string]TaskTemplate, len(list))
+	for _, tmpl := range list {
+		s.templates[tmpl.Name] = tmpl
+	}
+}
+
+// Replicate applies a template entry of the leader's write log
+func (s *TemplateStore) Replicate(e WriteEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e.Op == opDropTemplate {
+		delete(s.templates, e.Template.Name)
+	} else {
+		s.templates[e.Template.Name] = *e.Template
+	}
+	return writeLog.Append(e)
+}
+
+// checkTemplateTask parses the placeholders of a template task and its children and enforces the size limits
+func checkTemplateTask(task TemplateTask, depth int, count *int) error {
+	*count++
+	if *count > maxTemplateTasks {
+		return fmt.Errorf("a template can have at most %d tasks", maxTemplateTasks)
+	}
+	if depth > maxTemplateDepth {
+		return fmt.Errorf("tasks can be nested at most %d levels deep", maxTemplateDepth)
+	}
+	if strings.TrimSpace(task.Title) == "" {
+		return errors.New("every task needs a title")
+	}
+	for _, text := range []string{task.Title, task.Description} {
+		_, _, err := parseTaskTemplate(text)
+		if err != nil {
+			return err
+		}
+	}
+	for _, child := range task.Children {
+		err := checkTemplateTask(child, depth+1, count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateFuncs are the functions available in placeholders besides the allowed built-in ones
+var templateFuncs = texttemplate.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"trim":  strings.TrimSpace,
+	"default": func(fallback, value string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// allowedTemplateFuncs lists the functions placeholders may call, 'printf' and friends are left out
+// because a format such as '%0999999999d' would make the server allocate gigabytes
+var allowedTemplateFuncs = []string{"and", "or", "not", "eq", "ne", "lt", "le", "gt", "ge", "len", "index", "upper", "lower", "trim", "default"}
+
+// parseTaskTemplate parses placeholders, only allowing actions and conditions so rendering is fast and small
+//
+// It also returns the variables that are printed directly, like '{{.version}}', which must be supplied.
+// Variables used in or under an 'if', or passed to 'default', are optional and empty when missing.
+func parseTaskTemplate(text string) (*texttemplate.Template, []string, error) {
+	tmpl, err := texttemplate.New("task").Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid placeholder: %s", strings.TrimPrefix(err.Error(), "template: task:"))
+	}
+	if len(tmpl.Templates()) > 1 {
+		return nil, nil, errors.New("invalid placeholder: 'define' and 'block' are not allowed")
+	}
+
+	var required []string
+	conditional := 0
+
+	// Loops could run for a very long time, so only plain actions and 'if' are accepted
+	var check func(node parse.Node) error
+	check = func(node parse.Node) error {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n == nil {
+				return nil
+			}
+			for _, child := range n.Nodes {
+				if err := check(child); err != nil {
+					return err
+				}
+			}
+		case *parse.IfNode:
+			conditional++
+			defer func() { conditional-- }()
+			if err := check(n.Pipe); err != nil {
+				return err
+			}
+			if err := check(n.List); err != nil {
+				return err
+			}
+			return check(n.ElseList)
+		case *parse.ActionNode:
+			if first := n.Pipe.Cmds[0].Args[0]; first.Type() == parse.NodeField && conditional == 0 {
+				required = append(required, strings.Join(first.(*parse.FieldNode).Ident, "."))
+			}
+			return check(n.Pipe)
+		case *parse.PipeNode:
+			for _, cmd := range n.Cmds {
+				for _, arg := range cmd.Args {
+					if err := check(arg); err != nil {
+						return err
+					}
+				}
+			}
+		case *parse.IdentifierNode:
+			if !slices.Contains(allowedTemplateFuncs, n.Ident) {
+				return fmt.Errorf("invalid placeholder: function '%s' is not allowed", n.Ident)
+			}
+		case *parse.TextNode, *parse.FieldNode, *parse.VariableNode, *parse.DotNode, *parse.StringNode,
+			*parse.NumberNode, *parse.BoolNode, *parse.NilNode, *parse.CommentNode:
+		default:
+			return fmt.Errorf("invalid placeholder: '%s' is not allowed", node)
+		}
+		return nil
+	}
+	err = check(tmpl.Tree.Root)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tmpl, required, nil
+}
+
+// instantiateTemplate fills in the placeholders of a template and returns its tasks in order,
+// 'parents' holds the index of the parent of every task or -1 for the root
+func instantiateTemplate(tmpl TaskTemplate, variables map[string]string) (tasks []Task, parents []int, err error) {
+	render := func(text string) (string, error) {
+		t, required, err := parseTaskTemplate(text)
+		if err != nil {
+			return "", err
+		}
+		for _, name := range required {
+			if _, ok := variables[name]; !ok {
+				return "", fmt.Errorf("missing variable '%s'", name)
+			}
+		}
+		var out strings.Builder
+		err = t.Execute(&out, variables)
+		if err != nil {
+			return "", fmt.Errorf("placeholder failed: %s", strings.TrimPrefix(err.Error(), "template: task:"))
+		}
+		return out.String(), nil
+	}
+
+	var walk func(task TemplateTask, parent int) error
+	walk = func(task TemplateTask, parent int) error {
+		title, err := render(task.Title)
+		if err != nil {
+			return err
+		}
+		description, err := render(task.Description)
+		if err != nil {
+			return err
+		}
+		created := Task{Title: strings.TrimSpace(title), Description: description}
+		err = validateTask(created)
+		if err != nil {
+			return fmt.Errorf("task '%s': %w", task.Title, err)
+		}
+
+		tasks = append(tasks, created)
+		parents = append(parents, parent)
+		index := len(tasks) - 1
+		for _, child := range task.Children {
+			err = walk(child, index)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(tmpl.TemplateTask, -1)
+	return tasks, parents, err
+}
+
+// handleListTemplates lists the task templates of the workspace
+func handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, workspaceFrom(r.Context()).Templates.List(r.Context()))
+}
+
+// handleGetTemplate returns one task template
+func handleGetTemplate(w http.ResponseWriter, r *http.Request) {
+	tmpl, err := workspaceFrom(r.Context()).Templates.Get(r.Context(), r.PathValue("name"))
+	if err != nil {
+		httpError(w, r, "Template not found.", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, tmpl)
+}
+
+// handlePutTemplate creates or replaces the task template named in the path
+func handlePutTemplate(w http.ResponseWriter, r *http.Request) {
+	var task TemplateTask
+	err := json.NewDecoder(r.Body).Decode(&task)
+	if err != nil {
+		httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+		return
+	}
+
+	tmpl, created, err := workspaceFrom(r.Context()).Templates.Put(r.Context(), TaskTemplate{Name: r.PathValue("name"), TemplateTask: task})
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Invalid template: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, tmpl)
+}
+
+// handleDeleteTemplate removes a task template, tasks created from it are kept
+func handleDeleteTemplate(w http.ResponseWriter, r *http.Request) {
+	err := workspaceFrom(r.Context()).Templates.Delete(r.Context(), r.PathValue("name"))
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Template not found.", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleInstantiateTemplate creates the task tree of a template with the placeholders filled in from the request
+func handleInstantiateTemplate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Variables map[string]string `json:"variables"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		httpError(w, r, "Invalid JSON format.", http.StatusBadRequest)
+		return
+	}
+	if req.Variables == nil {
+		req.Variables = map[string]string{}
+	}
+
+	ws := workspaceFrom(r.Context())
+	tmpl, err := ws.Templates.Get(r.Context(), r.PathValue("name"))
+	if err != nil {
+		httpError(w, r, "Template not found.", http.StatusNotFound)
+		return
+	}
+	tasks, parents, err := instantiateTemplate(tmpl, req.Variables)
+	if err != nil {
+		httpError(w, r, "Cannot instantiate template: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	created, err := ws.Tasks.AddTree(r.Context(), tasks, parents)
+	if storeError(w, r, err) {
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		httpError(w, r, fmt.Sprintf("Workspace task quota of %d reached.", ws.MaxTasks), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Invalid task: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/tasks/%d", basePath(r.Context()), created[0].ID))
+	writeTasks(w, r, http.StatusCreated, created)
+}
+
+// todoDateRE matches the dates of a todo.txt line
+var todoDateRE = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}$`)
+
+// todoPriorityRE matches the priority of an unfinished todo.txt task, such as '(A)'
+var todoPriorityRE = regexp.MustCompile(`^\([A-Z]\)$`)
+
+// todoRecurrenceRE matches the 'rec:' extension used by todo.txt apps, such as 'rec:3d' or 'rec:+2w'
+var todoRecurrenceRE = regexp.MustCompile(`^\+?([1-9]\d{0,3})([dw])$`)
+
+// todoExtensions lists the 'key:value' extensions that are read into task fields
+var todoExtensions = []string{"due", "rec", "cron", "status", "pri"}
+
+// isTodoExtension reports whether a word has the form of an extension read into a task field
+func isTodoExtension(word string) bool {
+	key, value, ok := strings.Cut(word, ":")
+	return ok && value != "" && slices.Contains(todoExtensions, key)
+}
+
+// needsTodoDash reports whether the first word of a title is written after '- ' so it is not read as
+// a completion mark, priority or date, a title starting with '-' is protected the same way
+func needsTodoDash(word string) bool {
+	return word == "x" || word == "-" || todoPriorityRE.MatchString(word) || todoDateRE.MatchString(word)
+}
+
+// parseTodoTxt reads tasks from a todo.txt file with one task per line, empty lines are skipped
+func parseTodoTxt(r io.Reader) ([]Task, error) {
+	var tasks []Task
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		task, err := parseTodoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, scanner.Err()
+}
+
+// parseTodoLine maps one todo.txt line onto a task
+//
+// Completion marks, priorities and dates come first, '+project' and '@context' tags stay in the title.
+// The extensions 'due:', 'rec:', 'cron:', 'status:' and 'pri:' fill in task fields, other 'key:value'
+// pairs and extensions with a value the field cannot take are kept in the title so nothing is lost.
+// The escapes written by formatTodoLine are removed again.
+func parseTodoLine(line string) (Task, error) {
+	var task Task
+	tokens := strings.Fields(line)
+
+	parseDate := func() (time.Time, bool) {
+		if len(tokens) == 0 || !todoDateRE.MatchString(tokens[0]) {
+			return time.Time{}, false
+		}
+		t, err := time.Parse("2006-01-02", tokens[0])
+		if err != nil {
+			return time.Time{}, false
+		}
+		tokens = tokens[1:]
+		return t, true
+	}
+
+	// 'x 2024-03-02 2024-03-01 text' is a task completed on the first date and created on the second
+	if tokens[0] == "x" {
+		task.Status = StatusDone
+		tokens = tokens[1:]
+		if completed, ok := parseDate(); ok {
+			task.UpdatedAt = completed
+		}
+	} else if todoPriorityRE.MatchString(tokens[0]) {
+		task.Priority = tokens[0][1:2]
+		tokens = tokens[1:]
+	}
+	if created, ok := parseDate(); ok {
+		task.CreatedAt = created
+	}
+	if len(tokens) > 1 && tokens[0] == "-" && needsTodoDash(tokens[1]) {
+		tokens = tokens[1:]
+	}
+
+	var words []string
+	for _, token := range tokens {
+		if strings.HasPrefix(token, `\`) && isTodoExtension(strings.TrimLeft(token, `\`)) {
+			words = append(words, token[1:])
+			continue
+		}
+		key, value, ok := strings.Cut(token, ":")
+		if !ok || value == "" {
+			words = append(words, token)
+			continue
+		}
+		switch key {
+		case "due":
+			due, err := time.Parse("2006-01-02", value)
+			if err != nil || due.Year() < minDueYear || due.Year() > maxDueYear {
+				words = append(words, token)
+				continue
+			}
+			task.Due = &due
+		case "rec":
+			m := todoRecurrenceRE.FindStringSubmatch(value)
+			if m == nil {
+				words = append(words, token)
+				continue
+			}
+			unit := map[string]string{"d": "days", "w": "weeks"}[m[2]]
+			task.Recurrence = "every " + m[1] + " " + unit
+		case "cron":
+			rule := strings.ReplaceAll(value, "_", " ")
+			schedule, err := parseCron(rule)
+			if err != nil || schedule.Next(time.Now()).IsZero() {
+				words = append(words, token)
+				continue
+			}
+			task.Recurrence = rule
+		case "status":
+			if value != StatusTodo && value != StatusInProgress && value != StatusDone {
+				words = append(words, token)
+				continue
+			}
+			task.Status = value
+		case "pri":
+			if len(value) != 1 || value[0] < 'A' || value[0] > 'Z' {
+				words = append(words, token)
+				continue
+			}
+			task.Priority = value
+		default:
+			words = append(words, token)
+		}
+	}
+	task.Title = strings.Join(words, " ")
+
+	err := validateTask(task)
+	if err != nil {
+		return Task{}, err
+	}
+	return task, nil
+}
+
+// writeTodoTxt writes tasks in the todo.txt format, one line per task
+func writeTodoTxt(w io.Writer, tasks []Task) error {
+	bw := bufio.NewWriter(w)
+	for _, task := range tasks {
+		bw.WriteString(formatTodoLine(task) + "\n")
+	}
+	return bw.Flush()
+}
+
+// formatTodoLine writes a task as a todo.txt line, descriptions have no place in the format and are left out
+func formatTodoLine(task Task) string {
+	var parts []string
+	done := task.Status == StatusDone
+	if done {
+		parts = append(parts, "x", task.UpdatedAt.UTC().Format("2006-01-02"))
+	} else if task.Priority != "" {
+		parts = append(parts, "("+task.Priority+")")
+	}
+	parts = append(parts, task.CreatedAt.UTC().Format("2006-01-02"))
+
+	// A title starting like a completion mark, priority or date would be read back as one, and words
+	// like 'due:2024-05-01' as extensions, so they get a '- ' in front or a backslash
+	words := strings.Fields(task.Title)
+	for i, word := range words {
+		if isTodoExtension(strings.TrimLeft(word, `\`)) {
+			words[i] = `\` + word
+		}
+	}
+	if len(words) > 0 && needsTodoDash(words[0]) {
+		parts = append(parts, "-")
+	}
+	parts = append(parts, words...)
+
+	if task.Due != nil {
+		parts = append(parts, "due:"+task.Due.UTC().Format("2006-01-02"))
+	}
+	if task.Recurrence != "" {
+		rule, err := parseRecurrence(task.Recurrence)
+		if interval, ok := rule.(IntervalRule); err == nil && ok {
+			if interval.Days%7 == 0 {
+				parts = append(parts, fmt.Sprintf("rec:%dw", interval.Days/7))
+			} else {
+				parts = append(parts, fmt.Sprintf("rec:%dd", interval.Days))
+			}
+		} else {
+			parts = append(parts, "cron:"+strings.Join(strings.Fields(task.Recurrence), "_"))
+		}
+	}
+	if task.Status == StatusInProgress {
+		parts = append(parts, "status:"+task.Status)
+	}
+	if done && task.Priority != "" {
+		parts = append(parts, "pri:"+task.Priority)
+	}
+	return strings.Join(parts, " ")
+}
+
+// maxImportSize is the largest todo.txt file accepted by the import endpoint
+const maxImportSize = 1 << 20
+
+// handleImportTasks creates tasks from a todo.txt file in the request body, either all of them or none
+func handleImportTasks(w http.ResponseWriter, r *http.Request) {
+	tasks, err := parseTodoTxt(http.MaxBytesReader(w, r.Body, maxImportSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		httpError(w, r, fmt.Sprintf("File too large, the limit is %d bytes.", maxImportSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Invalid todo.txt: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	if len(tasks) == 0 {
+		writeTasks(w, r, http.StatusOK, []Task{})
+		return
+	}
+
+	ws := workspaceFrom(r.Context())
+	parents := make([]int, len(tasks))
+	for i := range parents {
+		parents[i] = -1
+	}
+	created, err := ws.Tasks.AddTree(r.Context(), tasks, parents)
+	if storeError(w, r, err) {
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		httpError(w, r, fmt.Sprintf("Workspace task quota of %d reached.", ws.MaxTasks), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Invalid task: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	writeTasks(w, r, http.StatusCreated, created)
+}
+
+// handleExportTasks writes the tasks of the workspace in the format named by '?format=', only 'todotxt' for now
+func handleExportTasks(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "todotxt" {
+		httpError(w, r, "Unknown export format '"+format+"', use 'todotxt'.", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="todo.txt"`)
+	err := writeTodoTxt(w, workspaceFrom(r.Context()).Tasks.List(r.Context()))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "writing export failed", "error", err)
+	}
+}
+
+// httpError replies with an error message followed by the request ID for support and debugging
+func httpError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	if trace := traceFrom(r.Context()); trace != nil {
+		message += "\nRequest ID: " + trace.RequestID
+	}
+	http.Error(w, message, status)
+}
+
+// storeError replies with 202 Accepted if a change was made in memory but could not be stored, and reports whether it did
+func storeError(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errNotStored) {
+		return false
+	}
+	// The change is already made and logged, so a retry must not make it again: answer with
+	// a status the idempotency layer records, the write is stored again with the next change
+	httpError(w, r, "The change was made but not stored yet, it is stored with the next change.", http.StatusAccepted)
+	return true
+}
+
+// writeJSON writes a value as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// handleForm processes form submissions to add a new task
+func handleForm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		httpError(w, r, "Only POST method is allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Parse form data to retrieve task details
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, "Error parsing form data.", http.StatusBadRequest)
+		return
+	}
+
+	title := r.FormValue("title")
+	description := r.FormValue("description")
+
+	task := Task{Title: title, Description: description}
+	err = validateTask(task)
+	if err != nil {
+		httpError(w, r, "Invalid task: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+
+	// Add the task to the in-memory storage of the selected workspace
+	_, err = workspaceFrom(r.Context()).Tasks.Add(r.Context(), task)
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Workspace task quota reached.", http.StatusConflict)
+		return
+	}
+	// Browsers go back to the task list, other clients get a short confirmation
+	if strings.Contains(r.Header.Get("Accept"), "text/html") {
+		http.Redirect(w, r, basePath(r.Context())+"/ui", http.StatusSeeOther)
+		return
+	}
 	fmt.Fprintln(w, "Form submitted successfully!")
 }
 
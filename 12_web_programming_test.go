@@ -0,0 +1,605 @@
+// Testing in Go:
+// - Tests live in files ending in '_test.go' and are functions named 'TestXxx(t *testing.T)'
+// - Use 'go test 12_web_programming.go 15_task_storage.go 16_replication.go 17_authentication.go 18_markdown.go 12_web_programming_test.go 15_task_storage_test.go 18_markdown_test.go' to run the tests of the server
+// - Table tests list inputs and expected outputs in a slice and run the same checks on every entry
+// - Use 't.Run' to give every entry its own name in the output, and 't.Errorf' to report a failure and continue
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestTodoTxtRoundTrip checks that tasks written as todo.txt are read back with the same fields
+func TestTodoTxtRoundTrip(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	due := day("2024-05-01")
+	created := day("2024-03-01")
+	completed := day("2024-03-02")
+
+	tasks := []Task{
+		{Title: "Plain task", Status: StatusTodo, CreatedAt: created},
+		{Title: "Important", Status: StatusTodo, Priority: "A", CreatedAt: created},
+		{Title: "Finished", Status: StatusDone, Priority: "B", CreatedAt: created, UpdatedAt: completed},
+		{Title: "Started +project @home", Status: StatusInProgress, CreatedAt: created},
+		{Title: "Pay rent", Status: StatusTodo, Due: &due, CreatedAt: created},
+		{Title: "Water plants", Status: StatusTodo, Recurrence: "every 3 days", CreatedAt: created},
+		{Title: "Clean up", Status: StatusTodo, Recurrence: "every 2 weeks", CreatedAt: created},
+		{Title: "Standup", Status: StatusTodo, Recurrence: "0 9 * * 1-5", CreatedAt: created},
+		{Title: "x marks the spot", Status: StatusTodo, CreatedAt: created},
+		{Title: "x marks the spot too", Status: StatusDone, CreatedAt: created, UpdatedAt: completed},
+		{Title: "(A) is not a priority", Status: StatusTodo, Priority: "C", CreatedAt: created},
+		{Title: "2024-01-01 was a Monday", Status: StatusTodo, CreatedAt: created},
+		{Title: "- starts with a dash", Status: StatusTodo, CreatedAt: created},
+		{Title: "-", Status: StatusTodo, CreatedAt: created},
+		{Title: "Move due:2024-05-01 and status:blocked pri:Z rec:1d cron:x", Status: StatusTodo, CreatedAt: created},
+		{Title: `Keep \due:2024-05-01 escaped`, Status: StatusTodo, CreatedAt: created},
+		{Title: "Time 10:30 stays", Status: StatusTodo, CreatedAt: created},
+	}
+
+	var buf bytes.Buffer
+	err := writeTodoTxt(&buf, tasks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseTodoTxt(&buf)
+	if err != nil {
+		t.Fatalf("parseTodoTxt: %v", err)
+	}
+	if len(got) != len(tasks) {
+		t.Fatalf("read %d tasks, want %d", len(got), len(tasks))
+	}
+
+	for i, want := range tasks {
+		g := got[i]
+		// Unfinished tasks have no status of their own, the store makes them 'todo' when they are added
+		g.Status = cmp.Or(g.Status, StatusTodo)
+		if g.Title != want.Title || g.Status != want.Status || g.Priority != want.Priority || g.Recurrence != want.Recurrence {
+			t.Errorf("task %d = %q %s %q %q, want %q %s %q %q", i, g.Title, g.Status, g.Priority, g.Recurrence, want.Title, want.Status, want.Priority, want.Recurrence)
+		}
+		if (g.Due == nil) != (want.Due == nil) || (g.Due != nil && !g.Due.Equal(*want.Due)) {
+			t.Errorf("task %d %q: due = %v, want %v", i, want.Title, g.Due, want.Due)
+		}
+		if !g.CreatedAt.Equal(want.CreatedAt) {
+			t.Errorf("task %d %q: created = %v, want %v", i, want.Title, g.CreatedAt, want.CreatedAt)
+		}
+		if want.Status == StatusDone && !g.UpdatedAt.Equal(want.UpdatedAt) {
+			t.Errorf("task %d %q: completed = %v, want %v", i, want.Title, g.UpdatedAt, want.UpdatedAt)
+		}
+	}
+}
+
+// TestParseInterval checks which 'every N days' rules are accepted and how many days they repeat after
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		rule string
+		days int
+		ok   bool
+	}{
+		{"every day", 1, true},
+		{"every 3 days", 3, true},
+		{"Every 2 Weeks", 14, true},
+		{"every week", 7, true},
+		{"  every   1   day ", 1, true},
+		{"every 0 days", 0, false},
+		{"every -1 days", 0, false},
+		{"every x days", 0, false},
+		{"every 3 months", 0, false},
+		{"every", 0, false},
+		{"each 3 days", 0, false},
+		{"every 3 days please", 0, false},
+	}
+	for _, tt := range tests {
+		rule, err := parseInterval(tt.rule)
+		if (err == nil) != tt.ok || rule.Days != tt.days {
+			t.Errorf("parseInterval(%q) = %d, %v, want %d, ok %v", tt.rule, rule.Days, err, tt.days, tt.ok)
+		}
+	}
+}
+
+// TestParseCron checks the bitsets parsed from cron fields and the expressions that are rejected
+func TestParseCron(t *testing.T) {
+	bits := func(values ...int) uint64 {
+		var b uint64
+		for _, v := range values {
+			b |= 1 << v
+		}
+		return b
+	}
+	tests := []struct {
+		name string
+		expr string
+		want CronSchedule
+		err  bool
+	}{
+		{name: "single values", expr: "30 9 15 6 3", want: CronSchedule{minute: bits(30), hour: bits(9), dom: bits(15), month: bits(6), dow: bits(3)}},
+		{name: "lists and ranges", expr: "0,15 9-11 1-3,20 * *", want: CronSchedule{minute: bits(0, 15), hour: bits(9, 10, 11), dom: bits(1, 2, 3, 20), month: 0x1ffe, dow: 0x7f, dowStar: true}},
+		{name: "steps", expr: "*/20 0-12/6 10/10 * *", want: CronSchedule{minute: bits(0, 20, 40), hour: bits(0, 6, 12), dom: bits(10, 20, 30), month: 0x1ffe, dow: 0x7f, dowStar: true}},
+		{name: "names", expr: "0 0 * JAN-mar sun,Sat", want: CronSchedule{minute: 1, hour: 1, dom: 0xfffffffe, month: bits(1, 2, 3), dow: bits(0, 6), domStar: true}},
+		{name: "sunday as 7", expr: "0 0 * * 5-7", want: CronSchedule{minute: 1, hour: 1, dom: 0xfffffffe, month: 0x1ffe, dow: bits(0, 5, 6), domStar: true}},
+		{name: "macro", expr: "@Weekly", want: CronSchedule{minute: 1, hour: 1, dom: 0xfffffffe, month: 0x1ffe, dow: 1, domStar: true}},
+		{name: "too few fields", expr: "* * * *", err: true},
+		{name: "too many fields", expr: "* * * * * *", err: true},
+		{name: "minute out of range", expr: "60 * * * *", err: true},
+		{name: "day of month zero", expr: "0 0 0 * *", err: true},
+		{name: "reversed range", expr: "5-1 * * * *", err: true},
+		{name: "zero step", expr: "*/0 * * * *", err: true},
+		{name: "unknown name", expr: "0 0 * foo *", err: true},
+		{name: "name in wrong field", expr: "0 0 * mon *", err: true},
+		{name: "unknown macro", expr: "@reboot", err: true},
+		{name: "empty list entry", expr: "1,,2 * * * *", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCron(tt.expr)
+			if tt.err {
+				if err == nil {
+					t.Errorf("parseCron(%q) succeeded, want an error", tt.expr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseCron(%q) = %+v, want %+v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCronNext checks the next occurrence of cron expressions, including the day of month or day of week rule
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name string
+		expr string
+		from string
+		want string
+	}{
+		{"every minute", "* * * * *", "2024-03-01 10:00", "2024-03-01 10:01"},
+		{"strictly after", "0 9 * * *", "2024-03-01 09:00", "2024-03-02 09:00"},
+		{"step", "*/15 * * * *", "2024-03-01 10:07", "2024-03-01 10:15"},
+		{"weekdays over a weekend", "30 9 * * mon-fri", "2024-03-01 10:00", "2024-03-04 09:30"},
+		{"every third month", "0 0 1 */3 *", "2024-02-10 00:00", "2024-04-01 00:00"},
+		{"next year", "0 0 1 1 *", "2024-03-01 00:00", "2025-01-01 00:00"},
+		{"macro", "@weekly", "2024-03-06 12:00", "2024-03-10 00:00"},
+		{"sunday as 7", "0 12 * * 7", "2024-03-06 12:00", "2024-03-10 12:00"},
+		{"day of month or day of week", "0 0 13 * fri", "2024-03-01 10:00", "2024-03-08 00:00"},
+		{"day of month before day of week", "0 0 13 * fri", "2024-03-08 00:00", "2024-03-13 00:00"},
+		{"day of month with any weekday", "0 0 13 * *", "2024-03-01 10:00", "2024-03-13 00:00"},
+		{"day of week with any day of month", "0 0 * * fri", "2024-03-09 00:00", "2024-03-15 00:00"},
+		{"leap day", "0 0 29 2 *", "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"31st skips short months", "0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00"},
+		{"never occurs", "0 0 30 2 *", "2024-03-01 00:00", ""},
+		{"never occurs in april", "0 0 31 4 *", "2024-03-01 00:00", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := c.Next(at(tt.from))
+			var want time.Time
+			if tt.want != "" {
+				want = at(tt.want)
+			}
+			if !got.Equal(want) {
+				t.Errorf("Next(%s) of %q = %v, want %v", tt.from, tt.expr, got, want)
+			}
+		})
+	}
+}
+
+// TestMaterialiseOldDue checks that completing a recurring task long past its due date skips the missed occurrences at once
+func TestMaterialiseOldDue(t *testing.T) {
+	tests := []struct {
+		rule string
+		due  time.Time
+	}{
+		{"* * * * *", time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"every 3 days", time.Date(1970, 1, 1, 9, 30, 0, 0, time.UTC)},
+		{"every day", time.Now().UTC().Add(-25 * time.Hour)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			store := NewTaskStore("test", 0)
+			task, err := store.Add(context.Background(), Task{Title: "Repeat", Due: &tt.due, Recurrence: tt.rule})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			task, err = store.Update(context.Background(), task.ID, func(t *Task) { t.Status = StatusDone })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("completing the task took %v", elapsed)
+			}
+
+			next, err := store.Get(context.Background(), task.NextID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !next.Due.After(start) {
+				t.Errorf("next occurrence is due %v, before now", next.Due)
+			}
+			rule, _ := parseRecurrence(tt.rule)
+			if interval, ok := rule.(IntervalRule); ok {
+				days := int(next.Due.Sub(tt.due).Hours()) / 24
+				if days%interval.Days != 0 || next.Due.Sub(tt.due)%(24*time.Hour) != 0 || days > int(time.Since(tt.due).Hours()/24)+interval.Days {
+					t.Errorf("next occurrence is due %v, not the first one on the schedule of %v", next.Due, tt.due)
+				}
+			} else if next.Due.After(start.Add(2 * time.Minute)) {
+				t.Errorf("next occurrence is due %v, more than a minute from now", next.Due)
+			}
+		})
+	}
+}
+
+// TestValidateDueYear checks that due dates far outside the usual range are rejected
+func TestValidateDueYear(t *testing.T) {
+	for _, due := range []time.Time{time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(10000, 1, 1, 0, 0, 0, 0, time.UTC)} {
+		err := validateTask(Task{Title: "x", Due: &due})
+		if err == nil {
+			t.Errorf("due date %v accepted", due)
+		}
+	}
+	due := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := validateTask(Task{Title: "x", Due: &due}); err != nil {
+		t.Errorf("due date %v rejected: %v", due, err)
+	}
+}
+
+// TestIdempotentReplay checks that a replayed response is compressed again and keeps the headers of the retry
+func TestIdempotentReplay(t *testing.T) {
+	idempotency := NewIdempotencyStore(time.Hour)
+	calls := 0
+	handler := withCompression(withTracing(idempotency.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Location", "/tasks/1")
+		writeJSON(w, http.StatusCreated, Task{ID: 1, Title: "Large", Description: strings.Repeat("x", 2000)})
+	}))), 1024)
+
+	var bodies []string
+	for i := range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/tasks", strings.NewReader(`{"title":"Large"}`))
+		r.Header.Set("Idempotency-Key", "key")
+		r.Header.Set("Accept-Encoding", "gzip")
+		r.Header.Set("X-Request-ID", fmt.Sprint("request-", i))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+		if got := w.Header().Get("X-Request-ID"); got != fmt.Sprint("request-", i) {
+			t.Errorf("request %d: X-Request-ID = %q", i, got)
+		}
+		if got := w.Header().Values("Content-Encoding"); len(got) != 1 || got[0] != "gzip" {
+			t.Fatalf("request %d: Content-Encoding = %q", i, got)
+		}
+		if got := w.Header().Get("Location"); got != "/tasks/1" {
+			t.Errorf("request %d: Location = %q", i, got)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		bodies = append(bodies, string(body))
+	}
+	if calls != 1 {
+		t.Errorf("handler ran %d times, want 1", calls)
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("replayed body differs from the first one")
+	}
+}
+
+// TestIdempotentPanic checks that a handler panic releases the key for a retry
+func TestIdempotentPanic(t *testing.T) {
+	idempotency := NewIdempotencyStore(time.Hour)
+	fail := true
+	handler := idempotency.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	request := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/tasks", strings.NewReader(`{"title":"x"}`))
+		r.Header.Set("Idempotency-Key", "key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("panic was not passed on")
+			}
+		}()
+		request()
+	}()
+
+	fail = false
+	if w := request(); w.Code != http.StatusCreated {
+		t.Errorf("retry after a panic: status %d, want %d", w.Code, http.StatusCreated)
+	}
+}
+
+// TestIdempotentNotStored checks that a retry of a write the database refused does not make it twice
+func TestIdempotentNotStored(t *testing.T) {
+	oldLog := writeLog
+	t.Cleanup(func() { writeLog = oldLog })
+	writeLog = NewWriteLog()
+	writeLog.persist = func([]WriteEntry) error { return io.ErrShortWrite }
+
+	store := NewTaskStore("test", 0)
+	idempotency := NewIdempotencyStore(time.Hour)
+	handler := idempotency.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		created, err := store.Add(r.Context(), Task{Title: "Once", Status: StatusTodo})
+		if storeError(w, r, err) {
+			return
+		}
+		writeJSON(w, http.StatusCreated, created)
+	}))
+
+	for i := range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/tasks", strings.NewReader(`{"title":"Once"}`))
+		r.Header.Set("Idempotency-Key", "key")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Errorf("request %d: status %d, want %d", i, w.Code, http.StatusAccepted)
+		}
+	}
+	if n := len(store.List(context.Background())); n != 1 {
+		t.Errorf("store has %d tasks, want 1", n)
+	}
+}
+
+// TestCORSCredentials checks that credentials are only allowed for origins that were listed
+func TestCORSCredentials(t *testing.T) {
+	tests := []struct {
+		origins     []string
+		origin      string
+		allow       string
+		credentials bool
+	}{
+		{[]string{"*"}, "https://evil.example", "*", false},
+		{[]string{"https://app.example"}, "https://app.example", "https://app.example", true},
+		{[]string{"https://*.example.com"}, "https://a.example.com", "https://a.example.com", true},
+		{[]string{"https://app.example"}, "https://evil.example", "", false},
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, tt := range tests {
+		handler := withCORS(CORSConfig{Origins: tt.origins, AllowCredentials: true}, next)
+		r := httptest.NewRequest(http.MethodGet, "/tasks", nil)
+		r.Header.Set("Origin", tt.origin)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		allow := w.Header().Get("Access-Control-Allow-Origin")
+		credentials := w.Header().Get("Access-Control-Allow-Credentials") == "true"
+		if allow != tt.allow || credentials != tt.credentials {
+			t.Errorf("origins %v, origin %s: allow origin %q, credentials %v, want %q, %v", tt.origins, tt.origin, allow, credentials, tt.allow, tt.credentials)
+		}
+	}
+}
+
+// TestRankBetween checks that ranks sort strictly between their bounds
+func TestRankBetween(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"", "", "V"},
+		{"V", "", "l"},
+		{"", "V", "G"},
+		{"A", "C", "B"},
+		{"A", "B", "AV"},
+		{"z", "", "zV"},
+		{"", "1", "0V"},
+		{"", "0V", "0G"},
+		{"a0", "a1", "a0V"},
+		{"AV", "B", "Al"},
+		{"A", "AV", "AG"},
+		{"B", "A", "b"},
+	}
+	for _, tt := range tests {
+		got := rankBetween(tt.a, tt.b)
+		if got != tt.want {
+			t.Errorf("rankBetween(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+		if got <= tt.a || (tt.b > tt.a && got >= tt.b) {
+			t.Errorf("rankBetween(%q, %q) = %q is not between them", tt.a, tt.b, got)
+		}
+	}
+
+	// Inserting again and again at the same place keeps the order
+	low, high := "", ""
+	for i := range 200 {
+		rank := rankBetween(low, high)
+		if rank <= low || (high != "" && rank >= high) {
+			t.Fatalf("insert %d: rankBetween(%q, %q) = %q", i, low, high, rank)
+		}
+		if i%2 == 0 {
+			low = rank
+		} else {
+			high = rank
+		}
+	}
+}
+
+// boardOrder returns the titles of a column in board order
+func boardOrder(store *TaskStore, status string) string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var titles []string
+	for _, task := range store.column(status, 0) {
+		titles = append(titles, task.Title)
+	}
+	return strings.Join(titles, " ")
+}
+
+// TestMove checks moves within and between board columns
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	store := NewTaskStore("test", 0)
+	ids := map[string]int{}
+	for _, title := range []string{"a", "b", "c", "d"} {
+		task, err := store.Add(ctx, Task{Title: title})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[title] = task.ID
+	}
+
+	tests := []struct {
+		name           string
+		task, status   string
+		after, before  string
+		todo, progress string
+		err            bool
+	}{
+		{name: "to the top", task: "d", before: "a", todo: "d a b c"},
+		{name: "after a task", task: "d", after: "b", todo: "a b d c"},
+		{name: "to the bottom", task: "a", todo: "b d c a"},
+		{name: "to another column", task: "d", status: StatusInProgress, todo: "b c a", progress: "d"},
+		{name: "before a task in another column", task: "c", status: StatusInProgress, before: "d", todo: "b a", progress: "c d"},
+		{name: "between two tasks", task: "a", status: StatusInProgress, after: "c", todo: "b", progress: "c a d"},
+		{name: "neighbour in another column", task: "b", after: "c", err: true, todo: "b", progress: "c a d"},
+		{name: "both neighbours", task: "b", status: StatusInProgress, after: "c", before: "a", err: true, todo: "b", progress: "c a d"},
+		{name: "unknown status", task: "b", status: "blocked", err: true, todo: "b", progress: "c a d"},
+	}
+	for _, tt := range tests {
+		_, err := store.Move(ctx, ids[tt.task], tt.status, ids[tt.after], ids[tt.before])
+		if (err != nil) != tt.err {
+			t.Errorf("%s: Move error = %v, want error %v", tt.name, err, tt.err)
+		}
+		if got := boardOrder(store, StatusTodo); got != tt.todo {
+			t.Errorf("%s: todo column = %q, want %q", tt.name, got, tt.todo)
+		}
+		if got := boardOrder(store, StatusInProgress); got != tt.progress {
+			t.Errorf("%s: in progress column = %q, want %q", tt.name, got, tt.progress)
+		}
+	}
+
+	// Moving back and forth between the same two tasks keeps them apart
+	for i := range 100 {
+		task, after := "a", "c"
+		if i%2 == 1 {
+			task, after = "c", "a"
+		}
+		_, err := store.Move(ctx, ids[task], "", ids[after], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := boardOrder(store, StatusInProgress); got != "a c d" {
+		t.Errorf("after moving back and forth: in progress column = %q, want %q", got, "a c d")
+	}
+}
+
+// TestRestoreRank checks that a restored task does not share its rank with a task added while it was in the trash
+func TestRestoreRank(t *testing.T) {
+	ctx := context.Background()
+	store := NewTaskStore("test", 0)
+	a, err := store.Add(ctx, Task{Title: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete(ctx, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The column is empty, so the new task gets the rank the deleted one had
+	b, err := store.Add(ctx, Task{Title: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = store.Restore(ctx, a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Rank == b.Rank {
+		t.Fatalf("restored task has rank %q like the task added in the meantime", a.Rank)
+	}
+
+	c, err := store.Add(ctx, Task{Title: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Move(ctx, c.ID, "", b.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := boardOrder(store, StatusTodo); got != "b c a" {
+		t.Errorf("todo column = %q, want %q", got, "b c a")
+	}
+}
+
+// TestParseTodoLine checks that extensions with values a task cannot take stay in the title instead of failing the import
+func TestParseTodoLine(t *testing.T) {
+	tests := []struct {
+		line       string
+		title      string
+		recurrence string
+		status     string
+		priority   string
+	}{
+		{"Water plants rec:3d", "Water plants", "every 3 days", "", ""},
+		{"Water plants rec:+2w", "Water plants", "every 2 weeks", "", ""},
+		{"Never rec:0d", "Never rec:0d", "", "", ""},
+		{"Never rec:+000w", "Never rec:+000w", "", "", ""},
+		{"Too often rec:12345d", "Too often rec:12345d", "", "", ""},
+		{"Standup cron:0_9_*_*_1-5", "Standup", "0 9 * * 1-5", "", ""},
+		{"Broken cron:0_9", "Broken cron:0_9", "", "", ""},
+		{"Impossible cron:0_0_30_2_*", "Impossible cron:0_0_30_2_*", "", "", ""},
+		{"Started status:in_progress", "Started", "", StatusInProgress, ""},
+		{"Waiting status:blocked", "Waiting status:blocked", "", "", ""},
+		{"Ranked pri:B", "Ranked", "", "", "B"},
+		{"Ranked pri:high", "Ranked pri:high", "", "", ""},
+		{"Ancient due:0001-01-01", "Ancient due:0001-01-01", "", "", ""},
+	}
+	for _, tt := range tests {
+		task, err := parseTodoLine(tt.line)
+		if err != nil {
+			t.Errorf("parseTodoLine(%q): %v", tt.line, err)
+			continue
+		}
+		if task.Title != tt.title || task.Recurrence != tt.recurrence || task.Status != tt.status || task.Priority != tt.priority {
+			t.Errorf("parseTodoLine(%q) = %q %q %q %q, want %q %q %q %q", tt.line, task.Title, task.Recurrence, task.Status, task.Priority, tt.title, tt.recurrence, tt.status, tt.priority)
+		}
+	}
+}
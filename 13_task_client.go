@@ -0,0 +1,778 @@
+// Command-line tools in Go:
+// - Read subcommands from 'os.Args' and give each one its own 'flag.NewFlagSet'
+// - Use 'os.Exit(code)' to report success ('0') or a specific failure to scripts and shells
+// - Print tables with 'text/tabwriter' to line up columns of text
+// - Use 'os.UserConfigDir()' to find the standard place for a tool's configuration file
+
+// HTTP clients in Go:
+// - Create an 'http.Client' with a 'Timeout' so a slow server cannot hang the tool
+// - Use 'http.NewRequestWithContext' to add headers such as 'Authorization' and cancel requests
+// - Check 'resp.StatusCode' because 'client.Do' only returns an error when the request itself fails
+
+// Signals in Go:
+// - Use 'signal.NotifyContext' to get a context that is cancelled when the user presses Ctrl+C
+
+// Building the client:
+// - Use 'go build -o tasks 13_task_client.go' to build the 'tasks' command
+// - Run './tasks help' to see the available subcommands
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes reported by the 'tasks' command
+const (
+	exitOK           = 0
+	exitFailure      = 1
+	exitUsage        = 2
+	exitNotFound     = 3
+	exitRejected     = 4
+	exitUnauthorized = 5
+	exitUnavailable  = 6
+)
+
+// apiPrefix selects the version of the Task Manager API the client speaks
+const apiPrefix = "/v2"
+
+// Task mirrors the version 2 task returned by the Task Manager API
+type Task struct {
+	ID          int       `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	Status      string    `json:"status"`
+	Priority    string    `json:"priority,omitempty"`
+	Schedule    *Schedule `json:"schedule,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Schedule holds the due date and recurrence rule of a task
+type Schedule struct {
+	DueAt      *time.Time `json:"due_at,omitempty"`
+	Recurrence string     `json:"recurrence,omitempty"`
+}
+
+// TaskList is the envelope around task lists
+type TaskList struct {
+	Tasks []Task `json:"tasks"`
+	Count int    `json:"count"`
+}
+
+// Config holds the server URL, token and workspace read from the config file
+type Config struct {
+	Server    string `json:"server"`
+	Token     string `json:"token"`
+	Workspace string `json:"workspace"`
+}
+
+// cliError is an error that carries the exit code the command should end with
+type cliError struct {
+	code int
+	err  error
+}
+
+// Error returns the message of the wrapped error
+func (e *cliError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the wrapped error
+func (e *cliError) Unwrap() error {
+	return e.err
+}
+
+// usageError reports a problem with the command-line arguments
+func usageError(format string, args ...any) error {
+	return &cliError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// errUsageShown marks flag errors the flag package has already printed with the usage
+var errUsageShown = errors.New("invalid flags")
+
+// APIError describes an unsuccessful response from the server
+type APIError struct {
+	Status  int
+	Message string
+}
+
+// Error returns the status code and the message sent by the server
+func (e *APIError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.Status, e.Message)
+}
+
+// Client talks to the Task Manager API
+type Client struct {
+	baseURL   string
+	token     string
+	workspace string
+	http      *http.Client
+}
+
+// do sends a request with an optional JSON body and decodes the JSON response into 'out'
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	contentType := ""
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	resp, err := c.send(ctx, method, path, "application/json", contentType, reader)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// send sends a request with a body of any type and returns the successful response, which the caller must close
+func (c *Client) send(ctx context.Context, method, path, accept, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+apiPrefix+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", accept)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.workspace != "" {
+		req.Header.Set("X-Workspace", c.workspace)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, &cliError{code: exitUnavailable, err: fmt.Errorf("failed to reach server: %w", err)}
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &APIError{Status: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	return resp, nil
+}
+
+// exitCode maps an error to the exit code the command should end with
+func exitCode(err error) int {
+	var cliErr *cliError
+	if errors.As(err, &cliErr) {
+		return cliErr.code
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch {
+		case apiErr.Status == http.StatusNotFound:
+			return exitNotFound
+		case apiErr.Status == http.StatusUnauthorized || apiErr.Status == http.StatusForbidden:
+			return exitUnauthorized
+		case apiErr.Status >= 500:
+			return exitUnavailable
+		case apiErr.Status >= 400:
+			return exitRejected
+		}
+	}
+	return exitFailure
+}
+
+// defaultConfigPath returns the config file location, which 'TASKS_CONFIG' can override
+func defaultConfigPath() string {
+	if path := os.Getenv("TASKS_CONFIG"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "tasks.json"
+	}
+	return filepath.Join(dir, "tasks", "config.json")
+}
+
+// loadConfig reads the config file, a missing file falls back to the local server
+func loadConfig(path string) (Config, error) {
+	config := Config{Server: "http://localhost:4001"}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return config, fmt.Errorf("failed to read config file '%s': %w", path, err)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &config)
+		if err != nil {
+			return config, fmt.Errorf("failed to parse config file '%s': %w", path, err)
+		}
+	}
+
+	// Environment variables take precedence over the config file
+	if server := os.Getenv("TASKS_SERVER"); server != "" {
+		config.Server = server
+	}
+	if token := os.Getenv("TASKS_TOKEN"); token != "" {
+		config.Token = token
+	}
+	if workspace := os.Getenv("TASKS_WORKSPACE"); workspace != "" {
+		config.Workspace = workspace
+	}
+	config.Server = strings.TrimRight(config.Server, "/")
+	return config, nil
+}
+
+// options holds the flags shared by every subcommand
+type options struct {
+	configPath string
+	server     string
+	workspace  string
+	output     string
+}
+
+// newFlagSet creates the flag set of a subcommand with the shared flags registered
+func newFlagSet(name, usage string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&opts.configPath, "config", defaultConfigPath(), "path to the config file")
+	fs.StringVar(&opts.server, "server", "", "server URL (overrides the config file)")
+	fs.StringVar(&opts.workspace, "w", "", "workspace (overrides the config file)")
+	fs.StringVar(&opts.output, "o", "table", "output format: table or json")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: tasks %s\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parse parses the subcommand arguments and checks the shared flags
+func (o *options) parse(fs *flag.FlagSet, args []string) error {
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	if err != nil {
+		return &cliError{code: exitUsage, err: errUsageShown}
+	}
+	if o.output != "table" && o.output != "json" {
+		return usageError("unknown output format '%s'", o.output)
+	}
+	return nil
+}
+
+// client creates an API client from the config file and flags
+func (o *options) client() (*Client, error) {
+	config, err := loadConfig(o.configPath)
+	if err != nil {
+		return nil, err
+	}
+	if o.server != "" {
+		config.Server = strings.TrimRight(o.server, "/")
+	}
+	if o.workspace != "" {
+		config.Workspace = o.workspace
+	}
+	return &Client{baseURL: config.Server, token: config.Token, workspace: config.Workspace, http: &http.Client{Timeout: 15 * time.Second}}, nil
+}
+
+// command is a subcommand of the 'tasks' tool
+type command struct {
+	usage string
+	run   func(ctx context.Context, usage string, args []string) error
+}
+
+// commandNames lists the subcommands in the order they are documented
+var commandNames = []string{"add", "list", "show", "edit", "done", "rm", "watch", "import", "export"}
+
+// commands maps subcommand names to their implementation
+var commands = map[string]command{
+	"add":    {"add [-d description] [-s status] [-due date] [-repeat rule] <title>", runAdd},
+	"list":   {"list [-s status]", runList},
+	"show":   {"show <id>", runShow},
+	"edit":   {"edit [-t title] [-d description] [-s status] [-due date] [-repeat rule] <id>", runEdit},
+	"done":   {"done <id>", runDone},
+	"rm":     {"rm <id>", runRemove},
+	"watch":  {"watch [-s status] [-interval 2s]", runWatch},
+	"import": {"import <todo.txt file or ->", runImport},
+	"export": {"export [-f file]", runExport},
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run executes a subcommand and returns the exit code
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return exitUsage
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		return exitOK
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "tasks: unknown command '%s'\n", args[0])
+		printUsage()
+		return exitUsage
+	}
+
+	// Cancel requests in flight when the user presses Ctrl+C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := cmd.run(ctx, cmd.usage, args[1:])
+	if err == nil {
+		return exitOK
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+
+	// The flag package has already printed the problem and the usage
+	if !errors.Is(err, errUsageShown) {
+		fmt.Fprintln(os.Stderr, "tasks:", err)
+	}
+	return exitCode(err)
+}
+
+// printUsage prints the list of subcommands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: tasks <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	for _, name := range commandNames {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Flags for every command: -config <path>, -server <url>, -w <workspace>, -o table|json")
+}
+
+// parseID reads a task ID from the only positional argument
+func parseID(args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, usageError("expected exactly one task ID")
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil || id <= 0 {
+		return 0, usageError("invalid task ID '%s'", args[0])
+	}
+	return id, nil
+}
+
+// runAdd creates a task from the title and flags
+func runAdd(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("add", usage, &opts)
+	description := fs.String("d", "", "task description")
+	status := fs.String("s", "", "initial status")
+	dueText := fs.String("due", "", "due date (YYYY-MM-DD or RFC 3339)")
+	repeat := fs.String("repeat", "", "recurrence rule ('every N days' or a cron expression)")
+	err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return usageError("a title is required")
+	}
+	due, err := parseDue(*dueText)
+	if err != nil {
+		return err
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	task := Task{Title: strings.Join(fs.Args(), " "), Description: *description, Status: *status}
+	if due != nil || *repeat != "" {
+		task.Schedule = &Schedule{DueAt: due, Recurrence: *repeat}
+	}
+	var created Task
+	err = c.do(ctx, http.MethodPost, "/tasks", task, &created)
+	if err != nil {
+		return err
+	}
+	return printTask(opts.output, created)
+}
+
+// runList prints all tasks, optionally filtered by status
+func runList(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("list", usage, &opts)
+	status := fs.String("s", "", "only list tasks with this status")
+	err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return usageError("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	list, err := fetchTasks(ctx, c, *status)
+	if err != nil {
+		return err
+	}
+	return printTasks(opts.output, list)
+}
+
+// runShow prints a single task
+func runShow(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("show", usage, &opts)
+	id, c, err := parseTaskCommand(fs, &opts, args)
+	if err != nil {
+		return err
+	}
+
+	var task Task
+	err = c.do(ctx, http.MethodGet, fmt.Sprintf("/tasks/%d", id), nil, &task)
+	if err != nil {
+		return err
+	}
+	return printTask(opts.output, task)
+}
+
+// runEdit changes the fields of a task given as flags
+func runEdit(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("edit", usage, &opts)
+	title := fs.String("t", "", "new title")
+	description := fs.String("d", "", "new description")
+	status := fs.String("s", "", "new status")
+	dueText := fs.String("due", "", "new due date (YYYY-MM-DD or RFC 3339), empty to remove it")
+	repeat := fs.String("repeat", "", "new recurrence rule")
+	id, c, err := parseTaskCommand(fs, &opts, args)
+	if err != nil {
+		return err
+	}
+	due, err := parseDue(*dueText)
+	if err != nil {
+		return err
+	}
+
+	// Only send the fields that were given on the command line
+	patch := map[string]any{}
+	schedule := map[string]any{}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "t":
+			patch["title"] = *title
+		case "d":
+			patch["description"] = *description
+		case "s":
+			patch["status"] = *status
+		case "due":
+			schedule["due_at"] = due
+		case "repeat":
+			schedule["recurrence"] = *repeat
+		}
+	})
+	if len(schedule) > 0 {
+		patch["schedule"] = schedule
+	}
+	if len(patch) == 0 {
+		return usageError("nothing to change, use -t, -d, -s, -due or -repeat")
+	}
+	return patchTask(ctx, c, opts.output, id, patch)
+}
+
+// runDone marks a task as done
+func runDone(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("done", usage, &opts)
+	id, c, err := parseTaskCommand(fs, &opts, args)
+	if err != nil {
+		return err
+	}
+	return patchTask(ctx, c, opts.output, id, map[string]any{"status": "done"})
+}
+
+// runRemove deletes a task
+func runRemove(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("rm", usage, &opts)
+	id, c, err := parseTaskCommand(fs, &opts, args)
+	if err != nil {
+		return err
+	}
+
+	err = c.do(ctx, http.MethodDelete, fmt.Sprintf("/tasks/%d", id), nil, nil)
+	if err != nil {
+		return err
+	}
+	if opts.output == "json" {
+		return printJSON(map[string]int{"deleted": id})
+	}
+	fmt.Printf("Task %d deleted.\n", id)
+	return nil
+}
+
+// runWatch redraws the task list whenever it changes until interrupted
+func runWatch(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("watch", usage, &opts)
+	status := fs.String("s", "", "only watch tasks with this status")
+	interval := fs.Duration("interval", 2*time.Second, "how often to poll the server")
+	err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return usageError("-interval must be positive")
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var last []byte
+	for {
+		list, err := fetchTasks(ctx, c, *status)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Only redraw when the list has changed since the last poll
+		current, _ := json.Marshal(list)
+		if !bytes.Equal(current, last) {
+			last = current
+			if opts.output == "table" {
+				fmt.Print("\033[H\033[2J")
+				fmt.Printf("Every %s: %s (Ctrl+C to stop)\n\n", *interval, c.baseURL)
+			}
+			err = printTasks(opts.output, list)
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// runImport creates tasks from a todo.txt file, or from standard input when the file is '-'
+func runImport(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("import", usage, &opts)
+	err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return usageError("expected exactly one file")
+	}
+
+	in := os.Stdin
+	if name := fs.Arg(0); name != "-" {
+		in, err = os.Open(name)
+		if err != nil {
+			return fmt.Errorf("failed to open '%s': %w", name, err)
+		}
+		defer in.Close()
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(ctx, http.MethodPost, "/tasks/import", "application/json", "text/plain; charset=utf-8", in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var list TaskList
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	return printTasks(opts.output, list.Tasks)
+}
+
+// runExport writes all tasks in the todo.txt format to standard output or a file
+func runExport(ctx context.Context, usage string, args []string) error {
+	var opts options
+	fs := newFlagSet("export", usage, &opts)
+	file := fs.String("f", "", "file to write instead of standard output")
+	err := opts.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		return usageError("export takes no arguments")
+	}
+
+	c, err := opts.client()
+	if err != nil {
+		return err
+	}
+	resp, err := c.send(ctx, http.MethodGet, "/tasks/export?format=todotxt", "text/plain", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out := os.Stdout
+	if *file != "" {
+		out, err = os.Create(*file)
+		if err != nil {
+			return fmt.Errorf("failed to create '%s': %w", *file, err)
+		}
+		defer out.Close()
+	}
+	_, err = io.Copy(out, resp.Body)
+	if err == nil && out != os.Stdout {
+		// Closing flushes the file, so its error means the export is incomplete
+		err = out.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write export: %w", err)
+	}
+	return nil
+}
+
+// parseTaskCommand parses the flags of a subcommand that takes a task ID and creates the client
+func parseTaskCommand(fs *flag.FlagSet, opts *options, args []string) (int, *Client, error) {
+	err := opts.parse(fs, args)
+	if err != nil {
+		return 0, nil, err
+	}
+	id, err := parseID(fs.Args())
+	if err != nil {
+		return 0, nil, err
+	}
+	c, err := opts.client()
+	return id, c, err
+}
+
+// parseDue parses a due date given as a day in local time or an RFC 3339 timestamp
+func parseDue(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil, usageError("invalid due date '%s', use YYYY-MM-DD or RFC 3339", s)
+	}
+	return &t, nil
+}
+
+// fetchTasks requests the task list with an optional status filter
+func fetchTasks(ctx context.Context, c *Client, status string) ([]Task, error) {
+	path := "/tasks"
+	if status != "" {
+		path += "?status=" + url.QueryEscape(status)
+	}
+
+	var list TaskList
+	err := c.do(ctx, http.MethodGet, path, nil, &list)
+	return list.Tasks, err
+}
+
+// patchTask sends a partial update for a task and prints the result
+func patchTask(ctx context.Context, c *Client, output string, id int, patch map[string]any) error {
+	var task Task
+	err := c.do(ctx, http.MethodPatch, fmt.Sprintf("/tasks/%d", id), patch, &task)
+	if err != nil {
+		return err
+	}
+	return printTask(output, task)
+}
+
+// printTasks prints tasks as a table or JSON array
+func printTasks(output string, list []Task) error {
+	if output == "json" {
+		return printJSON(list)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tTITLE\tDUE\tUPDATED")
+	for _, task := range list {
+		due := "-"
+		if task.Schedule != nil && task.Schedule.DueAt != nil {
+			due = task.Schedule.DueAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", task.ID, task.Status, task.Title, due, task.UpdatedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return tw.Flush()
+}
+
+// printTask prints a single task as a list of fields or a JSON object
+func printTask(output string, task Task) error {
+	if output == "json" {
+		return printJSON(task)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%d\n", task.ID)
+	fmt.Fprintf(tw, "Title:\t%s\n", task.Title)
+	fmt.Fprintf(tw, "Status:\t%s\n", task.Status)
+	if task.Priority != "" {
+		fmt.Fprintf(tw, "Priority:\t%s\n", task.Priority)
+	}
+	fmt.Fprintf(tw, "Description:\t%s\n", task.Description)
+	if task.Schedule != nil && task.Schedule.DueAt != nil {
+		fmt.Fprintf(tw, "Due:\t%s\n", task.Schedule.DueAt.Local().Format(time.RFC1123))
+	}
+	if task.Schedule != nil && task.Schedule.Recurrence != "" {
+		fmt.Fprintf(tw, "Repeats:\t%s\n", task.Schedule.Recurrence)
+	}
+	fmt.Fprintf(tw, "Created:\t%s\n", task.CreatedAt.Local().Format(time.RFC1123))
+	fmt.Fprintf(tw, "Updated:\t%s\n", task.UpdatedAt.Local().Format(time.RFC1123))
+	return tw.Flush()
+}
+
+// printJSON prints a value as indented JSON
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
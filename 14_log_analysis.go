@@ -0,0 +1,469 @@
+// Reading logs line by line in Go:
+// - Use 'bufio.Reader.ReadString('\n')' to read one line at a time without loading the whole file
+// - Decode JSON log lines with 'json.Unmarshal' into a struct holding only the fields you need
+// - Skip lines that do not parse instead of stopping, logs often mix formats
+
+// Percentiles in Go:
+// - Sort the measured values with 'slices.Sort' and pick the value at the wanted rank
+// - The p99 latency is the time 99% of requests finished within, it shows slow outliers the average hides
+
+// Following a file in Go:
+// - After reaching 'io.EOF', wait and read again to pick up lines appended later, like 'tail -f'
+// - Compare 'os.Stat' of the path with the open file using 'os.SameFile' to notice log rotation
+// - A file that became smaller than the read offset was truncated, start again from the beginning
+
+// Building the tool:
+// - Use 'go build -o logstats 14_log_analysis.go' to build the 'logstats' command
+// - Use 'go test 14_log_analysis.go 14_log_analysis_test.go' to run its tests
+// - Run './logstats -h' to see the flags
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes reported by the 'logstats' command
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// accessLine holds the fields of a JSON access log line written by the task server
+type accessLine struct {
+	Time       time.Time `json:"time"`
+	Msg        string    `json:"msg"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Route      string    `json:"route"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// parseAccessLine reads an access log line, returning false for other log lines and text that is not JSON
+func parseAccessLine(line string) (accessLine, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "{") {
+		return accessLine{}, false
+	}
+	var entry accessLine
+	err := json.Unmarshal([]byte(line), &entry)
+	if err != nil || entry.Msg != "request" || entry.Status == 0 {
+		return accessLine{}, false
+	}
+	return entry, true
+}
+
+// routeKey names the route of a request, adding the method when the pattern accepts several
+func (e accessLine) routeKey() string {
+	route := e.Route
+	if route == "" {
+		route = "unmatched"
+	}
+	// Patterns such as 'GET /board' already name their method
+	if first, _, ok := strings.Cut(route, " "); ok && first == strings.ToUpper(first) {
+		return route
+	}
+	return e.Method + " " + route
+}
+
+// Window selects the requests to report on, a zero bound is open
+type Window struct {
+	From time.Time
+	To   time.Time
+	Last time.Duration
+}
+
+// contains reports whether a request at time t falls inside the window as seen at now
+func (w Window) contains(t, now time.Time) bool {
+	if !w.From.IsZero() && t.Before(w.From) {
+		return false
+	}
+	if !w.To.IsZero() && !t.Before(w.To) {
+		return false
+	}
+	if w.Last > 0 && t.Before(now.Add(-w.Last)) {
+		return false
+	}
+	return true
+}
+
+// Stats collects the requests of the access log that fall inside a window for the report
+type Stats struct {
+	window  Window
+	entries []accessLine
+	skipped int
+}
+
+// Add records a request
+func (s *Stats) Add(entry accessLine) {
+	s.entries = append(s.entries, entry)
+}
+
+// addLine records a log line if it is an access log entry inside the window
+//
+// A request outside the window now stays outside, the window only moves forward, so it is not kept.
+func (s *Stats) addLine(line string) {
+	entry, ok := parseAccessLine(line)
+	if !ok {
+		if strings.TrimSpace(line) != "" {
+			s.skipped++
+		}
+		return
+	}
+	if s.window.contains(entry.Time, time.Now()) {
+		s.Add(entry)
+	}
+}
+
+// prune drops requests that can no longer fall inside the window, so following a log does not grow forever
+func (s *Stats) prune(window Window, now time.Time) {
+	if window.Last <= 0 {
+		return
+	}
+	s.entries = slices.DeleteFunc(s.entries, func(e accessLine) bool {
+		return e.Time.Before(now.Add(-window.Last))
+	})
+}
+
+// RouteReport holds the numbers of one route
+type RouteReport struct {
+	Route        string  `json:"route"`
+	Requests     int     `json:"requests"`
+	ClientErrors int     `json:"client_errors"`
+	ServerErrors int     `json:"server_errors"`
+	ErrorRate    float64 `json:"error_rate"`
+	Bytes        int64   `json:"bytes"`
+	P50MS        float64 `json:"p50_ms"`
+	P90MS        float64 `json:"p90_ms"`
+	P99MS        float64 `json:"p99_ms"`
+}
+
+// Report is the summary of the requests inside a window
+type Report struct {
+	From    time.Time     `json:"from,omitzero"`
+	To      time.Time     `json:"to,omitzero"`
+	Total   RouteReport   `json:"total"`
+	Routes  []RouteReport `json:"routes"`
+	Skipped int           `json:"skipped_lines"`
+}
+
+// Report summarises the recorded requests that fall inside the window, busiest routes first
+func (s *Stats) Report(window Window, now time.Time) Report {
+	byRoute := map[string][]accessLine{}
+	var all []accessLine
+	report := Report{Skipped: s.skipped}
+	for _, e := range s.entries {
+		if !window.contains(e.Time, now) {
+			continue
+		}
+		byRoute[e.routeKey()] = append(byRoute[e.routeKey()], e)
+		all = append(all, e)
+		if report.From.IsZero() || e.Time.Before(report.From) {
+			report.From = e.Time
+		}
+		if e.Time.After(report.To) {
+			report.To = e.Time
+		}
+	}
+
+	for route, entries := range byRoute {
+		report.Routes = append(report.Routes, summarise(route, entries))
+	}
+	slices.SortFunc(report.Routes, func(a, b RouteReport) int {
+		if a.Requests != b.Requests {
+			return b.Requests - a.Requests
+		}
+		return strings.Compare(a.Route, b.Route)
+	})
+	report.Total = summarise("total", all)
+	return report
+}
+
+// summarise counts the requests and errors of a route and computes its latency percentiles
+func summarise(route string, entries []accessLine) RouteReport {
+	r := RouteReport{Route: route, Requests: len(entries)}
+	durations := make([]float64, 0, len(entries))
+	for _, e := range entries {
+		switch {
+		case e.Status >= 500:
+			r.ServerErrors++
+		case e.Status >= 400:
+			r.ClientErrors++
+		}
+		r.Bytes += e.Bytes
+		durations = append(durations, e.DurationMS)
+	}
+	if len(entries) == 0 {
+		return r
+	}
+
+	// Only server errors count against the error rate, 4xx answers are the client's mistake
+	r.ErrorRate = float64(r.ServerErrors) / float64(r.Requests)
+	slices.Sort(durations)
+	r.P50MS = percentile(durations, 50)
+	r.P90MS = percentile(durations, 90)
+	r.P99MS = percentile(durations, 99)
+	return r
+}
+
+// percentile returns the nearest-rank percentile p of sorted values
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+// printReport writes the report as a table or as JSON
+func printReport(w io.Writer, report Report, format string) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	if report.Total.Requests == 0 {
+		fmt.Fprintln(w, "No requests in the window.")
+	} else {
+		fmt.Fprintf(w, "Requests from %s to %s\n\n", report.From.Format(time.DateTime), report.To.Format(time.DateTime))
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "ROUTE\tREQUESTS\t4XX\t5XX\tERROR RATE\tP50 MS\tP90 MS\tP99 MS\t")
+	for _, r := range append(report.Routes, report.Total) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.1f%%\t%.1f\t%.1f\t%.1f\t\n",
+			r.Route, r.Requests, r.ClientErrors, r.ServerErrors, r.ErrorRate*100, r.P50MS, r.P90MS, r.P99MS)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+	if report.Skipped > 0 {
+		fmt.Fprintf(w, "\n%d lines were not access log entries and were skipped.\n", report.Skipped)
+	}
+	return nil
+}
+
+// LogReader reads complete lines from a log file and can keep reading as the file grows
+type LogReader struct {
+	path    string
+	file    *os.File
+	reader  *bufio.Reader
+	partial string
+}
+
+// OpenLog opens a log file for reading from its start
+func OpenLog(path string) (*LogReader, error) {
+	l := &LogReader{path: path}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open (re)opens the file at the path of the reader
+func (l *LogReader) open() error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to open log '%s': %w", l.path, err)
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.reader = bufio.NewReader(file)
+	l.partial = ""
+	return nil
+}
+
+// Close closes the log file
+func (l *LogReader) Close() error {
+	return l.file.Close()
+}
+
+// ReadLines calls fn for every complete line up to the current end of the file
+//
+// A line still being written is kept until its newline arrives, so it is never parsed half finished.
+func (l *LogReader) ReadLines(fn func(string)) error {
+	for {
+		chunk, err := l.reader.ReadString('\n')
+		l.partial += chunk
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log '%s': %w", l.path, err)
+		}
+		fn(l.partial)
+		l.partial = ""
+	}
+}
+
+// Flush calls fn for the last line when it has no newline, used once the whole file was read
+func (l *LogReader) Flush(fn func(string)) {
+	if l.partial != "" {
+		fn(l.partial)
+		l.partial = ""
+	}
+}
+
+// checkRotation reopens the log when it was replaced or truncated since the last read
+func (l *LogReader) checkRotation() error {
+	current, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// The new file has not been created yet, keep the old one until it appears
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	opened, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	offset, err := l.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	// The buffered reader may have read ahead, so compare with what the file handle has consumed
+	if !os.SameFile(current, opened) || current.Size() < offset {
+		return l.open()
+	}
+	return nil
+}
+
+// follow keeps reading new lines and prints a fresh report every interval until the context is cancelled
+func follow(ctx context.Context, log *LogReader, stats *Stats, window Window, interval time.Duration, format string) error {
+	poll := time.NewTicker(250 * time.Millisecond)
+	defer poll.Stop()
+	report := time.NewTicker(interval)
+	defer report.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-poll.C:
+			err := log.checkRotation()
+			if err != nil {
+				return err
+			}
+			err = log.ReadLines(stats.addLine)
+			if err != nil {
+				return err
+			}
+		case now := <-report.C:
+			stats.prune(window, now)
+			fmt.Printf("\n--- %s ---\n", now.Format(time.DateTime))
+			err := printReport(os.Stdout, stats.Report(window, now), format)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseTimeFlag reads a time given as RFC 3339 or as a date with an optional clock time
+func parseTimeFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid -%s '%s', use a time like 2026-10-18T15:04:05Z or 2026-10-18", name, value)
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run reads the log, prints the report and returns the exit code
+func run(args []string) int {
+	fs := flag.NewFlagSet("logstats", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: logstats [flags]")
+		fmt.Fprintln(fs.Output(), "Reports requests, error rates and latency per route from the task server's access log.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	path := fs.String("file", "server.log", "access log written by the task server")
+	last := fs.Duration("last", 0, "only report requests of this long before now, such as 15m (0 for all)")
+	from := fs.String("from", "", "only report requests at or after this time")
+	to := fs.String("to", "", "only report requests before this time")
+	followLog := fs.Bool("f", false, "keep reading new lines like 'tail -f' and print a report every interval")
+	interval := fs.Duration("interval", 10*time.Second, "how often to print the report with -f")
+	format := fs.String("o", "table", "output format: table or json")
+	err := fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+	if err != nil {
+		return exitUsage
+	}
+
+	window := Window{Last: *last}
+	window.From, err = parseTimeFlag("from", *from)
+	if err == nil {
+		window.To, err = parseTimeFlag("to", *to)
+	}
+	if err == nil && (*format != "table" && *format != "json") {
+		err = fmt.Errorf("invalid -o '%s', use table or json", *format)
+	}
+	if err == nil && *interval <= 0 {
+		err = errors.New("-interval must be positive")
+	}
+	if err == nil && fs.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument '%s'", fs.Arg(0))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logstats:", err)
+		return exitUsage
+	}
+
+	log, err := OpenLog(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logstats:", err)
+		return exitFailure
+	}
+	defer log.Close()
+
+	stats := &Stats{window: window}
+	err = log.ReadLines(stats.addLine)
+	// Without -f nothing more is written to the last line
+	if err == nil && !*followLog {
+		log.Flush(stats.addLine)
+	}
+	if err == nil {
+		err = printReport(os.Stdout, stats.Report(window, time.Now()), *format)
+	}
+
+	// Stop following when the user presses Ctrl+C
+	if err == nil && *followLog {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		err = follow(ctx, log, stats, window, *interval, *format)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "logstats:", err)
+		return exitFailure
+	}
+	return exitOK
+}
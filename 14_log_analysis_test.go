@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestStatsWindow checks that requests outside the window are not kept
+func TestStatsWindow(t *testing.T) {
+	now := time.Now().UTC()
+	line := func(at time.Time) string {
+		return `{"time":"` + at.Format(time.RFC3339Nano) + `","msg":"request","method":"GET","route":"/tasks","status":200,"duration_ms":1}`
+	}
+	tests := []struct {
+		name   string
+		window Window
+		kept   int
+	}{
+		{"all", Window{}, 3},
+		{"last", Window{Last: time.Hour}, 1},
+		{"from", Window{From: now.Add(-36 * time.Hour)}, 2},
+		{"to", Window{To: now.Add(-36 * time.Hour)}, 1},
+	}
+	for _, tt := range tests {
+		stats := &Stats{window: tt.window}
+		for _, at := range []time.Time{now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), now.Add(-time.Minute)} {
+			stats.addLine(line(at))
+		}
+		stats.addLine("not a request")
+		if len(stats.entries) != tt.kept || stats.skipped != 1 {
+			t.Errorf("%s: kept %d entries and skipped %d lines, want %d and 1", tt.name, len(stats.entries), stats.skipped, tt.kept)
+		}
+	}
+}
+
+// TestLogReaderLastLine checks that a last line without a newline is only read once it is flushed
+func TestLogReaderLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.log")
+	err := os.WriteFile(path, []byte("first\nsecond\nthird"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, err := OpenLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	var lines []string
+	add := func(line string) { lines = append(lines, line) }
+	err = log.ReadLines(add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("read %q before the flush, want the 2 complete lines", lines)
+	}
+	log.Flush(add)
+	log.Flush(add)
+	if len(lines) != 3 || lines[2] != "third" {
+		t.Errorf("read %q after the flush, want the last line once", lines)
+	}
+}
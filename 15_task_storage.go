@@ -0,0 +1,1178 @@
+// Storing data on disk in Go:
+// - Use 'File.ReadAt' and 'File.WriteAt' to read and write fixed-size pages anywhere in a file
+// - Use 'encoding/binary' to lay out numbers in a page and 'hash/crc32' to detect torn or corrupt writes
+// - A B+ tree keeps keys sorted in pages, so a lookup or range scan reads only a few pages even for many keys
+// - Write changes to a write-ahead log and 'File.Sync' it before touching the data file, so a crash never leaves half a change
+// - Secondary indexes are extra keys such as 'status/todo/42' that point back to the record they describe
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout of the page-based key-value store
+const (
+	kvPageSize  = 4096
+	kvMaxKey    = 512
+	kvMaxInline = 1024
+	kvMagic     = "TASKSKV1"
+	kvWALMagic  = "TASKWAL1"
+)
+
+// Kinds of pages in the key-value store, the kind is the first byte of a page
+const (
+	kvFree     byte = 0
+	kvLeaf     byte = 1
+	kvInternal byte = 2
+	kvOverflow byte = 3
+)
+
+// kvOverflowData is how many value bytes fit into an overflow page after its kind, next page and length
+const kvOverflowData = kvPageSize - 7
+
+// KVStore is a B+ tree of byte keys and values kept in fixed-size pages of one file
+//
+// Page 0 holds the root page, the head of the free list and the page count. Leaves hold the keys in order,
+// values larger than kvMaxInline continue in a chain of overflow pages. Pages that are no longer used are
+// linked into the free list and reused before the file grows.
+//
+// A transaction first writes the new images of every page it changed to a write-ahead log and syncs it,
+// only then are the pages written in place. After a crash the complete transactions in the log are written
+// again on open, and an incomplete one is dropped, so the file is never left half updated.
+type KVStore struct {
+	mu   sync.Mutex
+	file *os.File
+	wal  *os.File
+	meta kvMeta
+
+	// failed is set when a transaction reached the log but not the file, the file may be half updated
+	// until the log is written again
+	failed error
+}
+
+// kvMeta is the content of page 0
+type kvMeta struct {
+	root     uint32
+	freeHead uint32
+	pages    uint32
+}
+
+// kvNode is a decoded tree page
+//
+// Leaves keep the values in 'vals', for values in overflow pages 'big' is set and the value holds the
+// first page and length. Internal nodes have one child more than keys, child i holds the keys below key i.
+type kvNode struct {
+	leaf     bool
+	keys     [][]byte
+	vals     [][]byte
+	big      []bool
+	children []uint32
+}
+
+// OpenKV opens or creates a store file, finishing a transaction the write-ahead log still holds
+func OpenKV(path string) (*KVStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store '%s': %w", path, err)
+	}
+	wal, err := os.OpenFile(path+"-wal", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open write-ahead log of '%s': %w", path, err)
+	}
+	db := &KVStore{file: file, wal: wal}
+
+	err = db.recover()
+	if err == nil {
+		err = db.readMeta()
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("store '%s': %w", path, err)
+	}
+	return db, nil
+}
+
+// Close closes the store and its log
+func (db *KVStore) Close() error {
+	return errors.Join(db.file.Close(), db.wal.Close())
+}
+
+// recover writes the pages of a complete transaction left in the log and empties the log
+func (db *KVStore) recover() error {
+	data, err := io.ReadAll(io.NewSectionReader(db.wal, 0, 1<<62))
+	if err != nil {
+		return err
+	}
+	pages, ok := decodeWAL(data)
+	if ok {
+		slog.Warn("replaying write-ahead log", "file", db.file.Name(), "pages", len(pages))
+		err = db.writePages(pages)
+		if err != nil {
+			return err
+		}
+	}
+	// A log without a valid commit record belongs to a transaction that never reached the file
+	return db.wal.Truncate(0)
+}
+
+// readMeta reads page 0, creating an empty tree in a new file
+func (db *KVStore) readMeta() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		tx := &KVTx{db: db, meta: kvMeta{root: 1, pages: 2}, dirty: map[uint32][]byte{}}
+		tx.writeNode(1, &kvNode{leaf: true})
+		return db.commit(tx)
+	}
+
+	page := make([]byte, kvPageSize)
+	_, err = db.file.ReadAt(page, 0)
+	if err != nil {
+		return err
+	}
+	if string(page[:8]) != kvMagic {
+		return errors.New("not a task store file")
+	}
+	db.meta = kvMeta{
+		root:     binary.LittleEndian.Uint32(page[8:]),
+		freeHead: binary.LittleEndian.Uint32(page[12:]),
+		pages:    binary.LittleEndian.Uint32(page[16:]),
+	}
+	return nil
+}
+
+// encodeWAL serialises a transaction as its magic, page count, page images and a checksum over all of it
+func encodeWAL(pages map[uint32][]byte) []byte {
+	ids := slices.Sorted(maps.Keys(pages))
+	buf := make([]byte, 0, 12+len(ids)*(4+kvPageSize)+4)
+	buf = append(buf, kvWALMagic...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(ids)))
+	for _, id := range ids {
+		buf = binary.LittleEndian.AppendUint32(buf, id)
+		buf = append(buf, pages[id]...)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+// decodeWAL reads a transaction back, reporting false if the log is empty, torn or corrupt
+func decodeWAL(data []byte) (map[uint32][]byte, bool) {
+	if len(data) < 16 || string(data[:8]) != kvWALMagic {
+		return nil, false
+	}
+	count := int(binary.LittleEndian.Uint32(data[8:]))
+	end := 12 + count*(4+kvPageSize)
+	if count == 0 || len(data) < end+4 || crc32.ChecksumIEEE(data[:end]) != binary.LittleEndian.Uint32(data[end:]) {
+		return nil, false
+	}
+	pages := map[uint32][]byte{}
+	for i := 12; i < end; i += 4 + kvPageSize {
+		pages[binary.LittleEndian.Uint32(data[i:])] = data[i+4 : i+4+kvPageSize]
+	}
+	return pages, true
+}
+
+// commit makes the pages of a transaction durable, first in the log and then in the file
+func (db *KVStore) commit(tx *KVTx) error {
+	page := make([]byte, kvPageSize)
+	copy(page, kvMagic)
+	binary.LittleEndian.PutUint32(page[8:], tx.meta.root)
+	binary.LittleEndian.PutUint32(page[12:], tx.meta.freeHead)
+	binary.LittleEndian.PutUint32(page[16:], tx.meta.pages)
+	tx.dirty[0] = page
+
+	_, err := db.wal.WriteAt(encodeWAL(tx.dirty), 0)
+	if err == nil {
+		err = db.wal.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write log: %w", err)
+	}
+
+	// From here on the transaction survives a crash, after a failure below the store refuses to be used
+	// until the log was written again, and the new root is only used once the pages are in place
+	err = db.writePages(tx.dirty)
+	if err == nil {
+		err = db.wal.Truncate(0)
+	}
+	if err != nil {
+		db.failed = err
+		return err
+	}
+	db.meta = tx.meta
+	return nil
+}
+
+// repair writes the transaction left in the log by a failed commit, so the file is complete again
+func (db *KVStore) repair() error {
+	if db.failed == nil {
+		return nil
+	}
+	err := db.recover()
+	if err == nil {
+		err = db.readMeta()
+	}
+	if err != nil {
+		return fmt.Errorf("store is unusable after a failed write (%w), repair failed: %w", db.failed, err)
+	}
+	db.failed = nil
+	return nil
+}
+
+// writePages writes page images in place and syncs the file
+func (db *KVStore) writePages(pages map[uint32][]byte) error {
+	for id, page := range pages {
+		_, err := db.file.WriteAt(page, int64(id)*kvPageSize)
+		if err != nil {
+			return fmt.Errorf("failed to write page %d: %w", id, err)
+		}
+	}
+	return db.file.Sync()
+}
+
+// Update runs fn in a transaction that is committed if fn returns nil and discarded otherwise
+func (db *KVStore) Update(fn func(tx *KVTx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.repair()
+	if err != nil {
+		return err
+	}
+	tx := &KVTx{db: db, meta: db.meta, dirty: map[uint32][]byte{}}
+	err = fn(tx)
+	if err != nil || len(tx.dirty) == 0 {
+		return err
+	}
+	return db.commit(tx)
+}
+
+// View runs fn with a transaction that only reads
+func (db *KVStore) View(fn func(tx *KVTx) error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	err := db.repair()
+	if err != nil {
+		return err
+	}
+	return fn(&KVTx{db: db, meta: db.meta, dirty: map[uint32][]byte{}, readOnly: true})
+}
+
+// KVTx reads and changes a store, changed pages stay in memory until the transaction commits
+type KVTx struct {
+	db       *KVStore
+	meta     kvMeta
+	dirty    map[uint32][]byte
+	readOnly bool
+}
+
+// errKVReadOnly is returned when a read-only transaction tries to write
+var errKVReadOnly = errors.New("transaction is read-only")
+
+// page returns the current image of a page
+func (tx *KVTx) page(id uint32) ([]byte, error) {
+	if page, ok := tx.dirty[id]; ok {
+		return page, nil
+	}
+	if id == 0 || id >= tx.meta.pages {
+		return nil, fmt.Errorf("page %d out of range", id)
+	}
+	page := make([]byte, kvPageSize)
+	_, err := tx.db.file.ReadAt(page, int64(id)*kvPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %w", id, err)
+	}
+	return page, nil
+}
+
+// alloc returns an unused page, taken from the free list if possible
+func (tx *KVTx) alloc() (uint32, error) {
+	if tx.meta.freeHead == 0 {
+		tx.meta.pages++
+		return tx.meta.pages - 1, nil
+	}
+	id := tx.meta.freeHead
+	page, err := tx.page(id)
+	if err != nil {
+		return 0, err
+	}
+	if page[0] != kvFree {
+		return 0, fmt.Errorf("free list points at page %d which is in use", id)
+	}
+	tx.meta.freeHead = binary.LittleEndian.Uint32(page[1:])
+	return id, nil
+}
+
+// free puts a page at the head of the free list
+func (tx *KVTx) free(id uint32) {
+	page := make([]byte, kvPageSize)
+	page[0] = kvFree
+	binary.LittleEndian.PutUint32(page[1:], tx.meta.freeHead)
+	tx.dirty[id] = page
+	tx.meta.freeHead = id
+}
+
+// readNode decodes a tree page
+func (tx *KVTx) readNode(id uint32) (*kvNode, error) {
+	page, err := tx.page(id)
+	if err != nil {
+		return nil, err
+	}
+	if page[0] != kvLeaf && page[0] != kvInternal {
+		return nil, fmt.Errorf("page %d is not a tree page", id)
+	}
+	n := &kvNode{leaf: page[0] == kvLeaf}
+	count := int(binary.LittleEndian.Uint16(page[1:]))
+	pos := 3
+	if !n.leaf {
+		n.children = append(n.children, binary.LittleEndian.Uint32(page[pos:]))
+		pos += 4
+	}
+	for range count {
+		klen := int(binary.LittleEndian.Uint16(page[pos:]))
+		pos += 2
+		if n.leaf {
+			big := page[pos] == 1
+			vlen := int(binary.LittleEndian.Uint32(page[pos+1:]))
+			pos += 5
+			n.keys = append(n.keys, page[pos:pos+klen])
+			n.vals = append(n.vals, page[pos+klen:pos+klen+vlen])
+			n.big = append(n.big, big)
+			pos += klen + vlen
+		} else {
+			n.keys = append(n.keys, page[pos:pos+klen])
+			n.children = append(n.children, binary.LittleEndian.Uint32(page[pos+klen:]))
+			pos += klen + 4
+		}
+	}
+	return n, nil
+}
+
+// size returns how many bytes the node takes as a page
+func (n *kvNode) size() int {
+	size := 3
+	if !n.leaf {
+		size += 4
+	}
+	for i := range n.keys {
+		size += n.cellSize(i)
+	}
+	return size
+}
+
+// cellSize returns how many bytes the key at index i and its value or child take
+func (n *kvNode) cellSize(i int) int {
+	if n.leaf {
+		return 7 + len(n.keys[i]) + len(n.vals[i])
+	}
+	return 6 + len(n.keys[i])
+}
+
+// writeNode encodes a node into the page with the given ID
+func (tx *KVTx) writeNode(id uint32, n *kvNode) {
+	page := make([]byte, kvPageSize)
+	page[0] = kvInternal
+	if n.leaf {
+		page[0] = kvLeaf
+	}
+	binary.LittleEndian.PutUint16(page[1:], uint16(len(n.keys)))
+	pos := 3
+	if !n.leaf {
+		binary.LittleEndian.PutUint32(page[pos:], n.children[0])
+		pos += 4
+	}
+	for i, key := range n.keys {
+		binary.LittleEndian.PutUint16(page[pos:], uint16(len(key)))
+		pos += 2
+		if n.leaf {
+			if n.big[i] {
+				page[pos] = 1
+			}
+			binary.LittleEndian.PutUint32(page[pos+1:], uint32(len(n.vals[i])))
+			pos += 5
+			pos += copy(page[pos:], key)
+			pos += copy(page[pos:], n.vals[i])
+		} else {
+			pos += copy(page[pos:], key)
+			binary.LittleEndian.PutUint32(page[pos:], n.children[i+1])
+			pos += 4
+		}
+	}
+	tx.dirty[id] = page
+}
+
+// childIndex returns which child of an internal node covers the key
+func (n *kvNode) childIndex(key []byte) int {
+	i, found := slices.BinarySearchFunc(n.keys, key, bytes.Compare)
+	if found {
+		return i + 1
+	}
+	return i
+}
+
+// Get returns the value stored under a key
+func (tx *KVTx) Get(key []byte) ([]byte, bool, error) {
+	id := tx.meta.root
+	for {
+		n, err := tx.readNode(id)
+		if err != nil {
+			return nil, false, err
+		}
+		if !n.leaf {
+			id = n.children[n.childIndex(key)]
+			continue
+		}
+		i, found := slices.BinarySearchFunc(n.keys, key, bytes.Compare)
+		if !found {
+			return nil, false, nil
+		}
+		value, err := tx.value(n, i)
+		return value, err == nil, err
+	}
+}
+
+// value returns the value at index i of a leaf, reading it from its overflow pages if needed
+func (tx *KVTx) value(n *kvNode, i int) ([]byte, error) {
+	if !n.big[i] {
+		return bytes.Clone(n.vals[i]), nil
+	}
+	id := binary.LittleEndian.Uint32(n.vals[i])
+	value := make([]byte, 0, binary.LittleEndian.Uint32(n.vals[i][4:]))
+	for id != 0 {
+		page, err := tx.page(id)
+		if err != nil {
+			return nil, err
+		}
+		if page[0] != kvOverflow {
+			return nil, fmt.Errorf("page %d is not an overflow page", id)
+		}
+		length := int(binary.LittleEndian.Uint16(page[5:]))
+		value = append(value, page[7:7+length]...)
+		id = binary.LittleEndian.Uint32(page[1:])
+	}
+	return value, nil
+}
+
+// Put stores a value under a key, replacing the previous value
+func (tx *KVTx) Put(key, value []byte) error {
+	if tx.readOnly {
+		return errKVReadOnly
+	}
+	if len(key) == 0 || len(key) > kvMaxKey {
+		return fmt.Errorf("key must have 1 to %d bytes", kvMaxKey)
+	}
+
+	stored, big := bytes.Clone(value), false
+	if len(value) > kvMaxInline {
+		ref, err := tx.writeOverflow(value)
+		if err != nil {
+			return err
+		}
+		stored, big = ref, true
+	}
+
+	sep, right, err := tx.insert(tx.meta.root, bytes.Clone(key), stored, big)
+	if err != nil || right == 0 {
+		return err
+	}
+
+	// The root was split, a new root above both halves makes the tree one level taller
+	root, err := tx.alloc()
+	if err != nil {
+		return err
+	}
+	tx.writeNode(root, &kvNode{keys: [][]byte{sep}, children: []uint32{tx.meta.root, right}})
+	tx.meta.root = root
+	return nil
+}
+
+// insert adds a key to the subtree at page id, returning the separator and new page if the node was split
+func (tx *KVTx) insert(id uint32, key, stored []byte, big bool) ([]byte, uint32, error) {
+	n, err := tx.readNode(id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if n.leaf {
+		i, found := slices.BinarySearchFunc(n.keys, key, bytes.Compare)
+		if found {
+			err := tx.freeValue(n, i)
+			if err != nil {
+				return nil, 0, err
+			}
+			n.vals[i], n.big[i] = stored, big
+		} else {
+			n.keys = slices.Insert(n.keys, i, key)
+			n.vals = slices.Insert(n.vals, i, stored)
+			n.big = slices.Insert(n.big, i, big)
+		}
+	} else {
+		i := n.childIndex(key)
+		sep, right, err := tx.insert(n.children[i], key, stored, big)
+		if err != nil {
+			return nil, 0, err
+		}
+		if right == 0 {
+			return nil, 0, nil
+		}
+		n.keys = slices.Insert(n.keys, i, sep)
+		n.children = slices.Insert(n.children, i+1, right)
+	}
+
+	if n.size() <= kvPageSize {
+		tx.writeNode(id, n)
+		return nil, 0, nil
+	}
+	return tx.split(id, n)
+}
+
+// split moves the upper half of an overfull node by size to a new page
+func (tx *KVTx) split(id uint32, n *kvNode) ([]byte, uint32, error) {
+	// Cells differ in size, so pick the split point that makes the larger half smallest rather than the middle key
+	total := n.size()
+	header := total
+	for i := range n.keys {
+		header -= n.cellSize(i)
+	}
+	m, best := 1, total
+	for i, prefix := 1, 0; i < len(n.keys); i++ {
+		prefix += n.cellSize(i - 1)
+		left, right := header+prefix, total-prefix
+		if !n.leaf {
+			// The key at the split point moves up into the parent
+			right -= n.cellSize(i)
+		}
+		if larger := max(left, right); larger < best {
+			m, best = i, larger
+		}
+	}
+
+	rightID, err := tx.alloc()
+	if err != nil {
+		return nil, 0, err
+	}
+	left, right := &kvNode{leaf: n.leaf}, &kvNode{leaf: n.leaf}
+	var sep []byte
+	if n.leaf {
+		left.keys, left.vals, left.big = n.keys[:m], n.vals[:m], n.big[:m]
+		right.keys, right.vals, right.big = n.keys[m:], n.vals[m:], n.big[m:]
+		sep = right.keys[0]
+	} else {
+		// The middle key moves up into the parent instead of staying in either half
+		left.keys, left.children = n.keys[:m], n.children[:m+1]
+		right.keys, right.children = n.keys[m+1:], n.children[m+1:]
+		sep = n.keys[m]
+	}
+	tx.writeNode(id, left)
+	tx.writeNode(rightID, right)
+	return sep, rightID, nil
+}
+
+// Delete removes a key and reports whether it was there
+func (tx *KVTx) Delete(key []byte) (bool, error) {
+	if tx.readOnly {
+		return false, errKVReadOnly
+	}
+	found, empty, err := tx.remove(tx.meta.root, key)
+	if err != nil || !found {
+		return found, err
+	}
+
+	root, err := tx.readNode(tx.meta.root)
+	if err != nil {
+		return true, err
+	}
+	switch {
+	case empty:
+		tx.writeNode(tx.meta.root, &kvNode{leaf: true})
+	case !root.leaf && len(root.keys) == 0:
+		// A root with a single child is not needed, the tree becomes one level shorter
+		old := tx.meta.root
+		tx.meta.root = root.children[0]
+		tx.free(old)
+	}
+	return true, nil
+}
+
+// remove deletes a key from the subtree at page id and reports whether the node became empty
+//
+// Empty nodes are freed and unlinked from their parent. Nodes that are merely underfull are left as they
+// are, which wastes some space after many deletes but keeps the tree correct.
+func (tx *KVTx) remove(id uint32, key []byte) (bool, bool, error) {
+	n, err := tx.readNode(id)
+	if err != nil {
+		return false, false, err
+	}
+
+	if n.leaf {
+		i, found := slices.BinarySearchFunc(n.keys, key, bytes.Compare)
+		if !found {
+			return false, false, nil
+		}
+		err := tx.freeValue(n, i)
+		if err != nil {
+			return false, false, err
+		}
+		n.keys = slices.Delete(n.keys, i, i+1)
+		n.vals = slices.Delete(n.vals, i, i+1)
+		n.big = slices.Delete(n.big, i, i+1)
+		if len(n.keys) == 0 {
+			return true, true, nil
+		}
+		tx.writeNode(id, n)
+		return true, false, nil
+	}
+
+	i := n.childIndex(key)
+	found, empty, err := tx.remove(n.children[i], key)
+	if err != nil || !found {
+		return found, false, err
+	}
+	if !empty {
+		return true, false, nil
+	}
+
+	tx.free(n.children[i])
+	n.children = slices.Delete(n.children, i, i+1)
+	if len(n.children) == 0 {
+		return true, true, nil
+	}
+	n.keys = slices.Delete(n.keys, max(i-1, 0), max(i, 1))
+	tx.writeNode(id, n)
+	return true, false, nil
+}
+
+// writeOverflow stores a large value in a chain of overflow pages and returns the reference kept in the leaf
+func (tx *KVTx) writeOverflow(value []byte) ([]byte, error) {
+	ids := make([]uint32, (len(value)+kvOverflowData-1)/kvOverflowData)
+	for i := range ids {
+		id, err := tx.alloc()
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	for i, id := range ids {
+		chunk := value[i*kvOverflowData : min((i+1)*kvOverflowData, len(value))]
+		page := make([]byte, kvPageSize)
+		page[0] = kvOverflow
+		if i+1 < len(ids) {
+			binary.LittleEndian.PutUint32(page[1:], ids[i+1])
+		}
+		binary.LittleEndian.PutUint16(page[5:], uint16(len(chunk)))
+		copy(page[7:], chunk)
+		tx.dirty[id] = page
+	}
+	ref := binary.LittleEndian.AppendUint32(nil, ids[0])
+	return binary.LittleEndian.AppendUint32(ref, uint32(len(value))), nil
+}
+
+// freeValue frees the overflow pages of the value at index i of a leaf
+func (tx *KVTx) freeValue(n *kvNode, i int) error {
+	if !n.big[i] {
+		return nil
+	}
+	id := binary.LittleEndian.Uint32(n.vals[i])
+	for id != 0 {
+		page, err := tx.page(id)
+		if err != nil {
+			return err
+		}
+		next := binary.LittleEndian.Uint32(page[1:])
+		tx.free(id)
+		id = next
+	}
+	return nil
+}
+
+// Scan calls fn for every key from 'start' up to but excluding 'end' in order, a nil end scans to the last key
+//
+// Returning false from fn stops the scan.
+func (tx *KVTx) Scan(start, end []byte, fn func(key, value []byte) bool) error {
+	_, err := tx.scan(tx.meta.root, start, end, fn)
+	return err
+}
+
+// scan walks the subtree at page id and reports whether the scan should go on
+func (tx *KVTx) scan(id uint32, start, end []byte, fn func(key, value []byte) bool) (bool, error) {
+	n, err := tx.readNode(id)
+	if err != nil {
+		return false, err
+	}
+
+	if n.leaf {
+		i, _ := slices.BinarySearchFunc(n.keys, start, bytes.Compare)
+		for ; i < len(n.keys); i++ {
+			if end != nil && bytes.Compare(n.keys[i], end) >= 0 {
+				return false, nil
+			}
+			value, err := tx.value(n, i)
+			if err != nil {
+				return false, err
+			}
+			if !fn(bytes.Clone(n.keys[i]), value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	for i := n.childIndex(start); i < len(n.children); i++ {
+		if i > 0 && end != nil && bytes.Compare(n.keys[i-1], end) >= 0 {
+			return false, nil
+		}
+		more, err := tx.scan(n.children[i], start, end, fn)
+		if err != nil || !more {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// prefixEnd returns the first key after every key starting with prefix
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// TaskDB keeps the workspaces, tasks and role assignments of the server in a KVStore, with indexes by
+// status and due date
+//
+// Keys are grouped by a prefix and the workspace name, role assignments by the user name:
+//
+//	role/<user>                        role assignment, an empty role records a removed one
+//	ws/<workspace>                     members and quota
+//	n/<workspace>                      next IDs and sequence number
+//	t/<workspace>/<id>                 task
+//	x/<workspace>/<id>                 task in the trash
+//	c/<workspace>/<id>                 comments of a task
+//	tpl/<workspace>/<name>             task template
+//	s/<workspace>/<status>/<id>        index of tasks by status
+//	d/<workspace>/<due time>/<id>      index of tasks by due date
+//
+// IDs are zero padded and due times are written in UTC with a fixed width, so keys sort like the values.
+type TaskDB struct {
+	kv *KVStore
+}
+
+// Database of the server, nil when tasks are only kept in memory
+var taskDB *TaskDB
+
+// taskDBCounters are the numbers a workspace needs to continue where it stopped
+type taskDBCounters struct {
+	NextID        int   `json:"next_id"`
+	NextCommentID int   `json:"next_comment_id"`
+	Seq           int64 `json:"seq"`
+}
+
+// taskDBRole is a stored role assignment
+type taskDBRole struct {
+	Role string `json:"role"`
+}
+
+// taskDBWorkspace is the stored configuration of a workspace
+type taskDBWorkspace struct {
+	Members  []string `json:"members"`
+	MaxTasks int      `json:"max_tasks"`
+}
+
+// OpenTaskDB opens or creates the database file
+func OpenTaskDB(path string) (*TaskDB, error) {
+	kv, err := OpenKV(path)
+	if err != nil {
+		return nil, err
+	}
+	return &TaskDB{kv: kv}, nil
+}
+
+// Close closes the database
+func (db *TaskDB) Close() error {
+	return db.kv.Close()
+}
+
+// taskKey returns the key of a task, trashed task or comment thread depending on the prefix
+func taskKey(prefix, ws string, id int) []byte {
+	return fmt.Appendf(nil, "%s/%s/%010d", prefix, ws, id)
+}
+
+// templateKey returns the key of a task template
+func templateKey(ws, name string) []byte {
+	return []byte("tpl/" + ws + "/" + name)
+}
+
+// statusKey returns the status index key of a task
+func statusKey(ws, status string, id int) []byte {
+	return fmt.Appendf(nil, "s/%s/%s/%010d", ws, status, id)
+}
+
+// dueKey returns the due date index key of a task
+func dueKey(ws string, due time.Time, id int) []byte {
+	return fmt.Appendf(nil, "d/%s/%s/%010d", ws, due.UTC().Format("2006-01-02T15:04:05.000000000Z"), id)
+}
+
+// Apply writes entries of the write log in one transaction
+func (db *TaskDB) Apply(entries []WriteEntry) error {
+	return db.kv.Update(func(tx *KVTx) error {
+		for _, e := range entries {
+			err := db.apply(tx, e)
+			if err != nil {
+				return fmt.Errorf("entry %d: %w", e.Offset, err)
+			}
+		}
+		return nil
+	})
+}
+
+// apply writes one entry of the write log
+func (db *TaskDB) apply(tx *KVTx, e WriteEntry) error {
+	switch e.Op {
+	case opRole:
+		return putJSON(tx, []byte("role/"+e.User), taskDBRole{Role: e.Role})
+	case opWorkspace:
+		return putJSON(tx, []byte("ws/"+e.Workspace), taskDBWorkspace{Members: e.Members, MaxTasks: e.MaxTasks})
+	case opDropWorkspace:
+		return db.dropWorkspace(tx, e.Workspace)
+	case opTemplate:
+		return putJSON(tx, templateKey(e.Workspace, e.Template.Name), e.Template)
+	case opDropTemplate:
+		_, err := tx.Delete(templateKey(e.Workspace, e.Template.Name))
+		return err
+	}
+
+	id := e.TaskID
+	if e.Task != nil {
+		id = e.Task.ID
+	}
+	err := db.removeTask(tx, e.Workspace, id)
+	if err != nil {
+		return err
+	}
+
+	switch e.Op {
+	case opPut:
+		err = putJSON(tx, taskKey("t", e.Workspace, id), e.Task)
+		if err == nil {
+			err = tx.Put(statusKey(e.Workspace, e.Task.Status, id), nil)
+		}
+		if err == nil && e.Task.Due != nil {
+			err = tx.Put(dueKey(e.Workspace, *e.Task.Due, id), nil)
+		}
+	case opTrash:
+		err = putJSON(tx, taskKey("x", e.Workspace, id), e.Task)
+	case opPurge:
+		return nil
+	}
+	if err == nil && len(e.Comments) > 0 {
+		err = putJSON(tx, taskKey("c", e.Workspace, id), e.Comments)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep the counters ahead of everything stored so IDs of purged tasks are never given out again
+	var counters taskDBCounters
+	_, err = getJSON(tx, []byte("n/"+e.Workspace), &counters)
+	if err != nil {
+		return err
+	}
+	counters.NextID = max(counters.NextID, id+1)
+	counters.Seq = max(counters.Seq, e.Seq)
+	if len(e.Comments) > 0 {
+		counters.NextCommentID = max(counters.NextCommentID, e.Comments[len(e.Comments)-1].ID+1)
+	}
+	return putJSON(tx, []byte("n/"+e.Workspace), counters)
+}
+
+// removeTask deletes a task, its index entries and its comments
+func (db *TaskDB) removeTask(tx *KVTx, ws string, id int) error {
+	var old Task
+	found, err := getJSON(tx, taskKey("t", ws, id), &old)
+	if err != nil {
+		return err
+	}
+	if found {
+		_, err = tx.Delete(statusKey(ws, old.Status, id))
+		if err == nil && old.Due != nil {
+			_, err = tx.Delete(dueKey(ws, *old.Due, id))
+		}
+	}
+	for _, prefix := range []string{"t", "x", "c"} {
+		if err == nil {
+			_, err = tx.Delete(taskKey(prefix, ws, id))
+		}
+	}
+	return err
+}
+
+// dropWorkspace deletes every key of a workspace
+func (db *TaskDB) dropWorkspace(tx *KVTx, ws string) error {
+	keys := [][]byte{[]byte("ws/" + ws), []byte("n/" + ws)}
+	for _, prefix := range []string{"t", "x", "c", "s", "d", "tpl"} {
+		err := tx.Scan([]byte(prefix+"/"+ws+"/"), prefixEnd(prefix+"/"+ws+"/"), func(key, _ []byte) bool {
+			keys = append(keys, key)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		_, err := tx.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save replaces the content of the database with a snapshot, such as one loaded from a leader
+func (db *TaskDB) Save(snapshot ReplicaSnapshot) error {
+	return db.kv.Update(func(tx *KVTx) error {
+		var names []string
+		err := tx.Scan([]byte("ws/"), prefixEnd("ws/"), func(key, _ []byte) bool {
+			names = append(names, strings.TrimPrefix(string(key), "ws/"))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			err = db.dropWorkspace(tx, name)
+			if err != nil {
+				return err
+			}
+		}
+		err = db.saveRoles(tx, snapshot.Roles)
+		if err != nil {
+			return err
+		}
+
+		for _, ws := range snapshot.Workspaces {
+			err = db.apply(tx, WriteEntry{Workspace: ws.Name, Op: opWorkspace, Members: ws.Members, MaxTasks: ws.MaxTasks})
+			for _, task := range ws.State.Tasks {
+				if err == nil {
+					err = db.apply(tx, WriteEntry{Workspace: ws.Name, Op: opPut, Seq: task.Seq, Task: &task, Comments: ws.State.Comments[task.ID]})
+				}
+			}
+			for _, task := range ws.State.Trash {
+				if err == nil {
+					err = db.apply(tx, WriteEntry{Workspace: ws.Name, Op: opTrash, Task: &task, Comments: ws.State.Comments[task.ID]})
+				}
+			}
+			for _, tmpl := range ws.Templates {
+				if err == nil {
+					err = db.apply(tx, WriteEntry{Workspace: ws.Name, Op: opTemplate, Template: &tmpl})
+				}
+			}
+			if err == nil {
+				counters := taskDBCounters{NextID: ws.State.NextID, NextCommentID: ws.State.NextCommentID, Seq: ws.State.Seq}
+				err = putJSON(tx, []byte("n/"+ws.Name), counters)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveRoles replaces the stored role assignments
+func (db *TaskDB) saveRoles(tx *KVTx, assigned map[string]string) error {
+	var keys [][]byte
+	err := tx.Scan([]byte("role/"), prefixEnd("role/"), func(key, _ []byte) bool {
+		keys = append(keys, key)
+		return true
+	})
+	for _, key := range keys {
+		if err == nil {
+			_, err = tx.Delete(key)
+		}
+	}
+	for user, role := range assigned {
+		if err == nil {
+			err = db.apply(tx, WriteEntry{Op: opRole, User: user, Role: role})
+		}
+	}
+	return err
+}
+
+// Load reads every workspace with its templates and the role assignments from the database
+//
+// Deletes from before the restart are not known any more, so change feed cursors from before it expire.
+func (db *TaskDB) Load() (ReplicaSnapshot, error) {
+	snapshot := ReplicaSnapshot{Roles: map[string]string{}}
+	err := db.kv.View(func(tx *KVTx) error {
+		err := tx.Scan([]byte("role/"), prefixEnd("role/"), func(key, value []byte) bool {
+			var assignment taskDBRole
+			if json.Unmarshal(value, &assignment) == nil {
+				snapshot.Roles[strings.TrimPrefix(string(key), "role/")] = assignment.Role
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+
+		var configs []taskDBWorkspace
+		var names []string
+		err = tx.Scan([]byte("ws/"), prefixEnd("ws/"), func(key, value []byte) bool {
+			var config taskDBWorkspace
+			if json.Unmarshal(value, &config) == nil {
+				names = append(names, strings.TrimPrefix(string(key), "ws/"))
+				configs = append(configs, config)
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		// The default workspace exists without being created, so it has no configuration key
+		if !slices.Contains(names, DefaultWorkspace) {
+			names = append(names, DefaultWorkspace)
+			configs = append(configs, taskDBWorkspace{Members: []string{}})
+		}
+
+		for i, name := range names {
+			ws := WorkspaceSnapshot{Name: name, Members: configs[i].Members, MaxTasks: configs[i].MaxTasks}
+			state := StoreState{Tasks: []Task{}, Comments: map[int][]Comment{}}
+			var counters taskDBCounters
+			_, err = getJSON(tx, []byte("n/"+name), &counters)
+			if err == nil {
+				state.Tasks, err = scanTasks(tx, "t/"+name+"/")
+			}
+			if err == nil {
+				state.Trash, err = scanTasks(tx, "x/"+name+"/")
+			}
+			if err == nil {
+				err = tx.Scan([]byte("c/"+name+"/"), prefixEnd("c/"+name+"/"), func(key, value []byte) bool {
+					var thread []Comment
+					if json.Unmarshal(value, &thread) == nil && len(thread) > 0 {
+						state.Comments[thread[0].TaskID] = thread
+					}
+					return true
+				})
+			}
+			if err == nil {
+				err = tx.Scan([]byte("tpl/"+name+"/"), prefixEnd("tpl/"+name+"/"), func(key, value []byte) bool {
+					var tmpl TaskTemplate
+					if json.Unmarshal(value, &tmpl) == nil {
+						ws.Templates = append(ws.Templates, tmpl)
+					}
+					return true
+				})
+			}
+			if err != nil {
+				return err
+			}
+			state.NextID, state.NextCommentID = counters.NextID, counters.NextCommentID
+			state.Seq, state.TombstoneFloor = counters.Seq, counters.Seq
+			ws.State = state
+			snapshot.Workspaces = append(snapshot.Workspaces, ws)
+		}
+		return nil
+	})
+	return snapshot, err
+}
+
+// TasksByStatus returns the tasks of a workspace with a status using the status index
+func (db *TaskDB) TasksByStatus(ws, status string) ([]Task, error) {
+	prefix := "s/" + ws + "/" + status + "/"
+	return db.indexedTasks(ws, []byte(prefix), prefixEnd(prefix))
+}
+
+// TasksDue returns the tasks of a workspace due in [from, to) using the due date index, zero times are open bounds
+func (db *TaskDB) TasksDue(ws string, from, to time.Time) ([]Task, error) {
+	prefix := "d/" + ws + "/"
+	start, end := []byte(prefix), prefixEnd(prefix)
+	if !from.IsZero() {
+		start = dueKey(ws, from, 0)
+	}
+	if !to.IsZero() {
+		end = dueKey(ws, to, 0)
+	}
+	return db.indexedTasks(ws, start, end)
+}
+
+// indexedTasks reads the tasks whose IDs end the index keys in [start, end)
+func (db *TaskDB) indexedTasks(ws string, start, end []byte) ([]Task, error) {
+	list := []Task{}
+	err := db.kv.View(func(tx *KVTx) error {
+		var ids []int
+		err := tx.Scan(start, end, func(key, _ []byte) bool {
+			id, err := strconv.Atoi(string(key[bytes.LastIndexByte(key, '/')+1:]))
+			if err == nil {
+				ids = append(ids, id)
+			}
+			return true
+		})
+		for _, id := range ids {
+			if err != nil {
+				break
+			}
+			var task Task
+			var found bool
+			found, err = getJSON(tx, taskKey("t", ws, id), &task)
+			if found {
+				list = append(list, task)
+			}
+		}
+		return err
+	})
+	return list, err
+}
+
+// scanTasks reads every task stored under a key prefix
+func scanTasks(tx *KVTx, prefix string) ([]Task, error) {
+	list := []Task{}
+	var decodeErr error
+	err := tx.Scan([]byte(prefix), prefixEnd(prefix), func(key, value []byte) bool {
+		var task Task
+		decodeErr = json.Unmarshal(value, &task)
+		list = append(list, task)
+		return decodeErr == nil
+	})
+	return list, cmp.Or(err, decodeErr)
+}
+
+// putJSON stores a value as JSON
+func putJSON(tx *KVTx, key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(key, data)
+}
+
+// getJSON reads a JSON value into v and reports whether the key exists
+func getJSON(tx *KVTx, key []byte, v any) (bool, error) {
+	data, found, err := tx.Get(key)
+	if err != nil || !found {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// openTestKV opens a store in a temporary directory that is removed after the test
+func openTestKV(t *testing.T) (*KVStore, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := OpenKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, path
+}
+
+// reopenKV closes a store and opens its file again
+func reopenKV(t *testing.T, db *KVStore, path string) *KVStore {
+	t.Helper()
+	db.Close()
+	db, err := OpenKV(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// kvTestKey returns the key of entry i, zero padded so keys sort like their numbers
+func kvTestKey(i int) []byte {
+	return fmt.Appendf(nil, "key/%06d", i)
+}
+
+// kvTestValue returns the value of entry i, every 50th one is large enough for overflow pages
+func kvTestValue(i int) []byte {
+	if i%50 == 0 {
+		return bytes.Repeat(fmt.Appendf(nil, "%d,", i), 2000)
+	}
+	return fmt.Appendf(nil, "value %d %s", i, bytes.Repeat([]byte("x"), i%200))
+}
+
+// putKV stores the entries from..to-1 in one transaction
+func putKV(t *testing.T, db *KVStore, from, to int) {
+	t.Helper()
+	err := db.Update(func(tx *KVTx) error {
+		for i := from; i < to; i++ {
+			err := tx.Put(kvTestKey(i), kvTestValue(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkKV checks that exactly the entries in want are stored, in key order
+func checkKV(t *testing.T, db *KVStore, want map[int]bool) {
+	t.Helper()
+	err := db.View(func(tx *KVTx) error {
+		for i, present := range want {
+			value, ok, err := tx.Get(kvTestKey(i))
+			if err != nil {
+				return err
+			}
+			if ok != present || (ok && !bytes.Equal(value, kvTestValue(i))) {
+				t.Errorf("Get(%s) = %d bytes, %v, want present %v", kvTestKey(i), len(value), ok, present)
+			}
+		}
+
+		var count int
+		var last []byte
+		err := tx.Scan(nil, nil, func(key, value []byte) bool {
+			if last != nil && bytes.Compare(last, key) >= 0 {
+				t.Errorf("Scan returned %s after %s", key, last)
+			}
+			last = bytes.Clone(key)
+			count++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		stored := 0
+		for _, present := range want {
+			if present {
+				stored++
+			}
+		}
+		if count != stored {
+			t.Errorf("Scan returned %d keys, want %d", count, stored)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKVSplit fills the tree until leaves and internal nodes split and reads every key back
+func TestKVSplit(t *testing.T) {
+	db, path := openTestKV(t)
+	want := map[int]bool{}
+
+	// Insert in an order that splits nodes at the front, back and middle
+	for _, i := range []int{0, 3000, 1500} {
+		putKV(t, db, i, i+1500)
+		for j := i; j < i+1500; j++ {
+			want[j] = true
+		}
+	}
+	checkKV(t, db, want)
+
+	err := db.View(func(tx *KVTx) error {
+		root, err := tx.readNode(tx.meta.root)
+		if err != nil {
+			return err
+		}
+		child, err := tx.readNode(root.children[0])
+		if err != nil {
+			return err
+		}
+		if root.leaf || child.leaf {
+			t.Errorf("tree of %d keys has fewer than 3 levels", len(want))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db = reopenKV(t, db, path)
+	checkKV(t, db, want)
+
+	var scanned []string
+	err = db.View(func(tx *KVTx) error {
+		return tx.Scan(kvTestKey(1498), kvTestKey(1503), func(key, value []byte) bool {
+			scanned = append(scanned, string(key))
+			return true
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(scanned) != "[key/001498 key/001499 key/001500 key/001501 key/001502]" {
+		t.Errorf("range scan = %v", scanned)
+	}
+}
+
+// TestKVDelete removes keys until the tree is empty and checks the rest after every round
+func TestKVDelete(t *testing.T) {
+	db, path := openTestKV(t)
+	want := map[int]bool{}
+	putKV(t, db, 0, 3000)
+	for i := range 3000 {
+		want[i] = true
+	}
+
+	for _, step := range []int{2, 3, 1} {
+		err := db.Update(func(tx *KVTx) error {
+			for i := range 3000 {
+				if i%step != 0 {
+					continue
+				}
+				found, err := tx.Delete(kvTestKey(i))
+				if err != nil {
+					return err
+				}
+				if found != want[i] {
+					t.Errorf("Delete(%s) = %v, want %v", kvTestKey(i), found, want[i])
+				}
+				want[i] = false
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkKV(t, db, want)
+	}
+
+	db = reopenKV(t, db, path)
+	checkKV(t, db, want)
+	err := db.View(func(tx *KVTx) error {
+		root, err := tx.readNode(tx.meta.root)
+		if err != nil {
+			return err
+		}
+		if !root.leaf || len(root.keys) != 0 {
+			t.Errorf("root of an empty tree has %d keys, leaf %v", len(root.keys), root.leaf)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestKVFreeListReuse checks that pages freed by deletes are used again before the file grows
+func TestKVFreeListReuse(t *testing.T) {
+	db, path := openTestKV(t)
+	putKV(t, db, 0, 2000)
+	pages := db.meta.pages
+
+	err := db.Update(func(tx *KVTx) error {
+		for i := range 2000 {
+			_, err := tx.Delete(kvTestKey(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.meta.freeHead == 0 {
+		t.Fatal("no pages on the free list after deleting every key")
+	}
+
+	// The free list is kept in the file, so reopening must not lose it
+	db = reopenKV(t, db, path)
+	putKV(t, db, 0, 2000)
+	if db.meta.pages != pages {
+		t.Errorf("file has %d pages after refilling, want %d", db.meta.pages, pages)
+	}
+	want := map[int]bool{}
+	for i := range 2000 {
+		want[i] = true
+	}
+	checkKV(t, db, want)
+}
+
+// failWrites makes writes to the data file fail, as if the process stopped after the log was synced
+func failWrites(t *testing.T, db *KVStore, path string) {
+	t.Helper()
+	readOnly, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.file.Close()
+	db.file = readOnly
+}
+
+// TestKVReplay checks that a transaction in the log is finished on open, even after a torn page write
+func TestKVReplay(t *testing.T) {
+	db, path := openTestKV(t)
+	putKV(t, db, 0, 500)
+
+	failWrites(t, db, path)
+	err := db.Update(func(tx *KVTx) error {
+		for i := range 500 {
+			_, err := tx.Delete(kvTestKey(i))
+			if err != nil {
+				return err
+			}
+		}
+		for i := 500; i < 1000; i++ {
+			err := tx.Put(kvTestKey(i), kvTestValue(i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		t.Fatal("commit succeeded without writing the data file")
+	}
+	err = db.Update(func(tx *KVTx) error { return nil })
+	if err == nil {
+		t.Error("store accepted a transaction before the failed one was written")
+	}
+
+	// Tear the page write: only one page of the transaction reaches the file before the crash
+	data, err := os.ReadFile(path + "-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages, ok := decodeWAL(data)
+	if !ok {
+		t.Fatal("log does not hold the failed transaction")
+	}
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, page := range pages {
+		if id != 0 {
+			file.WriteAt(page[:kvPageSize/2], int64(id)*kvPageSize)
+			break
+		}
+	}
+	file.Close()
+
+	db = reopenKV(t, db, path)
+	want := map[int]bool{}
+	for i := range 1000 {
+		want[i] = i >= 500
+	}
+	checkKV(t, db, want)
+}
+
+// TestKVTornLog checks that a transaction whose log was not completely written is dropped on open
+func TestKVTornLog(t *testing.T) {
+	for _, damage := range []string{"truncated", "corrupt"} {
+		t.Run(damage, func(t *testing.T) {
+			db, path := openTestKV(t)
+			putKV(t, db, 0, 300)
+
+			failWrites(t, db, path)
+			err := db.Update(func(tx *KVTx) error {
+				return tx.Put(kvTestKey(0), []byte("changed"))
+			})
+			if err == nil {
+				t.Fatal("commit succeeded without writing the data file")
+			}
+			db.Close()
+
+			wal, err := os.OpenFile(path+"-wal", os.O_RDWR, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			size, err := wal.Seek(0, io.SeekEnd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if damage == "truncated" {
+				err = wal.Truncate(size - 100)
+			} else {
+				_, err = wal.WriteAt([]byte{0xff}, size/2)
+			}
+			wal.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenKV(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			want := map[int]bool{}
+			for i := range 300 {
+				want[i] = true
+			}
+			checkKV(t, db, want)
+		})
+	}
+}
+
+// useTaskDB stores every write of the test in a new database, like the server does with '--db'
+func useTaskDB(t *testing.T) (*TaskDB, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tasks.db")
+	db, err := OpenTaskDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldLog := writeLog
+	writeLog = NewWriteLog()
+	writeLog.persist = db.Apply
+	t.Cleanup(func() {
+		writeLog = oldLog
+		db.Close()
+	})
+	return db, path
+}
+
+// TestTaskDBTemplates checks that saved and deleted templates are stored and replicated
+func TestTaskDBTemplates(t *testing.T) {
+	ctx := context.Background()
+	db, path := useTaskDB(t)
+	store := NewTemplateStore(DefaultWorkspace)
+	for _, name := range []string{"release", "onboarding"} {
+		_, _, err := store.Put(ctx, TaskTemplate{Name: name, TemplateTask: TemplateTask{Title: name + " {{.version}}", Children: []TemplateTask{{Title: "step"}}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.Delete(ctx, "onboarding")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	db, err = OpenTaskDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	snapshot, err := db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := slices.IndexFunc(snapshot.Workspaces, func(ws WorkspaceSnapshot) bool { return ws.Name == DefaultWorkspace })
+	templates := snapshot.Workspaces[i].Templates
+	if len(templates) != 1 || templates[0].Name != "release" || len(templates[0].Children) != 1 {
+		t.Fatalf("loaded templates = %+v, want only 'release' with its step", templates)
+	}
+
+	// A follower applies the log entries of the leader to its own store and log
+	entries, _, err := writeLog.Read(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLog = NewWriteLog()
+	follower := NewTemplateStore(DefaultWorkspace)
+	for _, e := range entries {
+		err = follower.Replicate(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := follower.List(ctx)
+	if len(list) != 1 || list[0].Name != "release" || !list[0].UpdatedAt.Equal(templates[0].UpdatedAt) {
+		t.Errorf("replicated templates = %+v, want only 'release'", list)
+	}
+}
+
+// TestTaskDBRoles checks that role changes made through the API survive a restart on top of the users file
+func TestTaskDBRoles(t *testing.T) {
+	db, path := useTaskDB(t)
+	oldRoles := roles
+	t.Cleanup(func() { roles = oldRoles })
+	seed := map[string]string{"alice": RoleAdmin, "bob": RoleEditor}
+	roles = NewRoleStore(RoleViewer)
+	roles.Load(seed)
+
+	for user, role := range map[string]string{"bob": "", "carol": RoleEditor} {
+		err := roles.Assign(user, role)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]string{"alice": RoleAdmin, "bob": RoleViewer, "carol": RoleEditor}
+
+	// Restart: the users file is read first, then the stored changes
+	db.Close()
+	db, err := OpenTaskDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	snapshot, err := db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted := NewRoleStore(RoleViewer)
+	restarted.Load(seed)
+	restarted.Load(snapshot.Roles)
+	for user, role := range want {
+		if got := restarted.RoleOf(user); got != role {
+			t.Errorf("after a restart %s has role %q, want %q", user, got, role)
+		}
+	}
+
+	// A follower without the users file gets every assignment from the snapshot and the changes from the log
+	entries, _, err := writeLog.Read(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeLog = NewWriteLog()
+	roles = NewRoleStore(RoleViewer)
+	roles.Load(map[string]string{"alice": RoleAdmin, "bob": RoleEditor})
+	for _, e := range entries {
+		err = roles.Replicate(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for user, role := range want {
+		if got := roles.RoleOf(user); got != role {
+			t.Errorf("on a follower %s has role %q, want %q", user, got, role)
+		}
+	}
+	if list := roles.List(); len(list) != 2 {
+		t.Errorf("assignments = %v, want alice and carol", list)
+	}
+}
+
+// taskIDs returns the IDs of tasks in their order
+func taskIDs(tasks []Task) []int {
+	ids := []int{}
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
+
+// TestTaskDB checks that applied entries keep the indexes right, load again after a restart and
+// list in the same order as the store in memory
+func TestTaskDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tasks.db")
+	db, err := OpenTaskDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := DefaultWorkspace
+	day := func(month, day int) *time.Time {
+		due := time.Date(2024, time.Month(month), day, 9, 0, 0, 0, time.UTC)
+		return &due
+	}
+	deleted := day(5, 1)
+	comments := []Comment{{ID: 5, TaskID: 1, Author: "alice", Body: "first"}}
+	entries := []WriteEntry{
+		{Workspace: ws, Op: opPut, Seq: 1, Task: &Task{ID: 3, Title: "c", Status: StatusTodo, Due: day(4, 1)}},
+		{Workspace: ws, Op: opPut, Seq: 2, Task: &Task{ID: 1, Title: "a", Status: StatusTodo, Due: day(3, 1)}, Comments: comments},
+		{Workspace: ws, Op: opPut, Seq: 3, Task: &Task{ID: 2, Title: "b", Status: StatusInProgress, Due: day(3, 10)}},
+		{Workspace: ws, Op: opPut, Seq: 4, Task: &Task{ID: 4, Title: "d", Status: StatusTodo}},
+		// Finishing a task and clearing its due date must remove its old index entries
+		{Workspace: ws, Op: opPut, Seq: 5, Task: &Task{ID: 1, Title: "a", Status: StatusDone}, Comments: comments},
+		{Workspace: ws, Op: opTrash, Seq: 6, Task: &Task{ID: 4, Title: "d", Status: StatusTodo, DeletedAt: deleted}},
+		{Workspace: ws, Op: opPut, Seq: 7, Task: &Task{ID: 5, Title: "e", Status: StatusTodo, Due: day(3, 5)}},
+		{Workspace: ws, Op: opPurge, TaskID: 5},
+	}
+	others := []WriteEntry{
+		{Workspace: "other", Op: opWorkspace, Members: []string{"bob"}},
+		{Workspace: "other", Op: opPut, Seq: 1, Task: &Task{ID: 1, Title: "x", Status: StatusTodo, Due: day(3, 1)}},
+		{Workspace: "other", Op: opDropWorkspace},
+	}
+	for _, e := range append(entries, others...) {
+		err = db.Apply([]WriteEntry{e})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for status, want := range map[string][]int{StatusTodo: {3}, StatusInProgress: {2}, StatusDone: {1}} {
+		tasks, err := db.TasksByStatus(ws, status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := taskIDs(tasks); !slices.Equal(got, want) {
+			t.Errorf("TasksByStatus(%q) = %v, want %v", status, got, want)
+		}
+	}
+	dueTests := []struct {
+		from, to time.Time
+		want     []int
+	}{
+		{time.Time{}, time.Time{}, []int{2, 3}},
+		{*day(3, 10), *day(4, 1), []int{2}},
+		{*day(3, 11), time.Time{}, []int{3}},
+		{time.Time{}, *day(3, 10), []int{}},
+	}
+	for _, test := range dueTests {
+		tasks, err := db.TasksDue(ws, test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := taskIDs(tasks); !slices.Equal(got, test.want) {
+			t.Errorf("TasksDue(%v, %v) = %v, want %v", test.from, test.to, got, test.want)
+		}
+	}
+
+	db.Close()
+	db, err = OpenTaskDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	snapshot, err := db.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Workspaces) != 1 || snapshot.Workspaces[0].Name != ws {
+		t.Fatalf("loaded workspaces = %+v, want only %q", snapshot.Workspaces, ws)
+	}
+	state := snapshot.Workspaces[0].State
+	if got := taskIDs(state.Tasks); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Errorf("loaded tasks = %v, want [1 2 3]", got)
+	}
+	if got := taskIDs(state.Trash); !slices.Equal(got, []int{4}) {
+		t.Errorf("loaded trash = %v, want [4]", got)
+	}
+	if got := state.Comments[1]; len(got) != 1 || got[0].Body != "first" {
+		t.Errorf("loaded comments = %+v, want the comment on task 1", state.Comments)
+	}
+	if state.NextID != 6 || state.NextCommentID != 6 || state.Seq != 7 {
+		t.Errorf("loaded counters = %d, %d, %d, want 6, 6, 7", state.NextID, state.NextCommentID, state.Seq)
+	}
+
+	// A follower receiving the entries out of ID order lists its tasks like the database does
+	oldLog := writeLog
+	t.Cleanup(func() { writeLog = oldLog })
+	writeLog = NewWriteLog()
+	follower := NewTaskStore(ws, 0)
+	for _, e := range entries {
+		err = follower.Replicate(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := taskIDs(follower.List(context.Background())); !slices.Equal(got, taskIDs(state.Tasks)) {
+		t.Errorf("follower lists %v, the database %v", got, taskIDs(state.Tasks))
+	}
+}
@@ -0,0 +1,725 @@
+// Replication in Go:
+// - A leader accepts writes and numbers them in a write log, followers read that log and apply every entry in order
+// - Followers remember the offset they reached, so after a lost connection they continue where they stopped
+// - Stream the log as one JSON object per line and call 'http.ResponseController.Flush' so entries arrive at once
+// - Send heartbeats while idle so a follower can tell a quiet leader from a dead connection
+// - Promoting a follower makes it accept writes, stop the old leader first or the two copies drift apart
+// - Try it on one machine: start a second server with '--addr :4002 --http-addr "" --follow http://localhost:4001'
+
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the replication log
+const (
+	opPut           = "put"
+	opTrash         = "trash"
+	opPurge         = "purge"
+	opWorkspace     = "workspace"
+	opDropWorkspace = "drop-workspace"
+	opTemplate      = "template"
+	opDropTemplate  = "drop-template"
+	opRole          = "role"
+	opHeartbeat     = "heartbeat"
+)
+
+// WriteEntry is one write in the replication log, holding the state a task or workspace was left in
+type WriteEntry struct {
+	Offset    int64     `json:"offset"`
+	Time      time.Time `json:"time"`
+	Workspace string    `json:"workspace,omitempty"`
+	Op        string    `json:"op"`
+	Seq       int64     `json:"seq,omitempty"`
+	Task      *Task     `json:"task,omitempty"`
+	Comments  []Comment `json:"comments,omitempty"`
+	TaskID    int       `json:"task_id,omitempty"`
+	Members   []string  `json:"members,omitempty"`
+	MaxTasks  int       `json:"max_tasks,omitempty"`
+
+	// Template holds a saved template, or only the name of a deleted one
+	Template *TaskTemplate `json:"template,omitempty"`
+
+	// User and Role record a role assignment, an empty role removes it
+	User string `json:"user,omitempty"`
+	Role string `json:"role,omitempty"`
+}
+
+// WriteLog numbers every write of the server with an offset so followers can read them in order and resume
+//
+// The log lives in memory and keeps the latest entries only, a follower that falls further behind
+// starts again from a snapshot. Its random ID changes whenever the history is replaced.
+type WriteLog struct {
+	mu      sync.Mutex
+	id      string
+	entries []WriteEntry
+	next    int64
+	changed chan struct{}
+
+	// persist, when set, stores the entries of every append before the write is answered, entries it
+	// failed to store are kept in 'unstored' and passed to it again with the next append
+	persist  func([]WriteEntry) error
+	unstored []WriteEntry
+}
+
+// maxWriteLogEntries is how many writes the replication log keeps for followers to catch up
+const maxWriteLogEntries = 100000
+
+// errOffsetExpired is returned for an offset the replication log no longer has or never had
+var errOffsetExpired = errors.New("log offset expired")
+
+// errNotStored is returned by writes that were made in memory but could not be stored in the database
+var errNotStored = errors.New("failed to store the change")
+
+// Writes of the server for followers to replicate
+var writeLog = NewWriteLog()
+
+// NewWriteLog creates an empty log with a new ID
+func NewWriteLog() *WriteLog {
+	return &WriteLog{id: randomHex(8), next: 1, changed: make(chan struct{})}
+}
+
+// Append gives the entries the next offsets, stores them and wakes up the readers waiting for them
+//
+// The entries are in the log even when storing them fails, because the write already happened in memory.
+// The error wraps errNotStored, and the entries are stored again with the next append.
+func (l *WriteLog) Append(entries ...WriteEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC()
+	start := len(l.entries)
+	for _, e := range entries {
+		e.Offset = l.next
+		e.Time = now
+		l.next++
+		l.entries = append(l.entries, e)
+	}
+	var err error
+	if l.persist != nil {
+		l.unstored = append(l.unstored, l.entries[start:]...)
+		err = l.persist(l.unstored)
+		if err != nil {
+			slog.Error("failed to store writes", "error", err, "offset", l.unstored[0].Offset, "pending", len(l.unstored))
+			err = fmt.Errorf("%w: %w", errNotStored, err)
+		} else {
+			l.unstored = nil
+		}
+	}
+	if over := len(l.entries) - maxWriteLogEntries; over > 0 {
+		l.entries = slices.Delete(l.entries, 0, over)
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return err
+}
+
+// Stored reports whether every entry has been stored, the database lags behind the memory when it has not
+func (l *WriteLog) Stored() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.unstored) == 0
+}
+
+// Read returns up to 'limit' entries from offset 'from' on, and a channel closed when more are appended
+func (l *WriteLog) Read(from int64, limit int) ([]WriteEntry, <-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	first := l.next - int64(len(l.entries))
+	if from < first || from > l.next {
+		return nil, nil, errOffsetExpired
+	}
+	start := int(from - first)
+	end := min(start+limit, len(l.entries))
+	return slices.Clone(l.entries[start:end]), l.changed, nil
+}
+
+// Position returns the ID of the log and the offset the next write will get
+func (l *WriteLog) Position() (string, int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.id, l.next
+}
+
+// Reset forgets the history after the state was replaced by a snapshot, readers must start again
+func (l *WriteLog) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.id = randomHex(8)
+	l.entries = nil
+	l.unstored = nil
+	l.next = 1
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// StoreState is the complete content of a task store, used to start a follower
+type StoreState struct {
+	Tasks          []Task            `json:"tasks"`
+	Trash          []Task            `json:"trash"`
+	Comments       map[int][]Comment `json:"comments"`
+	Tombstones     []Tombstone       `json:"tombstones"`
+	TombstoneFloor int64             `json:"tombstone_floor"`
+	NextID         int               `json:"next_id"`
+	NextCommentID  int               `json:"next_comment_id"`
+	Seq            int64             `json:"seq"`
+}
+
+// State returns a copy of everything in the store
+func (s *TaskStore) State() StoreState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	comments := make(map[int][]Comment, len(s.comments))
+	for id, thread := range s.comments {
+		comments[id] = slices.Clone(thread)
+	}
+	return StoreState{
+		Tasks:          slices.Clone(s.tasks),
+		Trash:          slices.Clone(s.trash),
+		Comments:       comments,
+		Tombstones:     slices.Clone(s.tombstones),
+		TombstoneFloor: s.tombstoneFloor,
+		NextID:         s.nextID,
+		NextCommentID:  s.nextCommentID,
+		Seq:            s.seq,
+	}
+}
+
+// SetState replaces everything in the store with a state read from the leader
+func (s *TaskStore) SetState(state StoreState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tasks = state.Tasks
+	slices.SortFunc(s.tasks, func(a, b Task) int { return cmp.Compare(a.ID, b.ID) })
+	s.trash = state.Trash
+	s.comments = state.Comments
+	if s.comments == nil {
+		s.comments = map[int][]Comment{}
+	}
+	s.tombstones = state.Tombstones
+	s.tombstoneFloor = state.TombstoneFloor
+	s.nextID = max(state.NextID, 1)
+	s.nextCommentID = max(state.NextCommentID, 1)
+	s.seq = state.Seq
+	s.logged = state.Seq
+	s.purged = nil
+}
+
+// Replicate applies a task entry of the leader's write log, keeping the leader's IDs and sequence numbers
+func (s *TaskStore) Replicate(e WriteEntry) (err error) {
+	s.mu.Lock()
+	defer s.unlock(&err)
+
+	id := e.TaskID
+	if e.Task != nil {
+		id = e.Task.ID
+	}
+	s.tasks = slices.DeleteFunc(s.tasks, func(t Task) bool { return t.ID == id })
+	s.trash = slices.DeleteFunc(s.trash, func(t Task) bool { return t.ID == id })
+	delete(s.comments, id)
+
+	switch e.Op {
+	case opPut:
+		s.insert(*e.Task)
+		s.written = append(s.written, id)
+	case opTrash:
+		s.trash = append(s.trash, *e.Task)
+		if !slices.ContainsFunc(s.tombstones, func(t Tombstone) bool { return t.Seq == e.Seq }) {
+			s.addTombstone(Tombstone{ID: id, Seq: e.Seq, DeletedAt: *cmp.Or(e.Task.DeletedAt, &e.Time)})
+		}
+	case opPurge:
+		s.purged = append(s.purged, id)
+		return nil
+	}
+
+	if len(e.Comments) > 0 {
+		s.comments[id] = e.Comments
+		s.nextCommentID = max(s.nextCommentID, e.Comments[len(e.Comments)-1].ID+1)
+	}
+	s.nextID = max(s.nextID, id+1)
+	s.seq = max(s.seq, e.Seq)
+	return nil
+}
+
+// Replicate applies a workspace entry of the leader's write log
+func (reg *WorkspaceRegistry) Replicate(e WriteEntry) error {
+	if e.Op == opDropWorkspace {
+		err := reg.Delete(e.Workspace)
+		if errors.Is(err, errWorkspaceNotFound) {
+			return nil
+		}
+		return err
+	}
+	_, err := reg.Update(e.Workspace, e.Members, e.MaxTasks)
+	if errors.Is(err, errWorkspaceNotFound) {
+		_, err = reg.Create(e.Workspace, e.Members, e.MaxTasks)
+	}
+	return err
+}
+
+// ReplicaSnapshot is the state of every workspace and the role assignments together with the log position
+// they are consistent with
+type ReplicaSnapshot struct {
+	LogID      string              `json:"log_id"`
+	Offset     int64               `json:"offset"`
+	Workspaces []WorkspaceSnapshot `json:"workspaces"`
+	Roles      map[string]string   `json:"roles,omitempty"`
+}
+
+// WorkspaceSnapshot is the state of one workspace in a snapshot
+type WorkspaceSnapshot struct {
+	Name      string         `json:"name"`
+	Members   []string       `json:"members"`
+	MaxTasks  int            `json:"max_tasks"`
+	State     StoreState     `json:"state"`
+	Templates []TaskTemplate `json:"templates"`
+}
+
+// Snapshot copies every workspace
+//
+// The log position is taken first, so writes that land while copying are both in the copy and in the
+// log after the position. Log entries hold whole tasks, so applying them again on top gives the same result.
+func (reg *WorkspaceRegistry) Snapshot() ReplicaSnapshot {
+	id, offset := writeLog.Position()
+	snapshot := ReplicaSnapshot{LogID: id, Offset: offset, Roles: roles.Assignments()}
+	for _, ws := range reg.List() {
+		snapshot.Workspaces = append(snapshot.Workspaces, WorkspaceSnapshot{Name: ws.Name, Members: ws.Members, MaxTasks: ws.MaxTasks, State: ws.Tasks.State(), Templates: ws.Templates.List(context.Background())})
+	}
+	return snapshot
+}
+
+// Load replaces every workspace with the ones of a snapshot
+func (reg *WorkspaceRegistry) Load(snapshot ReplicaSnapshot) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+
+	loaded := map[string]*Workspace{}
+	for _, s := range snapshot.Workspaces {
+		ws := &Workspace{Name: s.Name, Members: s.Members, MaxTasks: s.MaxTasks, Tasks: NewTaskStore(s.Name, s.MaxTasks), Templates: NewTemplateStore(s.Name)}
+		ws.Tasks.SetState(s.State)
+		ws.Templates.SetTemplates(s.Templates)
+		loaded[s.Name] = ws
+	}
+	if loaded[DefaultWorkspace] == nil {
+		loaded[DefaultWorkspace] = reg.workspaces[DefaultWorkspace]
+	}
+	reg.workspaces = loaded
+}
+
+// Replica follows the write log of a leader, the server is read-only while it does
+type Replica struct {
+	mu          sync.Mutex
+	leader      string
+	token       string
+	logID       string
+	offset      int64
+	lastContact time.Time
+	stop        context.CancelFunc
+	done        chan struct{}
+}
+
+// Replication state of the server, it is a leader unless started with --follow
+var replica = &Replica{}
+
+// replicationStall is how long a follower waits for a line from the leader before it reconnects
+const replicationStall = 45 * time.Second
+
+// Follow starts reading the write log of the leader at the given URL in the background
+func (rp *Replica) Follow(leader, token string) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	ctx, stop := context.WithCancel(context.Background())
+	rp.leader = strings.TrimSuffix(leader, "/")
+	rp.token = token
+	rp.stop = stop
+	rp.done = make(chan struct{})
+	go rp.run(ctx, rp.done)
+}
+
+// Leader returns the URL of the leader, or "" when this server is the leader
+func (rp *Replica) Leader() string {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return rp.leader
+}
+
+// Following reports whether this server is a read-only follower
+func (rp *Replica) Following() bool {
+	return rp.Leader() != ""
+}
+
+// Promote stops following and makes this server a leader that accepts writes, it returns false if it already was one
+func (rp *Replica) Promote() bool {
+	rp.mu.Lock()
+	if rp.leader == "" {
+		rp.mu.Unlock()
+		return false
+	}
+	stop, done := rp.stop, rp.done
+	rp.mu.Unlock()
+
+	// Wait for the entry being applied so no replicated write lands after the first local one
+	stop()
+	<-done
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	slog.Warn("promoted to leader", "former_leader", rp.leader, "offset", rp.offset)
+	rp.leader = ""
+	return true
+}
+
+// run replicates until the context is cancelled, reconnecting with a growing delay after errors
+func (rp *Replica) run(ctx context.Context, done chan struct{}) {
+	defer close(done)
+
+	delay := time.Second
+	for ctx.Err() == nil {
+		start := time.Now()
+		err := rp.stream(ctx)
+		if errors.Is(err, errOffsetExpired) {
+			slog.Warn("no usable position in the leader's log, loading a snapshot")
+			err = rp.resync(ctx)
+		} else if time.Since(start) > replicationStall {
+			// The stream worked for a while, so reconnect quickly
+			delay = time.Second
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			slog.Warn("replication interrupted", "leader", rp.Leader(), "error", err, "retry_in", delay)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, 30*time.Second)
+			continue
+		}
+		delay = time.Second
+	}
+}
+
+// request sends a GET request to the leader
+func (rp *Replica) request(ctx context.Context, path string) (*http.Response, error) {
+	rp.mu.Lock()
+	url, token := rp.leader+path, rp.token
+	rp.mu.Unlock()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		resp.Body.Close()
+		return nil, errOffsetExpired
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("leader answered %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// resync replaces all workspaces with a snapshot of the leader and continues from its log position
+func (rp *Replica) resync(ctx context.Context) error {
+	resp, err := rp.request(ctx, "/replication/snapshot")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var snapshot ReplicaSnapshot
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	workspaces.Load(snapshot)
+	roles.Load(snapshot.Roles)
+	writeLog.Reset()
+	if taskDB != nil {
+		err = taskDB.Save(snapshot)
+		if err != nil {
+			return fmt.Errorf("failed to store snapshot: %w", err)
+		}
+	}
+
+	rp.mu.Lock()
+	rp.logID, rp.offset, rp.lastContact = snapshot.LogID, snapshot.Offset, time.Now()
+	rp.mu.Unlock()
+	slog.Info("replication snapshot loaded", "log_id", snapshot.LogID, "offset", snapshot.Offset, "workspaces", len(snapshot.Workspaces))
+	return nil
+}
+
+// stream reads the leader's write log from the current offset and applies every entry until the connection ends
+func (rp *Replica) stream(ctx context.Context) error {
+	rp.mu.Lock()
+	logID, offset := rp.logID, rp.offset
+	rp.mu.Unlock()
+	if logID == "" {
+		return errOffsetExpired
+	}
+
+	// A leader that stops sending heartbeats may be gone without closing the connection
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stall := time.AfterFunc(replicationStall, cancel)
+	defer stall.Stop()
+
+	resp, err := rp.request(ctx, fmt.Sprintf("/replication/log?log_id=%s&offset=%d", url.QueryEscape(logID), offset))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	slog.Info("replicating", "leader", rp.Leader(), "offset", offset)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	for scanner.Scan() {
+		stall.Reset(replicationStall)
+		var e WriteEntry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return fmt.Errorf("invalid log entry: %w", err)
+		}
+		if e.Op != opHeartbeat {
+			if e.Offset != offset {
+				return fmt.Errorf("expected log offset %d, got %d", offset, e.Offset)
+			}
+			err = applyWriteEntry(e)
+			if err != nil {
+				return fmt.Errorf("failed to apply log entry %d: %w", e.Offset, err)
+			}
+			offset++
+		}
+		rp.mu.Lock()
+		rp.offset, rp.lastContact = offset, time.Now()
+		rp.mu.Unlock()
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("nothing received from the leader for %s", replicationStall)
+	}
+	return cmp.Or(scanner.Err(), io.ErrUnexpectedEOF)
+}
+
+// applyWriteEntry writes an entry of the leader's log to the workspaces of this server
+func applyWriteEntry(e WriteEntry) error {
+	switch e.Op {
+	case opWorkspace, opDropWorkspace:
+		return workspaces.Replicate(e)
+	case opRole:
+		return roles.Replicate(e)
+	case opTemplate, opDropTemplate:
+		if e.Template == nil {
+			return errors.New("entry has no template")
+		}
+		ws, err := workspaces.Get(e.Workspace)
+		if err != nil {
+			return fmt.Errorf("workspace '%s': %w", e.Workspace, err)
+		}
+		return ws.Templates.Replicate(e)
+	case opPut, opTrash:
+		if e.Task == nil {
+			return errors.New("entry has no task")
+		}
+	case opPurge:
+	default:
+		return fmt.Errorf("unknown operation '%s'", e.Op)
+	}
+	ws, err := workspaces.Get(e.Workspace)
+	if err != nil {
+		return fmt.Errorf("workspace '%s': %w", e.Workspace, err)
+	}
+	return ws.Tasks.Replicate(e)
+}
+
+// ReplicationStatus describes the role of the server and how far it has replicated
+type ReplicationStatus struct {
+	Role        string     `json:"role"`
+	LogID       string     `json:"log_id"`
+	Offset      int64      `json:"offset"`
+	Leader      string     `json:"leader,omitempty"`
+	LeaderLogID string     `json:"leader_log_id,omitempty"`
+	LeaderAt    int64      `json:"leader_offset,omitempty"`
+	LastContact *time.Time `json:"last_contact,omitempty"`
+}
+
+// Status returns the replication status of the server
+func (rp *Replica) Status() ReplicationStatus {
+	status := ReplicationStatus{Role: "leader"}
+	status.LogID, status.Offset = writeLog.Position()
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.leader != "" {
+		status.Role = "follower"
+		status.Leader = rp.leader
+		status.LeaderLogID = rp.logID
+		status.LeaderAt = rp.offset
+		if !rp.lastContact.IsZero() {
+			status.LastContact = &rp.lastContact
+		}
+	}
+	return status
+}
+
+// withReadOnly rejects writes while the server follows a leader
+//
+// Signing in and out only changes local sessions and JSON-RPC checks each method, so they stay open.
+func withReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login", "/logout", "/rpc", "/replication/promote":
+			next.ServeHTTP(w, r)
+			return
+		}
+		if leader := replica.Leader(); leader != "" && !safeMethod(r.Method) {
+			w.Header().Set("Retry-After", "5")
+			httpError(w, r, "This server is a read-only follower, send writes to the leader at "+leader+".", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleReplicationLog streams the write log as JSON lines from '?offset=', sending heartbeats while there are no writes
+//
+// A '?log_id=' that does not match the current log, or an offset the log no longer has, is answered with
+// 410 Gone and the follower has to start again from a snapshot.
+func handleReplicationLog(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.ParseInt(cmp.Or(r.URL.Query().Get("offset"), "1"), 10, 64)
+	if err != nil {
+		httpError(w, r, "Invalid offset.", http.StatusBadRequest)
+		return
+	}
+	logID, _ := writeLog.Position()
+	if id := r.URL.Query().Get("log_id"); id != "" && id != logID {
+		httpError(w, r, "The log was replaced, load a snapshot.", http.StatusGone)
+		return
+	}
+	entries, changed, err := writeLog.Read(offset, 500)
+	if err != nil {
+		httpError(w, r, "Log offset is no longer available, load a snapshot.", http.StatusGone)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	heartbeat := time.NewTicker(replicationStall / 3)
+	defer heartbeat.Stop()
+
+	for {
+		for _, e := range entries {
+			err := enc.Encode(e)
+			if err != nil {
+				return
+			}
+		}
+		offset += int64(len(entries))
+		rc.Flush()
+
+		if len(entries) == 0 {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				err := enc.Encode(WriteEntry{Op: opHeartbeat, Offset: offset, Time: time.Now().UTC()})
+				if err != nil {
+					return
+				}
+				rc.Flush()
+			case <-changed:
+			}
+		}
+
+		entries, changed, err = writeLog.Read(offset, 500)
+		if err != nil {
+			// The log was reset or the follower fell too far behind, ending the stream makes it reconnect
+			return
+		}
+	}
+}
+
+// handleReplicationSnapshot returns every workspace and the log offset to follow from
+func handleReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, workspaces.Snapshot())
+}
+
+// handleReplicationStatus returns the role of the server and its log position
+func handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, replica.Status())
+}
+
+// handlePromote makes a follower the leader, the old leader must be stopped first or writes will diverge
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	if !replica.Promote() {
+		httpError(w, r, "This server is already a leader.", http.StatusConflict)
+		return
+	}
+	slog.InfoContext(r.Context(), "promotion requested", "user", requestUser(r))
+	writeJSON(w, http.StatusOK, replica.Status())
+}
+
+// runPromote asks a follower to become the leader
+func runPromote(args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:4001", "URL of the follower to promote")
+	token := fs.String("token", os.Getenv("TASKS_TOKEN"), "API token of an admin when the follower checks tokens")
+	fs.Parse(args)
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(*server, "/")+"/replication/promote", nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Printf("%s is now the leader: %s", *server, body)
+	return nil
+}
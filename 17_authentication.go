@@ -0,0 +1,700 @@
+// Authentication and authorization in Go:
+// - Authentication finds out who the caller is, here from an 'Authorization: Bearer <token>' header
+// - Store only a hash of each token ('crypto/sha256') so the users file does not contain working secrets
+// - Authorization decides what the caller may do, roles group permissions so users are easy to manage
+// - Answer '401 Unauthorized' when the caller is unknown and '403 Forbidden' when they lack a permission
+
+// Sessions in Go:
+// - Browsers sign in once with a password and then send a random session ID in a cookie with every request
+// - Hash passwords with a salt and many iterations ('crypto/pbkdf2') so stolen hashes are slow to crack
+// - Mark the cookie 'Secure', 'HttpOnly' and 'SameSite' so it only travels over HTTPS, is hidden from scripts and stays on this site
+// - Keep sessions on the server with an expiry so they can be ended, and issue a new ID on every login
+// - Forms carry a CSRF token because the browser attaches the cookie to requests other sites trigger too
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserAccount is a user who can sign in, as stored in the users file
+type UserAccount struct {
+	Name         string `json:"name"`
+	TokenSHA256  string `json:"token_sha256,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Role         string `json:"role"`
+}
+
+// UserStore holds the accounts of the users file, looked up by the hash of their API token or by name
+type UserStore struct {
+	byToken map[string]UserAccount
+	byName  map[string]UserAccount
+}
+
+// Users of the server, nil when no users file is configured and callers name themselves with 'X-User'
+var users *UserStore
+
+// loadUsers reads a users file of the form '{"users": [{"name": ..., "token_sha256": ..., "password_hash": ..., "role": ...}]}'
+func loadUsers(path string) (*UserStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users file '%s': %w", path, err)
+	}
+	var file struct {
+		Users []UserAccount `json:"users"`
+	}
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse users file '%s': %w", path, err)
+	}
+
+	store := &UserStore{byToken: map[string]UserAccount{}, byName: map[string]UserAccount{}}
+	for _, account := range file.Users {
+		if account.Name == "" || (account.TokenSHA256 == "" && account.PasswordHash == "") {
+			return nil, fmt.Errorf("users file '%s': every user needs a name and a token_sha256 or password_hash", path)
+		}
+		if account.TokenSHA256 != "" && len(account.TokenSHA256) != 64 {
+			return nil, fmt.Errorf("users file '%s': token_sha256 of user '%s' must be 64 hex characters", path, account.Name)
+		}
+		if account.PasswordHash != "" {
+			_, _, _, err := parsePasswordHash(account.PasswordHash)
+			if err != nil {
+				return nil, fmt.Errorf("users file '%s': password_hash of user '%s': %w", path, account.Name, err)
+			}
+		}
+		if account.Role != "" && rolePermissions[account.Role] == nil {
+			return nil, fmt.Errorf("users file '%s': unknown role '%s' for user '%s'", path, account.Role, account.Name)
+		}
+		if _, ok := store.byName[account.Name]; ok {
+			return nil, fmt.Errorf("users file '%s': user '%s' is listed twice", path, account.Name)
+		}
+		store.byName[account.Name] = account
+		if account.TokenSHA256 != "" {
+			store.byToken[strings.ToLower(account.TokenSHA256)] = account
+		}
+	}
+	return store, nil
+}
+
+// Authenticate returns the account whose API token hashes to the stored hash
+func (s *UserStore) Authenticate(token string) (UserAccount, bool) {
+	// Only hashes are stored, so a leaked users file does not leak working tokens
+	sum := sha256.Sum256([]byte(token))
+	account, ok := s.byToken[hex.EncodeToString(sum[:])]
+	return account, ok
+}
+
+// Login returns the account of a user if the password matches its stored hash
+func (s *UserStore) Login(name, password string) (UserAccount, bool) {
+	account, ok := s.byName[name]
+	encoded := account.PasswordHash
+	if !ok || encoded == "" {
+		// Hash anyway so the response time does not tell which user names exist
+		encoded = dummyPasswordHash()
+	}
+	return account, checkPassword(encoded, password) && ok && account.PasswordHash != ""
+}
+
+// Settings of the password hashes created by 'hash-password'
+const (
+	passwordIterations = 600_000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+)
+
+// dummyPasswordHash is checked for unknown users so they take as long to reject as wrong passwords
+var dummyPasswordHash = sync.OnceValue(func() string { return hashPassword(randomHex(16)) })
+
+// hashPassword derives a salted key from a password as 'pbkdf2-sha256$<iterations>$<salt>$<key>'
+func hashPassword(password string) string {
+	salt := make([]byte, passwordSaltSize)
+	rand.Read(salt)
+	key, _ := pbkdf2.Key(sha256.New, password, salt, passwordIterations, passwordKeySize)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+// parsePasswordHash splits a hash created by hashPassword into its iterations, salt and key
+func parsePasswordHash(encoded string) (int, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, errors.New("expected 'pbkdf2-sha256$<iterations>$<salt>$<key>'")
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errors.New("invalid iteration count")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil || len(salt) == 0 {
+		return 0, nil, nil, errors.New("invalid salt")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("invalid key")
+	}
+	return iterations, salt, key, nil
+}
+
+// checkPassword reports whether a password matches a hash created by hashPassword
+func checkPassword(encoded, password string) bool {
+	iterations, salt, want, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+	got, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	// Compare in constant time so the response time does not reveal how much of the key matched
+	return err == nil && subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// Session is a signed in browser, remembered on the server and named by a random cookie
+type Session struct {
+	ID      string
+	User    string
+	CSRF    string
+	Expires time.Time
+}
+
+// sessionCookie is the name of the cookie holding the session ID
+const sessionCookie = "tasks_session"
+
+// SessionStore keeps the sessions of signed in browsers in memory until they expire
+type SessionStore struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	sessions map[string]*Session
+}
+
+// NewSessionStore creates a store whose sessions last for the given duration after login
+func NewSessionStore(ttl time.Duration) *SessionStore {
+	return &SessionStore{ttl: ttl, sessions: map[string]*Session{}}
+}
+
+// Sessions of signed in browsers, replaced with the configured lifetime in runServer
+var sessions = NewSessionStore(12 * time.Hour)
+
+// Create starts a new session for a user, dropping expired sessions along the way
+func (s *SessionStore) Create(user string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+	session := &Session{ID: randomHex(32), User: user, CSRF: randomHex(32), Expires: now.Add(s.ttl)}
+	s.sessions[session.ID] = session
+	return session
+}
+
+// Get returns a session that has not expired yet
+func (s *SessionStore) Get(id string) (*Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, false
+	}
+	// The expiry is enforced here, the cookie's own lifetime is only a hint to the browser
+	if time.Now().After(session.Expires) {
+		delete(s.sessions, id)
+		return nil, false
+	}
+	return session, true
+}
+
+// Delete ends a session
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// sessionFrom returns the session of a request signed in with a cookie
+func sessionFrom(ctx context.Context) (*Session, bool) {
+	session, ok := ctx.Value(sessionKey).(*Session)
+	return session, ok
+}
+
+// requestSession returns the unexpired session named by the cookie of a request
+func requestSession(r *http.Request) (*Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil, false
+	}
+	return sessions.Get(cookie.Value)
+}
+
+// setSessionCookie sends the session cookie, or removes it when session is nil
+func setSessionCookie(w http.ResponseWriter, session *Session) {
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if session == nil {
+		cookie.MaxAge = -1
+	} else {
+		cookie.Value = session.ID
+		cookie.MaxAge = int(time.Until(session.Expires).Seconds())
+	}
+	http.SetCookie(w, cookie)
+}
+
+// withAuth identifies the caller from an 'Authorization: Bearer' token or a session cookie when a users file is configured
+//
+// Calendar apps cannot send headers, so '.ics' feeds also accept the token as '?access_token='.
+// Browsers that are not signed in are sent to the login page instead of getting a 401.
+func withAuth(store *UserStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if store == nil || r.URL.Path == "/" || r.URL.Path == "/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok && r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, ".ics") && r.URL.Query().Has("access_token") {
+			token, ok = r.URL.Query().Get("access_token"), true
+		}
+		if ok {
+			account, found := store.Authenticate(strings.TrimSpace(token))
+			if !found {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="tasks"`)
+				httpError(w, r, "Authentication required.", http.StatusUnauthorized)
+				return
+			}
+			slog.DebugContext(r.Context(), "request authenticated", "user", account.Name)
+			ctx := context.WithValue(r.Context(), userKey, account.Name)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		session, found := requestSession(r)
+		if !found {
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tasks"`)
+			httpError(w, r, "Authentication required.", http.StatusUnauthorized)
+			return
+		}
+
+		// Cookies are sent along with requests other sites trigger, so changes must prove they came from our own pages
+		if !safeMethod(r.Method) && !validCSRF(r, session) {
+			httpError(w, r, "Missing or invalid CSRF token.", http.StatusForbidden)
+			return
+		}
+
+		slog.DebugContext(r.Context(), "request authenticated", "user", session.User, "session", true)
+		ctx := context.WithValue(r.Context(), userKey, session.User)
+		ctx = context.WithValue(ctx, sessionKey, session)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// safeMethod reports whether a method only reads and so needs no CSRF token
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// validCSRF checks the CSRF token of a session in the 'X-CSRF-Token' header or the 'csrf_token' form field
+func validCSRF(r *http.Request, session *Session) bool {
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		token = r.PostFormValue("csrf_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRF)) == 1
+}
+
+// requestUser returns the name of the authenticated caller, or the 'X-User' header when authentication is off
+func requestUser(r *http.Request) string {
+	if user, ok := r.Context().Value(userKey).(string); ok {
+		return user
+	}
+	if users != nil {
+		return ""
+	}
+	return strings.TrimSpace(r.Header.Get("X-User"))
+}
+
+// Permission names an action a role may take
+type Permission string
+
+// Permissions checked by the routes
+const (
+	PermReadTasks        Permission = "tasks:read"
+	PermWriteTasks       Permission = "tasks:write"
+	PermManageWorkspaces Permission = "workspaces:manage"
+	PermManageRoles      Permission = "roles:manage"
+)
+
+// Roles and the permissions they grant
+const (
+	RoleViewer = "viewer"
+	RoleEditor = "editor"
+	RoleAdmin  = "admin"
+)
+
+// rolePermissions lists the permissions of every role
+var rolePermissions = map[string][]Permission{
+	RoleViewer: {PermReadTasks},
+	RoleEditor: {PermReadTasks, PermWriteTasks},
+	RoleAdmin:  {PermReadTasks, PermWriteTasks, PermManageWorkspaces, PermManageRoles},
+}
+
+// errLastAdmin is returned when a change would leave the server without an admin
+var errLastAdmin = errors.New("at least one admin must remain")
+
+// RoleStore holds the role assigned to each user, users without one get the default role
+//
+// Assignments changed through the API go to the replication log, so they are stored and replicated like
+// task writes. An empty role records that an assignment from the users file was removed.
+type RoleStore struct {
+	mu          sync.RWMutex
+	defaultRole string
+	assigned    map[string]string
+}
+
+// Role assignments of the server, seeded from the users file and changed through the API
+var roles = NewRoleStore(RoleAdmin)
+
+// NewRoleStore creates a store without assignments
+func NewRoleStore(defaultRole string) *RoleStore {
+	return &RoleStore{defaultRole: defaultRole, assigned: map[string]string{}}
+}
+
+// RoleOf returns the role of a user
+func (s *RoleStore) RoleOf(user string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if role := s.assigned[user]; role != "" {
+		return role
+	}
+	return s.defaultRole
+}
+
+// Assign gives a user a role, an empty role removes the assignment so the default role applies again
+func (s *RoleStore) Assign(user, role string) error {
+	if role != "" && rolePermissions[role] == nil {
+		return fmt.Errorf("unknown role '%s'", role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Refuse to take away the last explicit admin, nobody could assign roles afterwards
+	if s.assigned[user] == RoleAdmin && role != RoleAdmin && s.defaultRole != RoleAdmin {
+		admins := 0
+		for _, r := range s.assigned {
+			if r == RoleAdmin {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return errLastAdmin
+		}
+	}
+
+	s.assigned[user] = role
+	return writeLog.Append(WriteEntry{Op: opRole, User: user, Role: role})
+}
+
+// Load sets assignments read from the users file, the database or a leader's snapshot, without logging them
+//
+// Assignments it does not mention are kept, so stored changes can be loaded on top of the users file.
+func (s *RoleStore) Load(assigned map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for user, role := range assigned {
+		if role == "" || rolePermissions[role] != nil {
+			s.assigned[user] = role
+		}
+	}
+}
+
+// Assignments returns a copy of every assignment, including the removed ones
+func (s *RoleStore) Assignments() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return maps.Clone(s.assigned)
+}
+
+// Replicate applies a role entry of the leader's write log
+func (s *RoleStore) Replicate(e WriteEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.assigned[e.User] = e.Role
+	return writeLog.Append(e)
+}
+
+// roleAssignment is a user and the role assigned to them
+type roleAssignment struct {
+	User string `json:"user"`
+	Role string `json:"role"`
+}
+
+// List returns the assignments sorted by user
+func (s *RoleStore) List() []roleAssignment {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := []roleAssignment{}
+	for user, role := range s.assigned {
+		if role != "" {
+			list = append(list, roleAssignment{user, role})
+		}
+	}
+	slices.SortFunc(list, func(a, b roleAssignment) int { return strings.Compare(a.User, b.User) })
+	return list
+}
+
+// Can reports whether a user's role grants a permission
+func (s *RoleStore) Can(user string, perm Permission) bool {
+	return slices.Contains(rolePermissions[s.RoleOf(user)], perm)
+}
+
+// allow only lets requests through whose caller has the permission
+func allow(perm Permission, next http.HandlerFunc) http.Handler {
+	return allowByMethod(perm, perm, next)
+}
+
+// allowByMethod checks 'read' for GET and HEAD requests and 'write' for every other method
+func allowByMethod(read, write Permission, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		perm := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			perm = read
+		}
+		user := requestUser(r)
+		if !roles.Can(user, perm) {
+			slog.InfoContext(r.Context(), "permission denied", "user", user, "permission", string(perm))
+			httpError(w, r, fmt.Sprintf("Permission '%s' is required, your role '%s' does not have it.", perm, roles.RoleOf(user)), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleListRoles returns the roles, their permissions and the assignments
+func handleListRoles(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		DefaultRole string                  `json:"default_role"`
+		Roles       map[string][]Permission `json:"roles"`
+		Assignments []roleAssignment        `json:"assignments"`
+	}{roles.RoleOf(""), rolePermissions, roles.List()})
+}
+
+// handleAssignRole sets the role of the user named in the path
+func handleAssignRole(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || req.Role == "" {
+		httpError(w, r, "Invalid JSON format, expected {\"role\": \"viewer|editor|admin\"}.", http.StatusBadRequest)
+		return
+	}
+
+	user := r.PathValue("user")
+	err = roles.Assign(user, req.Role)
+	if storeError(w, r, err) {
+		return
+	}
+	if errors.Is(err, errLastAdmin) {
+		httpError(w, r, "Cannot change role: "+err.Error()+".", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Invalid role: "+err.Error()+".", http.StatusBadRequest)
+		return
+	}
+	slog.InfoContext(r.Context(), "role assigned", "user", user, "role", req.Role, "by", requestUser(r))
+	writeJSON(w, http.StatusOK, roleAssignment{user, req.Role})
+}
+
+// handleRemoveRole removes the role assignment of a user so the default role applies
+func handleRemoveRole(w http.ResponseWriter, r *http.Request) {
+	user := r.PathValue("user")
+	err := roles.Assign(user, "")
+	if storeError(w, r, err) {
+		return
+	}
+	if err != nil {
+		httpError(w, r, "Cannot change role: "+err.Error()+".", http.StatusConflict)
+		return
+	}
+	slog.InfoContext(r.Context(), "role removed", "user", user, "by", requestUser(r))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runGenToken prints a new API token and the users file entry that accepts it
+func runGenToken(args []string) error {
+	fs := flag.NewFlagSet("gen-token", flag.ExitOnError)
+	name := fs.String("user", "", "name of the user the token is for")
+	role := fs.String("role", RoleEditor, "role of the user: viewer, editor or admin")
+	fs.Parse(args)
+
+	if *name == "" {
+		return errors.New("--user is required")
+	}
+	if rolePermissions[*role] == nil {
+		return fmt.Errorf("unknown role '%s'", *role)
+	}
+
+	token := randomHex(32)
+	sum := sha256.Sum256([]byte(token))
+	entry, _ := json.Marshal(UserAccount{Name: *name, TokenSHA256: hex.EncodeToString(sum[:]), Role: *role})
+	fmt.Println("Token (give this to the user, it is not stored):")
+	fmt.Println(token)
+	fmt.Println()
+	fmt.Println("Add this entry to the \"users\" list of the users file:")
+	fmt.Println(string(entry))
+	return nil
+}
+
+// runHashPassword reads a password from standard input and prints its salted hash for the users file
+func runHashPassword(args []string) error {
+	fs := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	fs.Parse(args)
+
+	// Reading from standard input keeps the password out of the shell history and the process list
+	fmt.Fprintln(os.Stderr, "Password:")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if len(password) < 8 {
+		return errors.New("password must have at least 8 characters")
+	}
+
+	fmt.Println("Add this as \"password_hash\" to the user's entry in the users file:")
+	fmt.Println(hashPassword(password))
+	return nil
+}
+
+// loginPage is the HTML form to sign in with a user name and password
+var loginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Sign in - Tasks</title>
+<style>
+body { font-family: sans-serif; max-width: 25em; margin: 4em auto; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Sign in</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>
+{{end}}<form method="post" action="/login">
+<input type="hidden" name="next" value="{{.Next}}">
+<p><label>User <input name="user" value="{{.User}}" autocomplete="username" required autofocus></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+<p><button type="submit">Sign in</button></p>
+</form>
+</body>
+</html>
+`))
+
+// writeLoginPage shows the login form with an optional error message
+func writeLoginPage(w http.ResponseWriter, r *http.Request, status int, user, next, message string) {
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; base-uri 'none'; frame-ancestors 'none'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := loginPage.Execute(w, struct{ User, Next, Error string }{user, next, message})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "rendering page failed", "error", err)
+	}
+}
+
+// localRedirect returns next if it is a path on this server, so the login form cannot send users to another site
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.ContainsAny(next, "\\\r\n") {
+		return "/ui"
+	}
+	return next
+}
+
+// handleLoginPage shows the login form
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	if users == nil {
+		httpError(w, r, "Sign in is not enabled, the server has no users file.", http.StatusNotFound)
+		return
+	}
+	writeLoginPage(w, r, http.StatusOK, "", localRedirect(r.URL.Query().Get("next")), "")
+}
+
+// handleLogin checks a user name and password and starts a new session
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if users == nil {
+		httpError(w, r, "Sign in is not enabled, the server has no users file.", http.StatusNotFound)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	err := r.ParseForm()
+	if err != nil {
+		httpError(w, r, "Error parsing form data.", http.StatusBadRequest)
+		return
+	}
+	name := strings.TrimSpace(r.PostFormValue("user"))
+	next := localRedirect(r.PostFormValue("next"))
+
+	account, ok := users.Login(name, r.PostFormValue("password"))
+	if !ok {
+		slog.WarnContext(r.Context(), "login failed", "user", name)
+		writeLoginPage(w, r, http.StatusUnauthorized, name, next, "Wrong user name or password.")
+		return
+	}
+
+	// Always issue a new session ID so one planted in the browser before login cannot be taken over
+	if old, ok := requestSession(r); ok {
+		sessions.Delete(old.ID)
+	}
+	session := sessions.Create(account.Name)
+	setSessionCookie(w, session)
+	slog.InfoContext(r.Context(), "user logged in", "user", account.Name)
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+// handleLogout ends the session of the browser
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if session, ok := sessionFrom(r.Context()); ok {
+		sessions.Delete(session.ID)
+		slog.InfoContext(r.Context(), "user logged out", "user", session.User)
+	}
+	setSessionCookie(w, nil)
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
@@ -0,0 +1,514 @@
+// Rendering Markdown safely in Go:
+// - Never copy HTML from user input into a page, escape all text with 'html.EscapeString'
+// - Only keep links whose scheme is known to be safe, 'javascript:' links run script when clicked
+// - 'html/template' escapes values automatically, wrap trusted HTML in 'template.HTML' to insert it as is
+// - A 'Content-Security-Policy' header is a second line of defense that stops inline scripts from running
+
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// renderMarkdown converts a subset of CommonMark to HTML that is safe to show in a page
+//
+// Supported are paragraphs, ATX headings, block quotes, lists, fenced code blocks, thematic breaks,
+// emphasis, code spans, links and autolinks. Raw HTML is never passed through, it is shown as text,
+// and links only keep URLs with a safe scheme so a description cannot run script in the reader's browser.
+func renderMarkdown(source string) string {
+	source = strings.ReplaceAll(source, "\r\n", "\n")
+	source = strings.ReplaceAll(source, "\r", "\n")
+	source = strings.ReplaceAll(source, "\x00", "\uFFFD")
+
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(source, "\n"), 0, false)
+	return b.String()
+}
+
+// maxMarkdownDepth limits how deeply quotes and lists nest so hostile input cannot exhaust the stack
+const maxMarkdownDepth = 16
+
+// Patterns for the start of block elements, allowing up to 3 spaces of indentation
+var (
+	mdHeading     = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	mdBreak       = regexp.MustCompile(`^ {0,3}(?:(?:-[ \t]*){3,}|(?:\*[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	mdFence       = regexp.MustCompile("^( {0,3})(`{3,}|~{3,})[ \t]*([^`]*)$")
+	mdQuote       = regexp.MustCompile(`^ {0,3}> ?`)
+	mdBullet      = regexp.MustCompile(`^( {0,3})([-*+])([ \t]+|$)`)
+	mdOrdered     = regexp.MustCompile(`^( {0,3})(\d{1,9})([.)])([ \t]+|$)`)
+	mdBlank       = regexp.MustCompile(`^[ \t]*$`)
+	mdIndentation = regexp.MustCompile(`^[ \t]*`)
+	mdLanguage    = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{1,32}$`)
+)
+
+// renderBlocks writes the block elements of a list of lines, paragraphs of tight list items have no '<p>' tags
+func renderBlocks(b *strings.Builder, lines []string, depth int, tight bool) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case mdBlank.MatchString(line):
+			i++
+
+		case mdFence.MatchString(line):
+			m := mdFence.FindStringSubmatch(line)
+			indent, fence, info := len(m[1]), m[2], strings.Fields(m[3])
+			b.WriteString("<pre><code")
+			if len(info) > 0 && mdLanguage.MatchString(info[0]) {
+				b.WriteString(` class="language-` + info[0] + `"`)
+			}
+			b.WriteString(">")
+			i++
+			for ; i < len(lines); i++ {
+				trimmed := strings.TrimLeft(lines[i], " ")
+				if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]+" \t") == "" {
+					i++
+					break
+				}
+				// Remove the indentation of the opening fence from every content line
+				content := lines[i]
+				for n := 0; n < indent && strings.HasPrefix(content, " "); n++ {
+					content = content[1:]
+				}
+				b.WriteString(html.EscapeString(content) + "\n")
+			}
+			b.WriteString("</code></pre>\n")
+
+		case mdHeading.MatchString(line):
+			m := mdHeading.FindStringSubmatch(line)
+			level := strconv.Itoa(len(m[1]))
+			b.WriteString("<h" + level + ">")
+			renderInline(b, m[2], 0)
+			b.WriteString("</h" + level + ">\n")
+			i++
+
+		case mdBreak.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+
+		case mdQuote.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && mdQuote.MatchString(lines[i]); i++ {
+				quoted = append(quoted, mdQuote.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			if depth < maxMarkdownDepth {
+				renderBlocks(b, quoted, depth+1, false)
+			} else {
+				renderParagraph(b, quoted, false)
+			}
+			b.WriteString("</blockquote>\n")
+
+		case mdBullet.MatchString(line) || mdOrdered.MatchString(line):
+			i = renderList(b, lines, i, depth)
+
+		default:
+			// A paragraph runs until a blank line or the start of another block
+			start := i
+			for i++; i < len(lines); i++ {
+				next := lines[i]
+				if mdBlank.MatchString(next) || mdFence.MatchString(next) || mdHeading.MatchString(next) ||
+					mdBreak.MatchString(next) || mdQuote.MatchString(next) || mdBullet.MatchString(next) {
+					break
+				}
+				// Only a list starting at 1 may interrupt a paragraph, so "in 2024. we" stays text
+				if m := mdOrdered.FindStringSubmatch(next); m != nil && m[2] == "1" {
+					break
+				}
+			}
+			renderParagraph(b, lines[start:i], tight)
+		}
+	}
+}
+
+// renderParagraph writes lines of text as one paragraph
+func renderParagraph(b *strings.Builder, lines []string, tight bool) {
+	trimmed := make([]string, len(lines))
+	for j, line := range lines {
+		trimmed[j] = strings.TrimLeft(line, " \t")
+	}
+	text := strings.TrimRight(strings.Join(trimmed, "\n"), " \t")
+	if tight {
+		renderInline(b, text, 0)
+		b.WriteString("\n")
+		return
+	}
+	b.WriteString("<p>")
+	renderInline(b, text, 0)
+	b.WriteString("</p>\n")
+}
+
+// renderList writes the list starting at line i and returns the index of the first line after it
+func renderList(b *strings.Builder, lines []string, i, depth int) int {
+	ordered := mdOrdered.MatchString(lines[i])
+	marker := func(line string) (int, string, bool) {
+		if ordered {
+			if m := mdOrdered.FindStringSubmatch(line); m != nil {
+				return len(m[0]), m[3], true
+			}
+		} else if m := mdBullet.FindStringSubmatch(line); m != nil {
+			return len(m[0]), m[2], true
+		}
+		return 0, "", false
+	}
+	_, kind, _ := marker(lines[i])
+
+	tag := "ul"
+	if ordered {
+		tag = "ol"
+		start, _ := strconv.Atoi(mdOrdered.FindStringSubmatch(lines[i])[2])
+		if start != 1 {
+			b.WriteString(`<ol start="` + strconv.Itoa(start) + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+
+	// Collect the items first, a blank line anywhere between them makes the whole list loose
+	var items [][]string
+	loose := false
+	for i < len(lines) {
+		width, k, ok := marker(lines[i])
+		if !ok || k != kind {
+			break
+		}
+
+		// The item holds its first line and every following line indented at least as far as its content,
+		// plus lazy continuation lines of its paragraph
+		item := []string{lines[i][width:]}
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if mdBlank.MatchString(line) {
+				// A blank line continues the item only when indented content follows
+				if i+1 < len(lines) && len(mdIndentation.FindString(lines[i+1])) >= width {
+					loose = true
+					item = append(item, "")
+					continue
+				}
+				break
+			}
+			if len(mdIndentation.FindString(line)) >= width {
+				item = append(item, line[width:])
+				continue
+			}
+			if startsBlock(line) {
+				break
+			}
+			item = append(item, line)
+		}
+		items = append(items, item)
+
+		// A blank line between two items keeps the list going
+		if i+1 < len(lines) && mdBlank.MatchString(lines[i]) {
+			if _, k, ok := marker(lines[i+1]); ok && k == kind {
+				loose = true
+				i++
+			}
+		}
+	}
+
+	for _, item := range items {
+		b.WriteString("<li>")
+		if depth < maxMarkdownDepth {
+			renderBlocks(b, item, depth+1, !loose)
+		} else {
+			renderInline(b, strings.Join(item, "\n"), 0)
+		}
+		b.WriteString("</li>\n")
+	}
+	b.WriteString("</" + tag + ">\n")
+	return i
+}
+
+// startsBlock reports whether a line opens a block other than a paragraph
+func startsBlock(line string) bool {
+	return mdFence.MatchString(line) || mdHeading.MatchString(line) || mdBreak.MatchString(line) ||
+		mdQuote.MatchString(line) || mdBullet.MatchString(line) || mdOrdered.MatchString(line)
+}
+
+// renderInline writes text with code spans, emphasis, links and line breaks, escaping everything else
+//
+// Emphasis and link text are rendered by recursive calls, below maxMarkdownDepth of them their markup is shown as text.
+func renderInline(b *strings.Builder, s string, depth int) {
+	// The closing brackets and parentheses of links are found once, so no character is scanned again for every '[',
+	// and a code span length without a closing run is not searched for again
+	var brackets, parens map[int]int
+	var unclosedCode map[int]bool
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n':
+			b.WriteString("<br>\n")
+			i += 2
+
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("!\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~", s[i+1]) >= 0:
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+
+		case c == '`':
+			// A code span ends at the next run of exactly as many backticks
+			n := 0
+			for i+n < len(s) && s[i+n] == '`' {
+				n++
+			}
+			fence := s[i : i+n]
+			end := -1
+			for j := i + n; j < len(s) && !unclosedCode[n]; {
+				k := strings.Index(s[j:], fence)
+				if k < 0 {
+					break
+				}
+				k += j
+				if k+n >= len(s) || s[k+n] != '`' {
+					end = k
+					break
+				}
+				for k < len(s) && s[k] == '`' {
+					k++
+				}
+				j = k
+			}
+			if end < 0 {
+				if unclosedCode == nil {
+					unclosedCode = map[int]bool{}
+				}
+				unclosedCode[n] = true
+				b.WriteString(fence)
+				i += n
+				continue
+			}
+			code := strings.ReplaceAll(s[i+n:end], "\n", " ")
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+				code = code[1 : len(code)-1]
+			}
+			b.WriteString("<code>" + html.EscapeString(code) + "</code>")
+			i = end + n
+
+		case (c == '*' || c == '_') && depth < maxMarkdownDepth:
+			n := 1
+			if i+1 < len(s) && s[i+1] == c {
+				n = 2
+			}
+			delim := s[i : i+n]
+			end := findEmphasisEnd(s, i, delim)
+			if end < 0 {
+				b.WriteString(delim)
+				i += n
+				continue
+			}
+			tag := "em"
+			if n == 2 {
+				tag = "strong"
+			}
+			b.WriteString("<" + tag + ">")
+			renderInline(b, s[i+n:end], depth+1)
+			b.WriteString("</" + tag + ">")
+			i = end + n
+
+		case (c == '[' || (c == '!' && i+1 < len(s) && s[i+1] == '[')) && depth < maxMarkdownDepth:
+			// Images are shown as links so a description cannot load remote content into the page
+			start := i
+			if c == '!' {
+				start++
+			}
+			if brackets == nil {
+				brackets, parens = matchPairs(s, '[', ']'), matchPairs(s, '(', ')')
+			}
+			text, href, title, next, ok := parseLink(s, start, brackets, parens)
+			if !ok {
+				b.WriteString(html.EscapeString(s[i : start+1]))
+				i = start + 1
+				continue
+			}
+			writeLink(b, href, title, func() { renderInline(b, text, depth+1) })
+			i = next
+
+		case c == '<':
+			// Autolinks like <https://example.com> or <me@example.com>, the search stops at the next '<' or space
+			// because neither may appear in the target
+			end := strings.IndexAny(s[i+1:], "<> \t\n")
+			if end >= 0 && s[i+1+end] == '>' {
+				target := s[i+1 : i+1+end]
+				if mdScheme.MatchString(target) {
+					writeLink(b, target, "", func() { b.WriteString(html.EscapeString(target)) })
+					i += end + 2
+					continue
+				}
+				if mdEmail.MatchString(target) {
+					writeLink(b, "mailto:"+target, "", func() { b.WriteString(html.EscapeString(target)) })
+					i += end + 2
+					continue
+				}
+			}
+			b.WriteString("&lt;")
+			i++
+
+		case c == '\n':
+			b.WriteString("\n")
+			i++
+
+		default:
+			// Copy plain text up to the next character that may start markup
+			j := i + 1
+			for j < len(s) && strings.IndexByte("\\`*_[!<\n", s[j]) < 0 {
+				j++
+			}
+			// Entities such as '&amp;' are decoded first so they are not escaped twice
+			text := html.UnescapeString(s[i:j])
+			if j < len(s) && s[j] == '\n' {
+				// Two trailing spaces make a hard line break, other trailing spaces are dropped
+				b.WriteString(html.EscapeString(strings.TrimRight(text, " ")))
+				if strings.HasSuffix(text, "  ") {
+					b.WriteString("<br>")
+				}
+				i = j
+				continue
+			}
+			b.WriteString(html.EscapeString(text))
+			i = j
+		}
+	}
+}
+
+// Patterns for the targets of autolinks
+var (
+	mdScheme = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]{1,31}:[^\s<>]*$`)
+	mdEmail  = regexp.MustCompile(`^[A-Za-z0-9.!#$%&'*+/=?^_{|}~-]+@[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?(?:\.[A-Za-z0-9](?:[A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+)
+
+// findEmphasisEnd returns the index of the delimiter closing emphasis opened at i, or -1
+func findEmphasisEnd(s string, i int, delim string) int {
+	n := len(delim)
+	// An opening delimiter must be followed by text, and '_' must not start inside a word
+	if i+n >= len(s) || unicode.IsSpace(rune(s[i+n])) {
+		return -1
+	}
+	if delim[0] == '_' && i > 0 && isWordByte(s[i-1]) {
+		return -1
+	}
+	for j := i + n + 1; j+n <= len(s); j++ {
+		if s[j] == '\\' {
+			// Skip escaped characters so '\*' never closes emphasis
+			j++
+			continue
+		}
+		if s[j:j+n] != delim {
+			continue
+		}
+		// A single delimiter must not be part of a double one
+		if n == 1 && j+1 < len(s) && s[j+1] == delim[0] {
+			j++
+			continue
+		}
+		if unicode.IsSpace(rune(s[j-1])) {
+			// A delimiter between a space and text opens emphasis of its own, stopping there scans
+			// every character once instead of once for each opening delimiter before it
+			if j+n < len(s) && !unicode.IsSpace(rune(s[j+n])) {
+				return -1
+			}
+			continue
+		}
+		if delim[0] == '_' && j+n < len(s) && isWordByte(s[j+n]) {
+			continue
+		}
+		return j
+	}
+	return -1
+}
+
+// isWordByte reports whether a byte is a letter, a digit or part of a multi-byte character
+func isWordByte(c byte) bool {
+	return c >= utf8.RuneSelf || c == '_' || ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// parseLink reads '[text](href "title")' at s[i] and returns its parts and the index after it
+//
+// Balanced brackets may appear inside the text and balanced parentheses inside the destination,
+// brackets and parens map each opening character of s to its closing one as returned by matchPairs.
+func parseLink(s string, i int, brackets, parens map[int]int) (text, href, title string, next int, ok bool) {
+	j, found := brackets[i]
+	if !found || j+1 >= len(s) || s[j+1] != '(' {
+		return "", "", "", 0, false
+	}
+	text = s[i+1 : j]
+
+	k, found := parens[j+1]
+	if !found {
+		return "", "", "", 0, false
+	}
+	inner := strings.TrimSpace(s[j+2 : k])
+	href, title, _ = strings.Cut(inner, " ")
+	title = strings.TrimSpace(title)
+	if len(title) >= 2 && (title[0] == '"' || title[0] == '\'') && title[len(title)-1] == title[0] {
+		title = title[1 : len(title)-1]
+	} else {
+		title = ""
+	}
+	href = strings.TrimSuffix(strings.TrimPrefix(href, "<"), ">")
+	return text, href, title, k + 1, true
+}
+
+// matchPairs returns the index of the matching closing character for every opening character of s that has one,
+// escaped characters are skipped
+func matchPairs(s string, open, close byte) map[int]int {
+	pairs := map[int]int{}
+	var stack []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case open:
+			stack = append(stack, i)
+		case close:
+			if len(stack) > 0 {
+				pairs[stack[len(stack)-1]] = i
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	return pairs
+}
+
+// writeLink writes an anchor around the output of text, or only the text when href is not safe
+func writeLink(b *strings.Builder, href, title string, text func()) {
+	safe, ok := safeURL(href)
+	if !ok {
+		text()
+		return
+	}
+	b.WriteString(`<a href="` + html.EscapeString(safe) + `"`)
+	if title != "" {
+		b.WriteString(` title="` + html.EscapeString(title) + `"`)
+	}
+	b.WriteString(` rel="nofollow noopener noreferrer">`)
+	text()
+	b.WriteString("</a>")
+}
+
+// safeURL returns a link target if it is relative or uses the http, https or mailto scheme
+func safeURL(href string) (string, bool) {
+	// Browsers ignore control characters and spaces inside a scheme, so 'java\tscript:' is dangerous too
+	href = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, href)
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "", "http", "https", "mailto":
+	default:
+		return "", false
+	}
+	return u.String(), true
+}
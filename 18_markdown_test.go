@@ -0,0 +1,81 @@
+package main
+
+import "testing"
+
+// TestRenderMarkdownXSS checks that Markdown with script payloads renders to HTML that cannot run them
+func TestRenderMarkdownXSS(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"javascript link", "[x](javascript:alert(1))", "<p>x</p>\n"},
+		{"mixed case scheme", "[x](JaVaScRiPt:alert(1))", "<p>x</p>\n"},
+		{"tab in scheme", "[x](java\tscript:alert(1))", "<p>x</p>\n"},
+		{"newline in scheme", "[x](java\nscript:alert(1))", "<p>x</p>\n"},
+		{"control character before scheme", "[x](\x01javascript:alert(1))", "<p>x</p>\n"},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>x</p>\n"},
+		{"vbscript link", "[x](vbscript:msgbox(1))", "<p>x</p>\n"},
+		{"javascript autolink", "<javascript:alert(1)>", "<p>javascript:alert(1)</p>\n"},
+		{
+			"quotes in href",
+			`[x](http://e.com/"onmouseover="alert(1))`,
+			`<p><a href="http://e.com/%22onmouseover=%22alert%281%29" rel="nofollow noopener noreferrer">x</a></p>` + "\n",
+		},
+		{
+			"double quotes in title",
+			`[x](http://e.com "a" onclick="alert(1)")`,
+			`<p><a href="http://e.com" title="a&#34; onclick=&#34;alert(1)" rel="nofollow noopener noreferrer">x</a></p>` + "\n",
+		},
+		{
+			"single quotes in title",
+			`[x](http://e.com 'a' onclick='alert(1)')`,
+			`<p><a href="http://e.com" title="a&#39; onclick=&#39;alert(1)" rel="nofollow noopener noreferrer">x</a></p>` + "\n",
+		},
+		{"script tag", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"event handler attribute", "<img src=x onerror=alert(1)>", "<p>&lt;img src=x onerror=alert(1)&gt;</p>\n"},
+		{"escaped entities", "&lt;script&gt;", "<p>&lt;script&gt;</p>\n"},
+		{"script in link text", "[<script>](http://e.com)", `<p><a href="http://e.com" rel="nofollow noopener noreferrer">&lt;script&gt;</a></p>` + "\n"},
+		{"tag in emphasis", "*<b>*", "<p><em>&lt;b&gt;</em></p>\n"},
+		{"script in code fence info", "```\"><script>alert(1)</script>\nx\n```", "<pre><code>x\n</code></pre>\n"},
+		{"image", "![x](http://e.com/a.png)", `<p><a href="http://e.com/a.png" rel="nofollow noopener noreferrer">x</a></p>` + "\n"},
+		{"javascript image", "![x](javascript:alert(1))", "<p>x</p>\n"},
+		{"ampersand in href", "[x](https://e.com/a?b=1&c=2)", `<p><a href="https://e.com/a?b=1&amp;c=2" rel="nofollow noopener noreferrer">x</a></p>` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderMarkdown(tt.input)
+			if got != tt.want {
+				t.Errorf("renderMarkdown(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSafeURL checks which link targets are kept
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		href string
+		ok   bool
+	}{
+		{"https://example.com/a", true},
+		{"http://example.com", true},
+		{"mailto:me@example.com", true},
+		{"/tasks/1", true},
+		{"#notes", true},
+		{"javascript:alert(1)", false},
+		{"JAVASCRIPT:alert(1)", false},
+		{" javascript:alert(1)", false},
+		{"java\tscript:alert(1)", false},
+		{"java\nscript:alert(1)", false},
+		{"java\x00script:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"vbscript:msgbox(1)", false},
+		{"file:///etc/passwd", false},
+	}
+	for _, tt := range tests {
+		if _, ok := safeURL(tt.href); ok != tt.ok {
+			t.Errorf("safeURL(%q) ok = %v, want %v", tt.href, ok, tt.ok)
+		}
+	}
+}